@@ -3,10 +3,11 @@ package main
 import (
 	"log"
 	"videochat/internal/server"
+	w "videochat/pkg/webrtc"
 )
 
 func main() {
-	if err := server.Run(); err != nil {
+	if err := server.Run(w.NewMemoryRegistry()); err != nil {
 		log.Fatalln(err.Error())
 	}
 }
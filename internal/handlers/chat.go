@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"log"
+	"strconv"
+
 	"videochat/pkg/chat"
-	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
@@ -13,18 +16,16 @@ func RoomChat(c *fiber.Ctx) error {
 	return c.Render("chat", fiber.Map{}, "layouts/main")
 }
 
-func RoomChatWebsocket(c *websocket.Conn) {
+func (h *Handlers) RoomChatWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		c.Close()
 		return
 	}
 
-	w.RoomsLock.Lock()
-	// get the room from the global map
-	room := w.Rooms[uuid]
-	w.RoomsLock.Unlock()
-	if room == nil {
+	// get the room from the registry
+	room, ok := h.Rooms.Get(uuid)
+	if !ok {
 		return
 	}
 
@@ -33,29 +34,54 @@ func RoomChatWebsocket(c *websocket.Conn) {
 	}
 
 	// add the connection to the chat hub
-	chat.PeerChatConn(c.Conn, room.Hub)
+	// NOTE nothing ties the websocket to a participant of the room, so it can't be told apart from a guest's, only
+	// the hosts get to moderate the chat (over the DataChannel of their peer connection)
+	chat.PeerChatConn(c.Conn, room.Hub, c.Query("name"), chat.RoleMember)
 }
 
-func StreamChatWebsocket(c *websocket.Conn) {
+func (h *Handlers) StreamChatWebsocket(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
 
-	// get the stream from the global map
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
-		if stream.Hub == nil {
-			// create a new chat hub
-			stream.Hub = chat.NewHub()
-			go stream.Hub.Run()
-		}
-
+	// get the stream from the registry
+	if stream, ok := h.Rooms.GetByStreamID(suuid); ok {
 		// add the connection to the chat hub
-		chat.PeerChatConn(c.Conn, stream.Hub)
-		return
+		chat.PeerChatConn(c.Conn, stream.Hub, c.Query("name"), chat.RoleMember)
+	}
+}
+
+// the most messages a page of the chat history can have
+const maxHistoryPage = 200
 
+// RoomChatHistory pages back through the chat of a room, the next page is asked for with the id of the oldest message
+// of the last one (?before=<id>)
+func (h *Handlers) RoomChatHistory(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	limit := 50
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		limit = n
+	}
+	if limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+
+	messages, err := room.Hub.History(c.Query("before"), limit)
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		log.Println(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	w.RoomsLock.Unlock()
+	return c.JSON(fiber.Map{"messages": messages})
 }
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handlers) RoomRecording(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	return c.JSON(fiber.Map{"recording": room.Recording()})
+}
+
+func (h *Handlers) RoomRecordingStart(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	room, ok := h.getRoom(uuid)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	name, err := room.StartRecording(uuid)
+	if errors.Is(err, w.ErrRecording) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	if err != nil {
+		log.Println(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"name": name})
+}
+
+func (h *Handlers) RoomRecordingStop(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	files, composite, err := room.StopRecording()
+	if errors.Is(err, w.ErrNotRecording) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	if err != nil {
+		log.Println(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{"files": files, "composite": composite})
+}
+
+// getRoom looks up an existing room without creating it
+func (h *Handlers) getRoom(uuid string) (*w.Room, bool) {
+	if uuid == "" {
+		return nil, false
+	}
+	return h.Rooms.Get(uuid)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRoomRecording(t *testing.T) {
+	rooms := w.NewMemoryRegistry()
+	rooms.Create("open")
+	h := New(rooms)
+
+	app := fiber.New()
+	app.Get("/room/:uuid/recording", h.RoomRecording)
+	app.Delete("/room/:uuid/recording", h.RoomRecordingStop)
+
+	tests := []struct {
+		method string
+		room   string
+		status int
+	}{
+		{"GET", "open", fiber.StatusOK},
+		{"GET", "missing", fiber.StatusNotFound},
+		{"DELETE", "open", fiber.StatusConflict},
+		{"DELETE", "missing", fiber.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := app.Test(httptest.NewRequest(test.method, "/room/"+test.room+"/recording", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.room, resp.StatusCode, test.status)
+		}
+	}
+
+	// the handlers never create rooms they are only asked about
+	if _, ok := rooms.Get("missing"); ok {
+		t.Error("missing room was created")
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type restreamRequest struct {
+	URL string `json:"url"`
+}
+
+func (h *Handlers) RoomRestreams(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	return c.JSON(room.Restreams())
+}
+
+func (h *Handlers) RoomRestreamStart(c *fiber.Ctx) error {
+	req := restreamRequest{}
+	if err := c.BodyParser(&req); err != nil || req.URL == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	id, err := room.AddRestream(req.URL)
+	if errors.Is(err, w.ErrRestreamNotAllowed) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	if err != nil {
+		// most likely the destination couldn't be reached or refused the stream
+		log.Println(err)
+		return c.SendStatus(fiber.StatusBadGateway)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": id})
+}
+
+func (h *Handlers) RoomRestreamStop(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	err := room.RemoveRestream(c.Params("id"))
+	if errors.Is(err, w.ErrRestreamNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		log.Println(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *Handlers) RoomRestreamStopAll(c *fiber.Ctx) error {
+	room, ok := h.getRoom(c.Params("uuid"))
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	room.StopRestreams()
+	return c.SendStatus(fiber.StatusNoContent)
+}
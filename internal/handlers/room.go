@@ -1,20 +1,26 @@
 package handlers
 
 import (
-	"crypto/sha256"
 	"fmt"
 	"os"
 	"time"
 
-	"videochat/pkg/chat"
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	guuid "github.com/google/uuid"
-	"github.com/pion/webrtc/v3"
 )
 
+// Handlers serves the rooms and streams kept in a registry
+type Handlers struct {
+	Rooms w.RoomRegistry
+}
+
+func New(rooms w.RoomRegistry) *Handlers {
+	return &Handlers{Rooms: rooms}
+}
+
 // define the struct that we are going to use to define the messages that we send between files
 type websocketMessage struct {
 	Event string `json:"event"`
@@ -25,7 +31,7 @@ func RoomCreate(c *fiber.Ctx) error {
 	return c.Redirect(fmt.Sprintf("/room/%s", guuid.New().String()))
 }
 
-func Room(c *fiber.Ctx) error {
+func (h *Handlers) Room(c *fiber.Ctx) error {
 	uuid := c.Params("uuid")
 
 	if uuid == "" {
@@ -38,78 +44,40 @@ func Room(c *fiber.Ctx) error {
 		ws = "wss"
 	}
 	// get the room or create it if it doesn't exist
-	uuid, suuid, _ := createOrGetRoom(uuid)
+	room := h.Rooms.Create(uuid)
 	// send this data to the frontend for rendering
 	return c.Render("peer", fiber.Map{
 		"RoomWebSocketAddr":   fmt.Sprintf("%s://%s/room/%s/websocket", ws, c.Hostname(), uuid),
 		"RoomLink":            fmt.Sprintf("%s://%s/room/%s", c.Protocol(), c.Hostname(), uuid),
 		"ChatWebSocketAddr":   fmt.Sprintf("%s://%s/room/%s/chat/websocket", ws, c.Hostname(), uuid),
 		"ViewerWebSocketAddr": fmt.Sprintf("%s://%s/room/%s/viewer/websocket", ws, c.Hostname(), uuid),
-		"StreamLink":          fmt.Sprintf("%s://%s/stream/%s", c.Protocol(), c.Hostname(), suuid),
+		"StreamLink":          fmt.Sprintf("%s://%s/stream/%s", c.Protocol(), c.Hostname(), room.StreamID),
+		"ICEConfig":           w.BrowserConfiguration(w.TURNUser(room.StreamID, c.IP())),
 		"Type":                "room",
 	}, "layouts/main")
 }
 
-func RoomWebsocket(c *websocket.Conn) {
+func (h *Handlers) RoomWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 
 	if uuid == "" {
 		return
 	}
 
-	_, _, room := createOrGetRoom(uuid)
-	w.RoomConn(c, room.Peers)
-}
-
-func createOrGetRoom(uuid string) (string, string, *w.Room) {
-	// lock the global map
-	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
-
-	// get the hashed stream uuid
-	h := sha256.New()
-	h.Write([]byte(uuid))
-	suuid := fmt.Sprintf("%x", h.Sum(nil))
-
-	// check if we already have the room
-	if room := w.Rooms[uuid]; room != nil {
-		// check if the stream exists
-		if _, ok := w.Streams[suuid]; !ok {
-			// create the stream
-			w.Streams[suuid] = room
-		}
-		return uuid, suuid, room
-	}
-	// else create the room
-	hub := chat.NewHub()
-	p := &w.Peers{}
-	// set the map for tracking the local RTP streams
-	p.TrackLocals = make(map[string]*webrtc.TrackLocalStaticRTP)
-	room := &w.Room{
-		Peers: p,
-		Hub:   hub,
-	}
-	// add the room to the global maps
-	w.Rooms[uuid] = room
-	w.Streams[suuid] = room
-	go hub.Run()
-	return uuid, suuid, room
+	room := h.Rooms.Create(uuid)
+	w.RoomConn(c, room.Peers, room.Hub)
 }
 
-func RoomViewerWebsocket(c *websocket.Conn) {
+func (h *Handlers) RoomViewerWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return
 	}
 
-	// get the room from the global map
-	w.RoomsLock.Lock()
-	if room, ok := w.Rooms[uuid]; ok {
-		w.RoomsLock.Unlock()
+	// get the room from the registry
+	if room, ok := h.Rooms.Get(uuid); ok {
 		roomViewerConn(c, room.Peers)
-		return
 	}
-	w.RoomsLock.Unlock()
 }
 
 func roomViewerConn(c *websocket.Conn, p *w.Peers) {
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"errors"
+
+	"videochat/pkg/rtmp"
+	w "videochat/pkg/webrtc"
+)
+
+var errUnknownStreamKey = errors.New("the stream key doesn't match a stream")
+
+// RTMPPublish publishes an RTMP client into the stream its stream key (the suuid) belongs to
+func (h *Handlers) RTMPPublish(app, key string) (rtmp.Publisher, error) {
+	// try to get the stream from the registry
+	stream, ok := h.Rooms.GetByStreamID(key)
+	if !ok {
+		return nil, errUnknownStreamKey
+	}
+
+	return w.NewRTMPPublisher(stream.Peers), nil
+}
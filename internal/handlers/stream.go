@@ -1,16 +1,23 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+	"videochat/pkg/hls"
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 )
 
-func Stream(c *fiber.Ctx) error {
+// the number of WebRTC connections a stream can have before new viewers are sent to HLS (0 turns HLS off)
+var HLSViewerThreshold = 50
+
+func (h *Handlers) Stream(c *fiber.Ctx) error {
 	// create the suuid
 	suuid := c.Params("suuid")
 	if suuid == "" {
@@ -23,18 +30,26 @@ func Stream(c *fiber.Ctx) error {
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
 		ws = "wss"
 	}
-	// try to get the stream from the global map
-	w.RoomsLock.Lock()
-	if _, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
-		return c.Render("stream", fiber.Map{
+	// try to get the stream from the registry
+	if stream, ok := h.Rooms.GetByStreamID(suuid); ok {
+		data := fiber.Map{
 			"StreamWebSocketAddr": fmt.Sprintf("%s://%s/stream/%s/websocket", ws, c.Hostname(), suuid),
 			"ChatWebSocketAddr":   fmt.Sprintf("%s://%s/stream/%s/chat/websocket", ws, c.Hostname(), suuid),
 			"ViewerWebSocketAddr": fmt.Sprintf("%s://%s/stream/%s/viewer/websocket", ws, c.Hostname(), suuid),
+			"ICEConfig":           w.BrowserConfiguration(w.TURNUser(suuid, c.IP())),
 			"Type":                "stream",
-		}, "layouts/main")
+		}
+
+		// push the viewer to HLS once the stream has too many WebRTC connections
+		stream.Peers.ListLock.Lock()
+		connections := len(stream.Peers.Connections)
+		stream.Peers.ListLock.Unlock()
+		if HLSViewerThreshold > 0 && connections >= HLSViewerThreshold {
+			stream.HLS()
+			data["HLSAddr"] = fmt.Sprintf("%s://%s/stream/%s/hls/index.m3u8", c.Protocol(), c.Hostname(), suuid)
+		}
+		return c.Render("stream", data, "layouts/main")
 	}
-	w.RoomsLock.Unlock()
 	// if we weren't able to find the stream, return the no stream page
 	return c.Render("stream", fiber.Map{
 		"NoStream": true,
@@ -42,36 +57,91 @@ func Stream(c *fiber.Ctx) error {
 	}, "layouts/main")
 }
 
-func StreamWebsocket(c *websocket.Conn) {
+func (h *Handlers) StreamHLS(c *fiber.Ctx) error {
+	suuid := c.Params("suuid")
+	file := c.Params("file")
+	if suuid == "" || file == "" {
+		c.Status(400)
+		return nil
+	}
+
+	// try to get the stream from the registry
+	stream, ok := h.Rooms.GetByStreamID(suuid)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	muxer := stream.HLS()
+
+	// the playlist changes with every segment so it must not be cached
+	if file == "index.m3u8" {
+		// blocking playlist reload, hold the request until the segment (or part) the player asked for is ready
+		// (a part is only meaningful along with the segment it belongs to)
+		msnQuery, partQuery := c.Query("_HLS_msn"), c.Query("_HLS_part")
+		if partQuery != "" && msnQuery == "" {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if msnQuery != "" {
+			msn, err := strconv.Atoi(msnQuery)
+			if err != nil || msn < 0 {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			part := -1
+			if partQuery != "" {
+				if part, err = strconv.Atoi(partQuery); err != nil || part < 0 {
+					return c.SendStatus(fiber.StatusBadRequest)
+				}
+			}
+			err = muxer.WaitPlaylist(msn, part)
+			if errors.Is(err, hls.ErrTooFarAhead) {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			if err != nil {
+				return c.SendStatus(fiber.StatusServiceUnavailable)
+			}
+		}
+		playlist := muxer.Playlist()
+		if playlist == nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		return c.Send(playlist)
+	}
+
+	data, ok := muxer.File(file)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if strings.HasSuffix(file, ".m4s") {
+		c.Set(fiber.HeaderContentType, "video/iso.segment")
+	} else {
+		c.Set(fiber.HeaderContentType, "video/mp4")
+	}
+	return c.Send(data)
+}
+
+func (h *Handlers) StreamWebsocket(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
-	// try to get the stream from the global map
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
+	// try to get the stream from the registry
+	if stream, ok := h.Rooms.GetByStreamID(suuid); ok {
 		// NOTE there might be a slight typo here
-		w.StreamConn(c, stream.Peers)
-		return
+		w.StreamConn(c, stream.Peers, stream.Hub)
 	}
-	w.RoomsLock.Unlock()
 }
 
-func StreamViewerWebsocket(c *websocket.Conn) {
+func (h *Handlers) StreamViewerWebsocket(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
-	// try to get the stream from the global map
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
+	// try to get the stream from the registry
+	if stream, ok := h.Rooms.GetByStreamID(suuid); ok {
 		// NOTE there might be a slight typo here
 		viewerConn(c, stream.Peers)
-		return
 	}
-	w.RoomsLock.Unlock()
 }
 
 func viewerConn(c *websocket.Conn, p *w.Peers) {
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"videochat/pkg/hls"
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestStreamHLSPlaylist(t *testing.T) {
+	// blocking requests give up after 3 segment durations
+	defer func(config hls.Config) { w.HLSConfig = config }(w.HLSConfig)
+	w.HLSConfig = hls.LowLatencyConfig
+	w.HLSConfig.SegmentDuration = 20 * time.Millisecond
+
+	rooms := w.NewMemoryRegistry()
+	room := rooms.Create("room")
+	defer room.StopHLS()
+	h := New(rooms)
+
+	app := fiber.New()
+	app.Get("/stream/:suuid/hls/:file", h.StreamHLS)
+
+	tests := []struct {
+		name   string
+		stream string
+		query  string
+		status int
+	}{
+		{"unknown stream", "missing", "", fiber.StatusNotFound},
+		{"nothing published yet", room.StreamID, "", fiber.StatusNotFound},
+		{"part without a segment", room.StreamID, "?_HLS_part=0", fiber.StatusBadRequest},
+		{"segment isn't a number", room.StreamID, "?_HLS_msn=first", fiber.StatusBadRequest},
+		{"negative segment", room.StreamID, "?_HLS_msn=-1", fiber.StatusBadRequest},
+		{"part isn't a number", room.StreamID, "?_HLS_msn=0&_HLS_part=first", fiber.StatusBadRequest},
+		{"negative part", room.StreamID, "?_HLS_msn=0&_HLS_part=-1", fiber.StatusBadRequest},
+		{"segment too far ahead", room.StreamID, "?_HLS_msn=5", fiber.StatusBadRequest},
+		{"segment never published", room.StreamID, "?_HLS_msn=0", fiber.StatusServiceUnavailable},
+		{"part never published", room.StreamID, "?_HLS_msn=0&_HLS_part=1", fiber.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", "/stream/"+test.stream+"/hls/index.m3u8"+test.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handlers) StreamWHEP(c *fiber.Ctx) error {
+	suuid := c.Params("suuid")
+	if suuid == "" {
+		c.Status(400)
+		return nil
+	}
+
+	// WHEP offers are sent as plain SDP
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/sdp") {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+
+	// try to get the stream from the registry
+	stream, ok := h.Rooms.GetByStreamID(suuid)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	// subscribe the player to the tracks of the stream
+	id, answer, err := w.WHEPConn(string(c.Body()), suuid, c.IP(), stream.Peers)
+	if err != nil {
+		log.Println(err)
+		if errors.Is(err, w.ErrNoTracks) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// point the client at the resource it can PATCH candidates to and DELETE to end the session
+	c.Location(fmt.Sprintf("/stream/%s/whep/%s", suuid, id))
+	c.Set(fiber.HeaderContentType, "application/sdp")
+	return c.Status(fiber.StatusCreated).SendString(answer)
+}
+
+func StreamWHEPPatch(c *fiber.Ctx) error {
+	suuid := c.Params("suuid")
+	id := c.Params("id")
+	if suuid == "" || id == "" {
+		c.Status(400)
+		return nil
+	}
+
+	// trickled candidates are sent as a SDP fragment
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/trickle-ice-sdpfrag") {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+
+	if err := w.AddSessionCandidates(id, suuid, w.SessionWHEP, string(c.Body())); err != nil {
+		if errors.Is(err, w.ErrSessionNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		log.Println(err)
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// StreamWHIPDelete ends a WHIP session
+func StreamWHIPDelete(c *fiber.Ctx) error {
+	return deleteSession(c, w.SessionWHIP)
+}
+
+// StreamWHEPDelete ends a WHEP session
+func StreamWHEPDelete(c *fiber.Ctx) error {
+	return deleteSession(c, w.SessionWHEP)
+}
+
+// deleteSession ends the session in the URL, it has to belong to the stream in the URL and be of the given kind
+func deleteSession(c *fiber.Ctx, kind w.SessionKind) error {
+	suuid := c.Params("suuid")
+	id := c.Params("id")
+	if suuid == "" || id == "" {
+		c.Status(400)
+		return nil
+	}
+
+	if err := w.CloseSession(id, suuid, kind); err != nil {
+		if errors.Is(err, w.ErrSessionNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		log.Println(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
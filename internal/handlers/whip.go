@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handlers) StreamWHIP(c *fiber.Ctx) error {
+	suuid := c.Params("suuid")
+	if suuid == "" {
+		c.Status(400)
+		return nil
+	}
+
+	// the suuid is public, publishing takes the room uuid it's derived from
+	if !whipAuthorized(c, suuid) {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	// WHIP offers are sent as plain SDP
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/sdp") {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+
+	// try to get the stream from the registry
+	stream, ok := h.Rooms.GetByStreamID(suuid)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	// publish the offered tracks into the stream
+	id, answer, err := w.WHIPConn(string(c.Body()), suuid, c.IP(), stream.Peers)
+	if err != nil {
+		log.Println(err)
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// point the client at the resource it can DELETE to end the session
+	c.Location(fmt.Sprintf("/stream/%s/whip/%s", suuid, id))
+	c.Set(fiber.HeaderContentType, "application/sdp")
+	return c.Status(fiber.StatusCreated).SendString(answer)
+}
+
+// whipAuthorized checks that the bearer token of the request is the room uuid of the stream
+func whipAuthorized(c *fiber.Ctx, suuid string) bool {
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(w.StreamID(token)), []byte(suuid)) == 1
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestStreamWHIPAuthorization(t *testing.T) {
+	rooms := w.NewMemoryRegistry()
+	room := rooms.Create("room")
+	h := New(rooms)
+
+	app := fiber.New()
+	app.Post("/stream/:suuid/whip", h.StreamWHIP)
+
+	tests := []struct {
+		name          string
+		stream        string
+		authorization string
+		status        int
+	}{
+		{"no token", room.StreamID, "", fiber.StatusUnauthorized},
+		{"not a bearer token", room.StreamID, "Basic room", fiber.StatusUnauthorized},
+		{"the stream id as token", room.StreamID, "Bearer " + room.StreamID, fiber.StatusUnauthorized},
+		{"token of another room", room.StreamID, "Bearer other", fiber.StatusUnauthorized},
+		{"unknown stream", "missing", "Bearer room", fiber.StatusUnauthorized},
+		// the offer is no SDP, getting that far means the token was accepted
+		{"room uuid as token", room.StreamID, "Bearer room", fiber.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/stream/"+test.stream+"/whip", strings.NewReader("offer"))
+		req.Header.Set(fiber.HeaderContentType, "application/sdp")
+		if test.authorization != "" {
+			req.Header.Set(fiber.HeaderAuthorization, test.authorization)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
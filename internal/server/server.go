@@ -2,16 +2,22 @@ package server
 
 import (
 	"flag"
+	"log"
 	"os"
+	"strings"
 	"time"
 
 	"videochat/internal/handlers"
+	"videochat/pkg/hls"
+	"videochat/pkg/rtmp"
+	"videochat/pkg/transcode"
 
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/template/html"
 	"github.com/gofiber/websocket/v2"
 )
@@ -20,11 +26,73 @@ var (
 	addr = flag.String("addr", ":"+os.Getenv("PORT"), "")
 	cert = flag.String("cert", "", "")
 	key  = flag.String("key", "", "")
+	// the number of WebRTC viewers after which new stream viewers are sent to HLS
+	hlsThreshold = flag.Int("hls-threshold", 50, "")
+	// serve low latency HLS (partial segments and blocking playlist reloads)
+	hlsLowLatency = flag.Bool("hls-low-latency", false, "")
+	// the directory room recordings are written to
+	recordings = flag.String("recordings", "recordings", "")
+	// the ffmpeg binary used to transcode and to render the composite recordings
+	ffmpeg = flag.String("ffmpeg", "ffmpeg", "")
+	// the address of the RTMP ingest listener (empty turns it off)
+	rtmpAddr = flag.String("rtmp-addr", ":1935", "")
+	// the hosts rooms can be restreamed to (comma separated, "*.example.com" allows the subdomains, empty turns restreaming off)
+	restreamHosts = flag.String("restream-hosts", "", "")
+	// the ICE servers handed to the server and browser connections (comma separated urls)
+	stunURLs = flag.String("stun", "stun:stun.l.google.com:19302", "")
+	turnURLs = flag.String("turn", "", "")
+	// static TURN credentials, or the secret shared with the TURN server to generate time limited ones
+	turnUsername = flag.String("turn-username", "", "")
+	turnPassword = flag.String("turn-password", "", "")
+	turnSecret   = flag.String("turn-secret", "", "")
+	turnTTL      = flag.Duration("turn-ttl", 24*time.Hour, "")
+	// force every connection through TURN
+	iceRelayOnly = flag.Bool("ice-relay-only", false, "")
+	// how long a room can be empty before it's closed
+	roomIdleTimeout = flag.Duration("room-idle-timeout", 5*time.Minute, "")
+	// hold new participants of a room in a lobby until a host admits them
+	lobby = flag.Bool("lobby", false, "")
+	// the directory the chat history is kept in (only kept in memory when empty)
+	chatHistory = flag.String("chat-history", "", "")
+	// the number of messages chat clients are sent when they join
+	chatBackfill = flag.Int("chat-backfill", 50, "")
+	// the messages per second chat clients can keep up and how many they can send in a burst (0 turns the limit off)
+	chatRate  = flag.Float64("chat-rate", 1, "")
+	chatBurst = flag.Int("chat-burst", 5, "")
 )
 
-func Run() error {
+// Run starts the server with the rooms kept in the registry
+func Run(rooms w.RoomRegistry) error {
 	flag.Parse()
 
+	h := handlers.New(rooms)
+
+	handlers.HLSViewerThreshold = *hlsThreshold
+	w.RecordingsDir = *recordings
+	transcode.FFmpegPath = *ffmpeg
+	if *hlsLowLatency {
+		w.HLSConfig = hls.LowLatencyConfig
+	}
+	w.RoomIdleTimeout = *roomIdleTimeout
+	w.RestreamHosts = splitList(*restreamHosts)
+	w.LobbyEnabled = *lobby
+	w.ChatHistoryDir = *chatHistory
+	w.ChatConfig.Backfill = *chatBackfill
+	w.ChatConfig.RateLimit.Rate = *chatRate
+	w.ChatConfig.RateLimit.Burst = *chatBurst
+	w.OnRoomEvent(func(e w.RoomEvent) {
+		log.Println("room", e.Room, e.State)
+	})
+	w.ICE = &w.ICEConfig{
+		STUN:      splitList(*stunURLs),
+		TURN:      splitList(*turnURLs),
+		Username:  *turnUsername,
+		Password:  *turnPassword,
+		Secret:    *turnSecret,
+		TTL:       *turnTTL,
+		RelayOnly: *iceRelayOnly,
+	}
+
 	// check if we should be using the default address value
 	if *addr == ":" {
 		*addr = ":8080"
@@ -33,28 +101,51 @@ func Run() error {
 	engine := html.New("./views", ".html")
 	app := fiber.New(fiber.Config{Views: engine})
 	app.Use(logger.New())
-	app.Use(cors.New())
+	// a panic in a handler fails the request instead of taking every room down with it
+	app.Use(recover.New())
+	// expose the location header so browser WHIP/WHEP clients can find their session resource
+	app.Use(cors.New(cors.Config{ExposeHeaders: fiber.HeaderLocation}))
 
 	// define all the routes
 	app.Get("/", handlers.Welcome)
 	app.Get("/room/create", handlers.RoomCreate)
-	app.Get("/room/:uuid", handlers.Room)
-	app.Get("/room/:uuid/websocket", websocket.New(handlers.RoomWebsocket, websocket.Config{
+	app.Get("/room/:uuid", h.Room)
+	app.Get("/room/:uuid/websocket", websocket.New(h.RoomWebsocket, websocket.Config{
 		HandshakeTimeout: 10 * time.Second}))
 	app.Get("/room/:uuid/chat", handlers.RoomChat)
-	app.Get("/room/:uuid/chat/websocket", websocket.New(handlers.RoomChatWebsocket))
-	app.Get("/room/:uuid/viewer/websocket", websocket.New(handlers.RoomViewerWebsocket))
-	app.Get("/stream/:ssuid", handlers.Stream)
-	app.Get("/stream/:ssuid/websocket", websocket.New(handlers.StreamWebsocket, websocket.Config{
+	app.Get("/room/:uuid/chat/websocket", websocket.New(h.RoomChatWebsocket))
+	app.Get("/room/:uuid/chat/history", h.RoomChatHistory)
+	app.Get("/room/:uuid/viewer/websocket", websocket.New(h.RoomViewerWebsocket))
+	app.Get("/room/:uuid/recording", h.RoomRecording)
+	app.Post("/room/:uuid/recording", h.RoomRecordingStart)
+	app.Delete("/room/:uuid/recording", h.RoomRecordingStop)
+	app.Get("/room/:uuid/restream", h.RoomRestreams)
+	app.Post("/room/:uuid/restream", h.RoomRestreamStart)
+	app.Delete("/room/:uuid/restream", h.RoomRestreamStopAll)
+	app.Delete("/room/:uuid/restream/:id", h.RoomRestreamStop)
+	app.Get("/stream/:suuid", h.Stream)
+	app.Get("/stream/:suuid/websocket", websocket.New(h.StreamWebsocket, websocket.Config{
 		HandshakeTimeout: 10 * time.Second,
 	}))
-	app.Get("/stream/:ssuid/chat/websocket", websocket.New(handlers.StreamChatWebsocket))
-	app.Get("/stream/:ssuid/viewer/websocket", websocket.New(handlers.StreamViewerWebsocket))
+	app.Get("/stream/:suuid/chat/websocket", websocket.New(h.StreamChatWebsocket))
+	app.Get("/stream/:suuid/viewer/websocket", websocket.New(h.StreamViewerWebsocket))
+	app.Get("/stream/:suuid/hls/:file", h.StreamHLS)
+	app.Post("/stream/:suuid/whip", h.StreamWHIP)
+	app.Delete("/stream/:suuid/whip/:id", handlers.StreamWHIPDelete)
+	app.Post("/stream/:suuid/whep", h.StreamWHEP)
+	app.Patch("/stream/:suuid/whep/:id", handlers.StreamWHEPPatch)
+	app.Delete("/stream/:suuid/whep/:id", handlers.StreamWHEPDelete)
 	app.Static("/", "./assets")
 
-	w.Rooms = make(map[string]*w.Room)
-	w.Streams = make(map[string]*w.Room)
-	go dispatchKeyFrames()
+	go dispatchKeyFrames(rooms)
+	go closeIdleRooms(rooms)
+	if *rtmpAddr != "" {
+		go func() {
+			if err := rtmp.ListenAndServe(*rtmpAddr, h.RTMPPublish); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 	// check for a nonempty certificate
 	if *cert != "" {
 		return app.ListenTLS(*addr, *cert, *key)
@@ -63,10 +154,27 @@ func Run() error {
 
 }
 
-func dispatchKeyFrames() {
+func dispatchKeyFrames(rooms w.RoomRegistry) {
 	for range time.NewTicker(3 * time.Second).C {
-		for _, room := range w.Rooms {
+		for _, room := range rooms.List() {
 			room.Peers.DispatchKeyFrame()
 		}
 	}
 }
+
+func closeIdleRooms(rooms w.RoomRegistry) {
+	for range time.NewTicker(10 * time.Second).C {
+		rooms.CloseIdle()
+	}
+}
+
+// splitList splits a comma separated flag, dropping the empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -1,30 +1,38 @@
 package chat
 
 import (
-	"bytes"
 	"log"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fasthttp/websocket"
+	guuid "github.com/google/uuid"
 )
 
 const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 8192
+	// the longest display name a client can have (in characters)
+	maxDisplayNameLength = 64
 )
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
+// messages are sent as JSON, the ones queued up together are separated by newlines
+var newline = []byte{'\n'}
 
 type Client struct {
 	// specify which hub this client is in
 	Hub  *Hub
 	Conn *websocket.Conn
 	Send chan []byte
+	// who the messages of the client are stamped with
+	Sender Sender
+	// the messages in a row the client missed because its queue was full (only touched by the hub)
+	missed int
+	// limits the messages the client sends (only touched by whoever calls Receive)
+	bucket *tokenBucket
 }
 
 var upgrader = websocket.FastHTTPUpgrader{
@@ -35,7 +43,7 @@ var upgrader = websocket.FastHTTPUpgrader{
 func (c *Client) readPump() {
 	// close the connection when the function returns
 	defer func() {
-		c.Hub.unregister <- c
+		c.Leave()
 		c.Conn.Close()
 	}()
 
@@ -52,9 +60,38 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		// parse the message then broadcast it to all clients in the hub
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.Hub.broadcast <- message
+		if !c.Receive(message) {
+			return
+		}
+	}
+}
+
+// Receive handles a message the client sent, it returns false once the hub is stopped
+// NOTE it has to be called from a single goroutine
+func (c *Client) Receive(message []byte) bool {
+	// drop the messages over the rate limit, and mute the clients that keep at it
+	// (moderators can't be muted, they only get the warnings)
+	if now := time.Now(); !c.bucket.take(now) {
+		if c.bucket.violate(now) && c.Sender.Role != RoleModerator {
+			c.Hub.mute(c, c.bucket.limit.MuteDuration)
+		} else {
+			c.Hub.sendTo(c, newServerMessage(TypeWarning, ErrTooFast.Error()))
+		}
+		return true
+	}
+
+	// parse the message then broadcast it to all clients in the hub
+	m, err := parseMessage(message, c.Sender)
+	if err != nil {
+		// let the client know why its message went nowhere
+		c.Hub.sendTo(c, newServerMessage(TypeError, err.Error()))
+		return true
+	}
+	select {
+	case c.Hub.broadcast <- clientMessage{client: c, message: m}:
+		return true
+	case <-c.Hub.done:
+		return false
 	}
 }
 
@@ -71,6 +108,8 @@ func (c *Client) writePump() {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
+				// the hub dropped the client
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 			w, err := c.Conn.NextWriter(websocket.TextMessage)
@@ -98,12 +137,58 @@ func (c *Client) writePump() {
 	}
 }
 
-func PeerChatConn(c *websocket.Conn, hub *Hub) {
+// PeerChatConn connects a chat client to the hub, the messages of the client are sent under the display name
+func PeerChatConn(c *websocket.Conn, hub *Hub, displayName string, role Role) {
 	// crate a new client and register it to the hub
-	client := &Client{Hub: hub, Conn: c, Send: make(chan []byte, 256)}
-	client.Hub.register <- client
+	client, ok := NewClient(hub, displayName, role)
+	if !ok {
+		// the room is gone
+		c.Close()
+		return
+	}
+	client.Conn = c
 
 	// start the read and write pumps (used to read and write messages to the client from the past)
 	go client.writePump()
 	client.readPump()
 }
+
+// NewClient registers a client with the hub, it returns false if the hub is stopped
+// clients that don't connect over the chat websocket (like the DataChannels of the peer connections) pass what the
+// client sends to Receive and write out what is queued on Send until it's closed, then Leave
+func NewClient(hub *Hub, displayName string, role Role) (*Client, bool) {
+	client := &Client{
+		Hub:    hub,
+		Send:   make(chan []byte, 256),
+		Sender: newSender(displayName, role),
+		bucket: newTokenBucket(hub.config.RateLimit),
+	}
+	select {
+	case hub.register <- client:
+		return client, true
+	case <-hub.done:
+		return nil, false
+	}
+}
+
+// Leave unregisters the client from the hub
+func (c *Client) Leave() {
+	// the hub doesn't need to hear about it once it's stopped
+	select {
+	case c.Hub.unregister <- c:
+	case <-c.Hub.done:
+	}
+}
+
+// newSender gives a client its id, along with a display name if it didn't pick one
+func newSender(displayName string, role Role) Sender {
+	id := guuid.New().String()
+	displayName = strings.TrimSpace(displayName)
+	if displayName == "" {
+		displayName = "Guest " + id[:4]
+	}
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		displayName = string([]rune(displayName)[:maxDisplayNameLength])
+	}
+	return Sender{ID: id, DisplayName: displayName, Role: role}
+}
@@ -1,18 +1,59 @@
 package chat
 
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many messages in a row a client can miss because its queue is full before it's dropped
+const maxMissedMessages = 64
+
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan clientMessage
 	register   chan *Client
 	unregister chan *Client
+	// messages for a single client
+	direct chan clientMessage
+	// mutes of clients that keep going over the rate limit
+	autoMute chan clientMessage
+
+	// who is muted and banned
+	moderation moderation
+
+	// the history of the chat, new clients are sent the last messages of it
+	store  Store
+	config HubConfig
+
+	// closed to stop the hub
+	done     chan struct{}
+	stopOnce sync.Once
+	// the number of clients, kept up to date by Run for everyone else to read
+	count atomic.Int32
+}
+
+// clientMessage is a message from (or for) a single client
+type clientMessage struct {
+	client  *Client
+	message *Message
 }
 
-func NewHub() *Hub {
+// NewHub creates a hub that keeps its history in the store
+func NewHub(store Store, config HubConfig) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		store:      store,
+		config:     config,
+		broadcast:  make(chan clientMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		direct:     make(chan clientMessage),
+		autoMute:   make(chan clientMessage),
+		moderation: newModeration(),
 		clients:    make(map[*Client]bool),
+		done:       make(chan struct{}),
 	}
 }
 
@@ -21,7 +62,13 @@ func (h *Hub) Run() {
 		select {
 		// in the case that we want to register a client for this hub
 		case client := <-h.register:
+			// banned clients are disconnected right away
+			if h.moderation.isBanned(client) {
+				close(client.Send)
+				continue
+			}
 			h.clients[client] = true
+			h.sendBackfill(client)
 		// in the case that we want to unregister a client for this hub
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
@@ -29,15 +76,161 @@ func (h *Hub) Run() {
 				close(client.Send)
 			}
 		// in the case that we want to broadcast a message to all clients in this hub
-		case message := <-h.broadcast:
+		case in := <-h.broadcast:
+			// the client might have been dropped or banned in the meantime
+			if !h.clients[in.client] {
+				continue
+			}
+			h.handle(in.client, in.message)
+		// in the case that a message is only meant for one client
+		case d := <-h.direct:
+			h.reply(d.client, d.message)
+		// in the case that a client keeps flooding the chat
+		case m := <-h.autoMute:
+			if h.clients[m.client] {
+				h.moderation.muted[m.client.Sender.ID] = *m.message.Until
+				h.fanOut(m.message)
+			}
+		// in the case that the hub is stopped, disconnect everyone
+		case <-h.done:
 			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
+				close(client.Send)
+				delete(h.clients, client)
+			}
+			h.count.Store(0)
+			if err := h.store.Close(); err != nil {
+				log.Println(err)
 			}
+			return
 		}
+		h.count.Store(int32(len(h.clients)))
+	}
+}
+
+// handle enforces the moderation on a message from a client before fanning it out
+func (h *Hub) handle(client *Client, message *Message) {
+	switch message.Type {
+	case TypeMessage:
+		if h.moderation.isMuted(client, time.Now()) {
+			h.reply(client, newServerMessage(TypeError, ErrMuted.Error()))
+			return
+		}
+		if err := h.store.Append(message); err != nil {
+			log.Println(err)
+		}
+		h.fanOut(message)
+	case TypeDelete, TypeMute, TypeBan:
+		h.moderate(client, message)
+	}
+}
+
+// fanOut sends a message to every client
+func (h *Hub) fanOut(message *Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for client := range h.clients {
+		h.deliver(client, data)
+	}
+}
+
+// reply sends a message to a single client, if it's still connected
+func (h *Hub) reply(client *Client, message *Message) {
+	if !h.clients[client] {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
 	}
+	h.deliver(client, data)
+}
+
+// sendBackfill catches a new client up on what was said before it joined
+func (h *Hub) sendBackfill(client *Client) {
+	// the backfill has to fit in the queue of the client or it gets dropped
+	n := h.config.Backfill
+	if n > cap(client.Send) {
+		n = cap(client.Send)
+	}
+	messages, err := h.store.Last(n)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !h.deliver(client, data) {
+			return
+		}
+	}
+}
+
+// History returns up to n messages sent before the message with the id (or the last n when the id is empty),
+// oldest first
+func (h *Hub) History(before string, n int) ([]*Message, error) {
+	return h.store.Before(before, n)
+}
+
+// deliver queues a message for a client, a client whose queue is full misses the message and is only dropped once
+// it has missed too many in a row
+func (h *Hub) deliver(client *Client, data []byte) bool {
+	select {
+	case client.Send <- data:
+		client.missed = 0
+		return true
+	default:
+		client.missed++
+		if client.missed >= maxMissedMessages {
+			log.Println("dropping chat client", client.Sender.ID, "it can't keep up")
+			h.drop(client)
+		}
+		return false
+	}
+}
+
+// drop disconnects a client
+func (h *Hub) drop(client *Client) {
+	close(client.Send)
+	delete(h.clients, client)
+}
+
+// sendTo sends a message to a single client of the hub
+func (h *Hub) sendTo(client *Client, message *Message) {
+	select {
+	case h.direct <- clientMessage{client: client, message: message}:
+	case <-h.done:
+	}
+}
+
+// mute mutes a client on behalf of the server
+func (h *Hub) mute(client *Client, duration time.Duration) {
+	message := newServerMessage(TypeMute, "")
+	message.Target = client.Sender.ID
+	until := message.Timestamp.Add(duration)
+	message.Until = &until
+
+	select {
+	case h.autoMute <- clientMessage{client: client, message: message}:
+	case <-h.done:
+	}
+}
+
+// Stop disconnects the clients and ends Run
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// Clients returns the number of clients connected to the hub
+func (h *Hub) Clients() int {
+	return int(h.count.Load())
 }
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	guuid "github.com/google/uuid"
+)
+
+// the types of messages
+const (
+	// a chat message from a client
+	TypeMessage = "message"
+	// sent back to a client whose message was rejected
+	TypeError = "error"
+	// sent back to a client that is sending messages too fast
+	TypeWarning = "warning"
+
+	// moderation, sent by moderators and broadcast once they're carried out
+	// delete a message (the target) for everyone
+	TypeDelete = "delete"
+	// stop a user (the target) from sending messages for a while
+	TypeMute = "mute"
+	// disconnect a user (the target) and keep it out of the hub
+	TypeBan = "ban"
+)
+
+const (
+	// the longest body a message can have (in characters)
+	maxBodyLength = 2000
+	// how long users are muted for when the moderator doesn't say
+	defaultMuteDuration = 5 * time.Minute
+	maxMuteDuration     = 24 * time.Hour
+)
+
+type Role string
+
+const (
+	RoleMember    Role = "member"
+	RoleModerator Role = "moderator"
+)
+
+var (
+	ErrBadMessage   = errors.New("message isn't valid json")
+	ErrBadType      = errors.New("message type can't be sent by clients")
+	ErrEmptyBody    = errors.New("message body is empty")
+	ErrBodyTooLong  = errors.New("message body is too long")
+	ErrBodyEncoding = errors.New("message body isn't valid utf-8")
+	ErrNoTarget     = errors.New("message has no target")
+	ErrBadDuration  = errors.New("mute duration is out of range")
+)
+
+// Message is the envelope of everything sent to the chat clients
+type Message struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Sender    Sender    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	Body      string    `json:"body,omitempty"`
+
+	// what a moderation message applies to (the id of a message or a user) and until when
+	Target string     `json:"target,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Sender identifies who a message came from, it's empty for messages from the server
+type Sender struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Role        Role   `json:"role"`
+}
+
+// incomingMessage is the part of the envelope clients get to fill in, the rest is stamped by the server
+type incomingMessage struct {
+	Type   string `json:"type"`
+	Body   string `json:"body"`
+	Target string `json:"target"`
+	// how long to mute for (in seconds)
+	Duration int `json:"duration"`
+}
+
+// parseMessage validates a message from a client and stamps it with the sender and the time
+func parseMessage(data []byte, sender Sender) (*Message, error) {
+	in := incomingMessage{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, ErrBadMessage
+	}
+	switch in.Type {
+	case TypeMessage:
+	case TypeDelete, TypeMute, TypeBan:
+		return parseModeration(in, sender)
+	default:
+		return nil, ErrBadType
+	}
+	if !utf8.ValidString(in.Body) {
+		return nil, ErrBodyEncoding
+	}
+	body := strings.TrimSpace(in.Body)
+	if body == "" {
+		return nil, ErrEmptyBody
+	}
+	if utf8.RuneCountInString(body) > maxBodyLength {
+		return nil, ErrBodyTooLong
+	}
+
+	return &Message{
+		ID:        guuid.New().String(),
+		Type:      in.Type,
+		Sender:    sender,
+		Timestamp: time.Now().UTC(),
+		Body:      body,
+	}, nil
+}
+
+// parseModeration validates a moderation message, the hub checks that the sender is allowed to send it
+func parseModeration(in incomingMessage, sender Sender) (*Message, error) {
+	if in.Target == "" {
+		return nil, ErrNoTarget
+	}
+	m := &Message{
+		ID:        guuid.New().String(),
+		Type:      in.Type,
+		Sender:    sender,
+		Timestamp: time.Now().UTC(),
+		Target:    in.Target,
+	}
+
+	if in.Type == TypeMute {
+		duration := time.Duration(in.Duration) * time.Second
+		if in.Duration == 0 {
+			duration = defaultMuteDuration
+		}
+		if duration < 0 || duration > maxMuteDuration {
+			return nil, ErrBadDuration
+		}
+		until := m.Timestamp.Add(duration)
+		m.Until = &until
+	}
+	return m, nil
+}
+
+// newServerMessage creates a message that comes from the server rather than a client
+func newServerMessage(typ, body string) *Message {
+	return &Message{
+		ID:        guuid.New().String(),
+		Type:      typ,
+		Timestamp: time.Now().UTC(),
+		Body:      body,
+	}
+}
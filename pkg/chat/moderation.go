@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	ErrNotModerator    = errors.New("only moderators can do that")
+	ErrModeratorTarget = errors.New("moderators can't be muted or banned")
+	ErrMuted           = errors.New("you are muted")
+)
+
+// moderation keeps track of who is muted and banned, it's only touched by Run
+// NOTE users are muted and banned by their sender id, not by the address they connect from which can be shared by
+// everyone behind the same NAT or proxy
+type moderation struct {
+	muted  map[string]time.Time
+	banned map[string]bool
+}
+
+func newModeration() moderation {
+	return moderation{
+		muted:  make(map[string]time.Time),
+		banned: make(map[string]bool),
+	}
+}
+
+func (m moderation) isMuted(client *Client, now time.Time) bool {
+	if until, ok := m.muted[client.Sender.ID]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(m.muted, client.Sender.ID)
+	}
+	return false
+}
+
+func (m moderation) isBanned(client *Client) bool {
+	return m.banned[client.Sender.ID]
+}
+
+// moderate carries out a moderation message and lets everyone know
+func (h *Hub) moderate(moderator *Client, message *Message) {
+	if moderator.Sender.Role != RoleModerator {
+		h.reply(moderator, newServerMessage(TypeError, ErrNotModerator.Error()))
+		return
+	}
+
+	if message.Type == TypeDelete {
+		if err := h.store.Delete(message.Target); err != nil {
+			if !errors.Is(err, ErrMessageNotFound) {
+				log.Println(err)
+			}
+			h.reply(moderator, newServerMessage(TypeError, err.Error()))
+			return
+		}
+		h.fanOut(message)
+		return
+	}
+
+	// the user might not be connected anymore, its id is muted or banned anyway
+	targets := []*Client{}
+	for client := range h.clients {
+		if client.Sender.ID != message.Target {
+			continue
+		}
+		if client.Sender.Role == RoleModerator {
+			h.reply(moderator, newServerMessage(TypeError, ErrModeratorTarget.Error()))
+			return
+		}
+		targets = append(targets, client)
+	}
+
+	if message.Type == TypeMute {
+		h.moderation.muted[message.Target] = *message.Until
+	} else {
+		h.moderation.banned[message.Target] = true
+	}
+	h.fanOut(message)
+
+	if message.Type == TypeBan {
+		for _, client := range targets {
+			h.drop(client)
+		}
+	}
+}
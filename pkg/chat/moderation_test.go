@@ -0,0 +1,41 @@
+package chat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestModerationOnlyHitsTheTarget(t *testing.T) {
+	tests := []struct {
+		moderation string
+		// what the target and the other member are sent
+		target, other string
+	}{
+		{TypeMute, "mute,error,message", "mute,message"},
+		{TypeBan, "ban", "ban,message"},
+	}
+	for _, test := range tests {
+		hub := NewHub(NewMemoryStore(10), HubConfig{})
+		go hub.Run()
+
+		// the members could be behind the same NAT, only the one the moderator picked is affected
+		moderator, _ := NewClient(hub, "moderator", RoleModerator)
+		target, _ := NewClient(hub, "target", RoleMember)
+		other, _ := NewClient(hub, "other", RoleMember)
+
+		moderator.Receive([]byte(fmt.Sprintf(`{"type":%q,"target":%q}`, test.moderation, target.Sender.ID)))
+		target.Receive([]byte(`{"type":"message","body":"hi"}`))
+		other.Receive([]byte(`{"type":"message","body":"hi"}`))
+		hub.Stop()
+
+		if types := received(t, target); types != test.target {
+			t.Errorf("%s: target was sent %s, want %s", test.moderation, types, test.target)
+		}
+		if types := received(t, other); types != test.other {
+			t.Errorf("%s: other member was sent %s, want %s", test.moderation, types, test.other)
+		}
+		if types := received(t, moderator); types != test.other {
+			t.Errorf("%s: moderator was sent %s, want %s", test.moderation, types, test.other)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrTooFast = errors.New("you are sending messages too fast")
+
+// RateLimit is how fast the clients of a hub can send messages
+type RateLimit struct {
+	// messages per second a client can keep up, and how many it can send in a burst (0 turns the limit off)
+	Rate  float64
+	Burst int
+	// how many times a client can hit the limit within the window before it's muted, and for how long
+	Violations      int
+	ViolationWindow time.Duration
+	MuteDuration    time.Duration
+}
+
+// HubConfig configures a hub
+type HubConfig struct {
+	// the number of messages a client is sent when it joins
+	Backfill  int
+	RateLimit RateLimit
+}
+
+var DefaultHubConfig = HubConfig{
+	Backfill: 50,
+	RateLimit: RateLimit{
+		Rate:            1,
+		Burst:           5,
+		Violations:      3,
+		ViolationWindow: time.Minute,
+		MuteDuration:    5 * time.Minute,
+	},
+}
+
+// tokenBucket limits the messages of a single client, it's only touched by the readPump of the client
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+
+	violations    int
+	lastViolation time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// take takes a token for a message, it returns false when the client is over the limit
+func (b *tokenBucket) take(now time.Time) bool {
+	if b.limit.Rate <= 0 || b.limit.Burst <= 0 {
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// violate records the client hitting the limit, it returns true when the client should be muted
+func (b *tokenBucket) violate(now time.Time) bool {
+	// forget about the violations that are too far back
+	if now.Sub(b.lastViolation) > b.limit.ViolationWindow {
+		b.violations = 0
+	}
+	b.lastViolation = now
+	b.violations++
+
+	if b.limit.Violations > 0 && b.violations >= b.limit.Violations {
+		b.violations = 0
+		return true
+	}
+	return false
+}
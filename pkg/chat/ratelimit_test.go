@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		limit RateLimit
+		// when each message is sent (after the bucket was created) and whether it gets through
+		steps []struct {
+			at   time.Duration
+			take bool
+		}
+	}{
+		{
+			name:  "burst then refill",
+			limit: RateLimit{Rate: 1, Burst: 2},
+			steps: []struct {
+				at   time.Duration
+				take bool
+			}{
+				{0, true},
+				{0, true},
+				{0, false},
+				{500 * time.Millisecond, false},
+				{time.Second, true},
+				{time.Second, false},
+				// a long pause only refills up to the burst
+				{10 * time.Second, true},
+				{10 * time.Second, true},
+				{10 * time.Second, false},
+			},
+		},
+		{
+			name:  "fractional rate",
+			limit: RateLimit{Rate: 0.5, Burst: 1},
+			steps: []struct {
+				at   time.Duration
+				take bool
+			}{
+				{0, true},
+				{time.Second, false},
+				{2 * time.Second, true},
+				{3 * time.Second, false},
+			},
+		},
+		{
+			name:  "turned off",
+			limit: RateLimit{},
+			steps: []struct {
+				at   time.Duration
+				take bool
+			}{
+				{0, true},
+				{0, true},
+				{0, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		b := newTokenBucket(test.limit)
+		b.last = start
+		for i, step := range test.steps {
+			if take := b.take(start.Add(step.at)); take != step.take {
+				t.Errorf("%s: message %d at %v got through %v, want %v", test.name, i, step.at, take, step.take)
+			}
+		}
+	}
+}
+
+func TestTokenBucketViolate(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		limit RateLimit
+		// when the client hits the limit and whether it gets muted for it
+		steps []struct {
+			at   time.Duration
+			mute bool
+		}
+	}{
+		{
+			name:  "muted on the third violation",
+			limit: RateLimit{Violations: 3, ViolationWindow: time.Minute},
+			steps: []struct {
+				at   time.Duration
+				mute bool
+			}{
+				{0, false},
+				{10 * time.Second, false},
+				{20 * time.Second, true},
+				// the count starts over after a mute
+				{30 * time.Second, false},
+				{40 * time.Second, false},
+				{50 * time.Second, true},
+			},
+		},
+		{
+			name:  "violations spread out are forgotten",
+			limit: RateLimit{Violations: 2, ViolationWindow: time.Minute},
+			steps: []struct {
+				at   time.Duration
+				mute bool
+			}{
+				{0, false},
+				{2 * time.Minute, false},
+				{4 * time.Minute, false},
+				{4*time.Minute + time.Second, true},
+			},
+		},
+		{
+			name:  "never muted",
+			limit: RateLimit{ViolationWindow: time.Minute},
+			steps: []struct {
+				at   time.Duration
+				mute bool
+			}{
+				{0, false},
+				{time.Second, false},
+				{2 * time.Second, false},
+			},
+		},
+	}
+	for _, test := range tests {
+		b := newTokenBucket(test.limit)
+		for i, step := range test.steps {
+			if mute := b.violate(start.Add(step.at)); mute != step.mute {
+				t.Errorf("%s: violation %d at %v muted %v, want %v", test.name, i, step.at, mute, step.mute)
+			}
+		}
+	}
+}
+
+// received returns the types of the messages queued for a client until its queue is closed
+func received(t *testing.T, client *Client) string {
+	t.Helper()
+	types := []string{}
+	for data := range client.Send {
+		m := &Message{}
+		if err := json.Unmarshal(data, m); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, m.Type)
+	}
+	return strings.Join(types, ",")
+}
+
+func TestFloodingModeratorIsNotMuted(t *testing.T) {
+	hub := NewHub(NewMemoryStore(10), HubConfig{RateLimit: RateLimit{
+		// slow enough that nothing refills during the test
+		Rate:            0.001,
+		Burst:           1,
+		Violations:      2,
+		ViolationWindow: time.Minute,
+		MuteDuration:    time.Minute,
+	}})
+	go hub.Run()
+
+	member, _ := NewClient(hub, "member", RoleMember)
+	moderator, _ := NewClient(hub, "moderator", RoleModerator)
+
+	message := []byte(`{"type":"message","body":"hi"}`)
+	for _, client := range []*Client{member, moderator} {
+		for i := 0; i < 3; i++ {
+			client.Receive(message)
+		}
+	}
+	hub.Stop()
+
+	// the member is warned then muted, the moderator only ever gets warned and can still talk
+	if types := received(t, member); types != "message,warning,mute,message" {
+		t.Errorf("member was sent %s", types)
+	}
+	if types := received(t, moderator); types != "message,mute,message,warning,warning" {
+		t.Errorf("moderator was sent %s", types)
+	}
+}
@@ -0,0 +1,319 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// Store keeps the chat history of a hub
+type Store interface {
+	Append(m *Message) error
+	// Last returns the last n messages, oldest first
+	Last(n int) ([]*Message, error)
+	// Before returns up to n messages sent before the message with the id (or the last n when the id is empty),
+	// oldest first
+	Before(id string, n int) ([]*Message, error)
+	// Delete takes a message out of the history
+	Delete(id string) error
+	Close() error
+}
+
+// MemoryStore keeps the last messages in a ring buffer
+type MemoryStore struct {
+	lock     sync.Mutex
+	messages []*Message
+	// where the next message goes once the buffer is full
+	next int
+	full bool
+}
+
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{messages: make([]*Message, size)}
+}
+
+func (s *MemoryStore) Append(m *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.messages) == 0 {
+		return nil
+	}
+	s.messages[s.next] = m
+	s.next = (s.next + 1) % len(s.messages)
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+// ordered returns the messages in the buffer, oldest first
+func (s *MemoryStore) ordered() []*Message {
+	messages := s.messages[:s.next]
+	if s.full {
+		messages = append(append([]*Message{}, s.messages[s.next:]...), s.messages[:s.next]...)
+	}
+	// skip the deleted messages
+	ordered := []*Message{}
+	for _, m := range messages {
+		if m != nil {
+			ordered = append(ordered, m)
+		}
+	}
+	return ordered
+}
+
+func (s *MemoryStore) Last(n int) ([]*Message, error) {
+	return s.Before("", n)
+}
+
+func (s *MemoryStore) Before(id string, n int) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	messages := s.ordered()
+	if id != "" {
+		end := indexOf(messages, id)
+		if end < 0 {
+			return nil, ErrMessageNotFound
+		}
+		messages = messages[:end]
+	}
+	return lastN(messages, n), nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the slot stays empty until the buffer comes around to it again
+	i := indexOf(s.messages, id)
+	if i < 0 {
+		return ErrMessageNotFound
+	}
+	s.messages[i] = nil
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore appends the messages to a file as JSON lines, the last messages are kept in memory for the backfills
+// NOTE deleting a message appends a delete message for it, the deleted ids are kept in memory
+// NOTE older messages are read back without holding the lock (the lines that are already in the file never change),
+// so a long history doesn't hold up the messages being appended
+type FileStore struct {
+	lock sync.Mutex
+	file *os.File
+	// the size of the file, it only ever grows
+	size   int64
+	recent *MemoryStore
+	// where the line of every message in the file starts (deleted messages are taken out)
+	offsets map[string]int64
+	deleted map[string]bool
+}
+
+// OpenFileStore opens (or creates) the history file, the last messages of the file are loaded into memory
+func OpenFileStore(path string, recent int) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &FileStore{
+		file:    file,
+		recent:  NewMemoryStore(recent),
+		offsets: make(map[string]int64),
+		deleted: make(map[string]bool),
+	}
+	// the first pass finds the deleted messages so the second one can skip them
+	size, err := s.scan(info.Size(), s.deleted, func(m *Message, offset int64) bool {
+		s.offsets[m.ID] = offset
+		return true
+	})
+	if err == nil {
+		_, err = s.scan(size, s.deleted, func(m *Message, _ int64) bool {
+			s.recent.Append(m)
+			return true
+		})
+	}
+	// drop the line that got cut off by a crash, or the next message would be appended to it
+	if err == nil && size < info.Size() {
+		err = file.Truncate(size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	for id := range s.deleted {
+		delete(s.offsets, id)
+	}
+	s.size = size
+	return s, nil
+}
+
+// scan reads the messages in the first size bytes of the file until f returns false, along with the offsets of
+// their lines, it adds the delete messages it comes across to deleted and skips the messages that are in there
+// it returns where the last complete line ends
+// NOTE the file is read with ReadAt, so this doesn't need the lock
+func (s *FileStore) scan(size int64, deleted map[string]bool, f func(m *Message, offset int64) bool) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, size))
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without a newline is whatever got cut off by a crash
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		start := offset
+		offset += int64(len(line))
+
+		m := &Message{}
+		// skip whatever got mangled
+		if err := json.Unmarshal(line, m); err != nil {
+			continue
+		}
+		if m.Type == TypeDelete {
+			deleted[m.Target] = true
+			continue
+		}
+		if deleted[m.ID] {
+			continue
+		}
+		if !f(m, start) {
+			return offset, nil
+		}
+	}
+}
+
+func (s *FileStore) Append(m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.write(data); err != nil {
+		return err
+	}
+	s.offsets[m.ID] = s.size - int64(len(data)) - 1
+	return s.recent.Append(m)
+}
+
+// write appends a line to the file, the lock has to be held
+func (s *FileStore) write(data []byte) error {
+	n, err := s.file.Write(append(data, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileStore) Last(n int) ([]*Message, error) {
+	return s.Before("", n)
+}
+
+func (s *FileStore) Before(id string, n int) ([]*Message, error) {
+	// most requests are for the latest messages, which are in memory
+	if messages, err := s.recent.Before(id, n); err == nil && (len(messages) == n || !s.truncated()) {
+		return messages, nil
+	}
+
+	// only the part of the file before the message has to be read
+	s.lock.Lock()
+	end := s.size
+	if id != "" {
+		offset, ok := s.offsets[id]
+		if !ok {
+			s.lock.Unlock()
+			return nil, ErrMessageNotFound
+		}
+		end = offset
+	}
+	deleted := make(map[string]bool, len(s.deleted))
+	for id := range s.deleted {
+		deleted[id] = true
+	}
+	s.lock.Unlock()
+
+	// keep a window of the last n messages before the one asked for
+	window := []*Message{}
+	if _, err := s.scan(end, deleted, func(m *Message, _ int64) bool {
+		window = lastN(append(window, m), n)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// truncated checks if the file has messages that are no longer in memory
+func (s *FileStore) truncated() bool {
+	s.recent.lock.Lock()
+	defer s.recent.lock.Unlock()
+	return s.recent.full
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// only messages that are in the file can be deleted
+	if _, ok := s.offsets[id]; !ok {
+		return ErrMessageNotFound
+	}
+
+	data, err := json.Marshal(&Message{Type: TypeDelete, Target: id})
+	if err != nil {
+		return err
+	}
+	if err := s.write(data); err != nil {
+		return err
+	}
+	// the message might have rolled out of memory already
+	s.recent.Delete(id)
+	delete(s.offsets, id)
+	s.deleted[id] = true
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+func indexOf(messages []*Message, id string) int {
+	for i, m := range messages {
+		if m != nil && m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastN returns the last n messages of the slice
+func lastN(messages []*Message, n int) []*Message {
+	if n >= 0 && len(messages) > n {
+		return messages[len(messages)-n:]
+	}
+	return messages
+}
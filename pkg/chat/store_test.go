@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testMessage(id string) *Message {
+	return &Message{ID: id, Type: TypeMessage, Body: "body of " + id}
+}
+
+func ids(messages []*Message) string {
+	list := []string{}
+	for _, m := range messages {
+		list = append(list, m.ID)
+	}
+	return strings.Join(list, ",")
+}
+
+func openTestFileStore(t *testing.T, path string, recent int) *FileStore {
+	t.Helper()
+	s, err := OpenFileStore(path, recent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStores(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore(10) }},
+		{"file", func(t *testing.T) Store { return openTestFileStore(t, filepath.Join(t.TempDir(), "chat.log"), 10) }},
+		// most of the history is only in the file
+		{"file with a small memory", func(t *testing.T) Store { return openTestFileStore(t, filepath.Join(t.TempDir(), "chat.log"), 3) }},
+	}
+
+	// every step runs against the history m1 to m6, after the deletes of the steps before it
+	steps := []struct {
+		name   string
+		run    func(s Store) ([]*Message, error)
+		result string
+		err    error
+	}{
+		{"last", func(s Store) ([]*Message, error) { return s.Last(3) }, "m4,m5,m6", nil},
+		{"last of everything", func(s Store) ([]*Message, error) { return s.Last(10) }, "m1,m2,m3,m4,m5,m6", nil},
+		{"before", func(s Store) ([]*Message, error) { return s.Before("m4", 2) }, "m2,m3", nil},
+		{"before the first", func(s Store) ([]*Message, error) { return s.Before("m1", 2) }, "", nil},
+		{"before an unknown message", func(s Store) ([]*Message, error) { return s.Before("nope", 2) }, "", ErrMessageNotFound},
+		{"delete", func(s Store) ([]*Message, error) { return nil, s.Delete("m2") }, "", nil},
+		{"delete again", func(s Store) ([]*Message, error) { return nil, s.Delete("m2") }, "", ErrMessageNotFound},
+		{"delete an unknown message", func(s Store) ([]*Message, error) { return nil, s.Delete("nope") }, "", ErrMessageNotFound},
+		{"last skips deleted", func(s Store) ([]*Message, error) { return s.Last(10) }, "m1,m3,m4,m5,m6", nil},
+		{"before skips deleted", func(s Store) ([]*Message, error) { return s.Before("m4", 10) }, "m1,m3", nil},
+		{"before a deleted message", func(s Store) ([]*Message, error) { return s.Before("m2", 1) }, "", ErrMessageNotFound},
+		{"delete a recent message", func(s Store) ([]*Message, error) { return nil, s.Delete("m6") }, "", nil},
+		{"last after deleting a recent message", func(s Store) ([]*Message, error) { return s.Last(2) }, "m4,m5", nil},
+	}
+
+	for _, store := range stores {
+		s := store.open(t)
+		for _, id := range []string{"m1", "m2", "m3", "m4", "m5", "m6"} {
+			if err := s.Append(testMessage(id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, step := range steps {
+			messages, err := step.run(s)
+			if !errors.Is(err, step.err) {
+				t.Errorf("%s: %s: got %v, want %v", store.name, step.name, err, step.err)
+				continue
+			}
+			if result := ids(messages); result != step.result {
+				t.Errorf("%s: %s: got [%s], want [%s]", store.name, step.name, result, step.result)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMemoryStoreWraps(t *testing.T) {
+	s := NewMemoryStore(3)
+	for _, id := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		s.Append(testMessage(id))
+	}
+	if messages, _ := s.Last(10); ids(messages) != "m3,m4,m5" {
+		t.Errorf("got [%s], want [m3,m4,m5]", ids(messages))
+	}
+	if _, err := s.Before("m1", 1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("a message that rolled out was found: %v", err)
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat", "history.log")
+
+	s := openTestFileStore(t, path, 2)
+	for _, id := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		if err := s.Append(testMessage(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"m2", "m4"} {
+		if err := s.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// the delete messages are carried over, whether the message is in memory or not
+	for _, want := range []string{"m1,m3,m5", "m1,m3,m5,m6"} {
+		s = openTestFileStore(t, path, 2)
+		if messages, err := s.Last(10); err != nil || ids(messages) != want {
+			t.Errorf("got [%s] %v, want [%s]", ids(messages), err, want)
+		}
+		if messages, _ := s.Last(2); len(messages) != 2 {
+			t.Errorf("%d recent messages, want 2", len(messages))
+		}
+		if err := s.Delete("m2"); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("deleted message deleted again: %v", err)
+		}
+		if messages, err := s.Before("m5", 10); err != nil || ids(messages) != "m1,m3" {
+			t.Errorf("before m5: got [%s] %v, want [m1,m3]", ids(messages), err)
+		}
+		s.Append(testMessage("m6"))
+		s.Close()
+	}
+}
+
+func TestFileStoreTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	history := `{"id":"m1","type":"message"}
+not json at all
+{"id":"m2","type":"message"}
+{"id":"m3","ty`
+	if err := os.WriteFile(path, []byte(history), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestFileStore(t, path, 10)
+	if messages, err := s.Last(10); err != nil || ids(messages) != "m1,m2" {
+		t.Errorf("got [%s] %v, want [m1,m2]", ids(messages), err)
+	}
+	if err := s.Delete("m3"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("the cut off message was deleted: %v", err)
+	}
+	// the next message doesn't get glued to the cut off line
+	if err := s.Append(testMessage("m4")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestFileStore(t, path, 1)
+	defer s.Close()
+	if messages, err := s.Last(10); err != nil || ids(messages) != "m1,m2,m4" {
+		t.Errorf("after reopening got [%s] %v, want [m1,m2,m4]", ids(messages), err)
+	}
+	if messages, err := s.Before("m4", 1); err != nil || ids(messages) != "m2" {
+		t.Errorf("before m4 got [%s] %v, want [m2]", ids(messages), err)
+	}
+}
+
+func TestFileStoreConcurrentBackfill(t *testing.T) {
+	s := openTestFileStore(t, filepath.Join(t.TempDir(), "chat.log"), 2)
+	defer s.Close()
+	for _, id := range []string{"m1", "m2", "m3"} {
+		s.Append(testMessage(id))
+	}
+
+	// backfills read the file while messages keep being appended
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Append(testMessage("new"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if messages, err := s.Before("m3", 10); err != nil || ids(messages) != "m1,m2" {
+			t.Fatalf("got [%s] %v, want [m1,m2]", ids(messages), err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package composite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+	"time"
+
+	"videochat/pkg/transcode"
+)
+
+// the size of each participant in the grid
+const (
+	cellWidth  = 640
+	cellHeight = 360
+)
+
+var ErrNothingToCompose = errors.New("the recording has no tracks")
+
+// Compose renders the participant files of the manifest into a single WebM file with the videos in a grid and
+// the audio mixed together
+func Compose(m *Manifest, output string) error {
+	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+	filters := []string{}
+	videos, audios := []string{}, []string{}
+
+	for i, p := range m.Participants {
+		args = append(args, "-i", p.File)
+		video, audio := m.offsets(p)
+
+		// start every track from zero and delay it to the point it was captured at
+		if p.Video != nil {
+			label := fmt.Sprintf("v%d", i)
+			filters = append(filters, fmt.Sprintf(
+				"[%d:v]setpts=PTS-STARTPTS,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,"+
+					"fps=30,tpad=start_duration=%.3f:color=black[%s]",
+				i, cellWidth, cellHeight, cellWidth, cellHeight, video.Seconds(), label))
+			videos = append(videos, "["+label+"]")
+		}
+		if p.Audio != nil {
+			label := fmt.Sprintf("a%d", i)
+			filters = append(filters, fmt.Sprintf("[%d:a]asetpts=PTS-STARTPTS,adelay=%d:all=1[%s]", i, audio/time.Millisecond, label))
+			audios = append(audios, "["+label+"]")
+		}
+	}
+	if len(videos) == 0 && len(audios) == 0 {
+		return ErrNothingToCompose
+	}
+
+	if len(videos) > 0 {
+		filters = append(filters, grid(videos))
+		args = append(args, "-map", "[video]", "-c:v", "libvpx", "-b:v", "2M", "-deadline", "good", "-cpu-used", "4")
+	}
+	if len(audios) > 0 {
+		filters = append(filters, fmt.Sprintf("%samix=inputs=%d:duration=longest[audio]", strings.Join(audios, ""), len(audios)))
+		args = append(args, "-map", "[audio]", "-c:a", "libopus", "-b:a", "128k")
+	}
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), output)
+
+	out, err := exec.Command(transcode.FFmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// grid lays the videos out in rows, as close to a square as possible
+func grid(videos []string) string {
+	if len(videos) == 1 {
+		return videos[0] + "null[video]"
+	}
+
+	columns := int(math.Ceil(math.Sqrt(float64(len(videos)))))
+	layout := []string{}
+	for i := range videos {
+		layout = append(layout, fmt.Sprintf("%d_%d", i%columns*cellWidth, i/columns*cellHeight))
+	}
+	// fill the empty cells of the last row with black
+	return fmt.Sprintf("%sxstack=inputs=%d:layout=%s:fill=black[video]", strings.Join(videos, ""), len(videos), strings.Join(layout, "|"))
+}
@@ -0,0 +1,93 @@
+package composite
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Manifest describes the per participant files of a recording and how to line them up
+type Manifest struct {
+	Name string `json:"name"`
+	// when the recording started, the track starts are relative to it
+	Start        time.Time     `json:"start"`
+	Participants []Participant `json:"participants"`
+}
+
+type Participant struct {
+	File  string `json:"file"`
+	Video *Track `json:"video,omitempty"`
+	Audio *Track `json:"audio,omitempty"`
+}
+
+// Track records the timing of the first frame of a track in a participant file
+type Track struct {
+	ClockRate uint32 `json:"clockRate"`
+	// the RTP timestamp of the first frame and when it arrived (relative to the start of the recording)
+	FirstTimestamp uint32        `json:"firstTimestamp"`
+	Start          time.Duration `json:"start"`
+	// the time of the first frame that made it into the file, on the same timeline as Start
+	// (it's later than Start when the file had to wait for a key frame)
+	FileStart time.Duration `json:"fileStart"`
+	// the first sender report of the track, nil if the publisher never sent one
+	Report *SenderReport `json:"report,omitempty"`
+}
+
+// SenderReport maps the RTP timestamps of a track to the wallclock of the publisher
+type SenderReport struct {
+	NTPTime time.Time `json:"ntpTime"`
+	RTPTime uint32    `json:"rtpTime"`
+	// when the report reached the server
+	Arrival time.Time `json:"arrival"`
+}
+
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	return m, json.Unmarshal(data, m)
+}
+
+// offsets returns when the first frame of the video and audio of the participant was captured,
+// relative to the start of the recording
+// NOTE the sender reports put the tracks of a participant on the same clock, without them we fall back to arrival times
+func (m *Manifest) offsets(p Participant) (video, audio time.Duration) {
+	// the offset between the clock of the publisher and ours, the smallest one has the least network delay in it
+	clockOffset, synced := time.Duration(0), false
+	for _, t := range []*Track{p.Video, p.Audio} {
+		if t == nil || t.Report == nil {
+			continue
+		}
+		if offset := t.Report.Arrival.Sub(t.Report.NTPTime); !synced || offset < clockOffset {
+			clockOffset, synced = offset, true
+		}
+	}
+
+	start := func(t *Track) time.Duration {
+		if t == nil {
+			return 0
+		}
+		offset := t.FileStart
+		if synced && t.Report != nil && t.ClockRate != 0 {
+			// the capture time of the first frame on the clock of the publisher, moved onto ours
+			delta := time.Duration(int32(t.FirstTimestamp-t.Report.RTPTime)) * time.Second / time.Duration(t.ClockRate)
+			captured := t.Report.NTPTime.Add(delta).Add(clockOffset)
+			offset = captured.Sub(m.Start) + t.FileStart - t.Start
+		}
+		if offset < 0 {
+			return 0
+		}
+		return offset
+	}
+	return start(p.Video), start(p.Audio)
+}
@@ -0,0 +1,144 @@
+package composite
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testManifest() *Manifest {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &Manifest{
+		Name:  "room-1",
+		Start: start,
+		Participants: []Participant{
+			{
+				File: "alice.webm",
+				Video: &Track{
+					ClockRate:      90000,
+					FirstTimestamp: 180000,
+					Start:          time.Second,
+					FileStart:      1200 * time.Millisecond,
+					Report: &SenderReport{
+						NTPTime: start.Add(900 * time.Millisecond),
+						RTPTime: 171000,
+						Arrival: start.Add(950 * time.Millisecond),
+					},
+				},
+				Audio: &Track{ClockRate: 48000, FirstTimestamp: 960, Start: 500 * time.Millisecond, FileStart: 500 * time.Millisecond},
+			},
+			{File: "bob.ogg", Audio: &Track{ClockRate: 48000, Start: 2 * time.Second, FileStart: 2 * time.Second}},
+		},
+	}
+}
+
+func TestManifestJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	m := testManifest()
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recorder and whatever renders the recording later agree on this shape
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "name": "room-1",
+  "start": "2024-05-01T12:00:00Z",
+  "participants": [
+    {
+      "file": "alice.webm",
+      "video": {
+        "clockRate": 90000,
+        "firstTimestamp": 180000,
+        "start": 1000000000,
+        "fileStart": 1200000000,
+        "report": {
+          "ntpTime": "2024-05-01T12:00:00.9Z",
+          "rtpTime": 171000,
+          "arrival": "2024-05-01T12:00:00.95Z"
+        }
+      },
+      "audio": {
+        "clockRate": 48000,
+        "firstTimestamp": 960,
+        "start": 500000000,
+        "fileStart": 500000000
+      }
+    },
+    {
+      "file": "bob.ogg",
+      "audio": {
+        "clockRate": 48000,
+        "firstTimestamp": 0,
+        "start": 2000000000,
+        "fileStart": 2000000000
+      }
+    }
+  ]
+}`
+	if string(data) != want {
+		t.Errorf("got\n%s\nwant\n%s", data, want)
+	}
+
+	loaded, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Errorf("loaded %+v, want %+v", loaded, m)
+	}
+}
+
+func TestManifestOffsets(t *testing.T) {
+	m := testManifest()
+	tests := []struct {
+		name         string
+		participant  Participant
+		video, audio time.Duration
+	}{
+		{
+			// the first video frame was captured 100ms after the report (9000 ticks at 90kHz), the publisher's clock is
+			// 50ms behind ours and the file starts 200ms into the track
+			name:        "synced by the sender report",
+			participant: m.Participants[0],
+			video:       1250 * time.Millisecond,
+			audio:       500 * time.Millisecond,
+		},
+		{
+			name:        "arrival times",
+			participant: m.Participants[1],
+			audio:       2 * time.Second,
+		},
+		{
+			name:        "before the recording started",
+			participant: Participant{Audio: &Track{FileStart: -time.Second}},
+		},
+	}
+	for _, test := range tests {
+		video, audio := m.offsets(test.participant)
+		if video != test.video || audio != test.audio {
+			t.Errorf("%s: got %v and %v, want %v and %v", test.name, video, audio, test.video, test.audio)
+		}
+	}
+}
+
+func TestGrid(t *testing.T) {
+	tests := []struct {
+		videos []string
+		want   string
+	}{
+		{[]string{"[v0]"}, "[v0]null[video]"},
+		{[]string{"[v0]", "[v1]"}, "[v0][v1]xstack=inputs=2:layout=0_0|640_0:fill=black[video]"},
+		{[]string{"[v0]", "[v1]", "[v2]"}, "[v0][v1][v2]xstack=inputs=3:layout=0_0|640_0|0_360:fill=black[video]"},
+	}
+	for _, test := range tests {
+		if got := grid(test.videos); got != test.want {
+			t.Errorf("grid(%v) = %q, want %q", test.videos, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// the NAL unit types we look at
+const (
+	NALUTypeIDR = 5
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+	NALUTypeAUD = 9
+)
+
+var errShortSPS = errors.New("sps is too short")
+
+// SplitAVCC splits a sample of 4 byte length prefixed NAL units, empty units are left out so callers can read
+// the header byte
+func SplitAVCC(data []byte) [][]byte {
+	nalus := [][]byte{}
+	for len(data) > 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			break
+		}
+		if size > 0 {
+			nalus = append(nalus, data[:size])
+		}
+		data = data[size:]
+	}
+	return nalus
+}
+
+// JoinAVCC is the reverse of SplitAVCC
+func JoinAVCC(nalus [][]byte) []byte {
+	data := []byte{}
+	for _, nalu := range nalus {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+// bitReader reads the exp-golomb coded fields of a SPS
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errShortSPS
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned exp-golomb value
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+	}
+	v, err := r.bits(zeros)
+	return (1 << zeros) - 1 + v, err
+}
+
+// se reads a signed exp-golomb value
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 0 {
+		return -int32(v / 2), err
+	}
+	return int32(v/2) + 1, err
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL unit
+func unescapeRBSP(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	for i := 0; i < len(nalu); i++ {
+		if i >= 2 && nalu[i] == 3 && nalu[i-1] == 0 && nalu[i-2] == 0 {
+			continue
+		}
+		out = append(out, nalu[i])
+	}
+	return out
+}
+
+// SPSResolution parses the width and height out of a SPS
+func SPSResolution(sps []byte) (uint16, uint16, error) {
+	if len(sps) < 4 {
+		return 0, 0, errShortSPS
+	}
+	r := &bitReader{data: unescapeRBSP(sps[1:])}
+
+	profile, _ := r.bits(8)
+	// skip the constraint flags and level
+	if _, err := r.bits(16); err != nil {
+		return 0, 0, err
+	}
+	// seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			separateColourPlane, _ = r.bit()
+		}
+		// bit depths and qpprime_y_zero_transform_bypass_flag
+		r.ue()
+		r.ue()
+		r.bit()
+		if scalingMatrix, _ := r.bit(); scalingMatrix == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if present, _ := r.bit(); present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					delta, err := r.se()
+					if err != nil {
+						return 0, 0, err
+					}
+					next = (last + delta + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	r.ue()
+	pocType, _ := r.ue()
+	switch pocType {
+	case 0:
+		r.ue()
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		cycle, _ := r.ue()
+		for i := uint32(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+
+	// max_num_ref_frames and gaps_in_frame_num_value_allowed_flag
+	r.ue()
+	r.bit()
+
+	widthInMbs, _ := r.ue()
+	heightInMapUnits, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.bit()
+	}
+	r.bit()
+
+	width := (widthInMbs + 1) * 16
+	height := (2 - frameMbsOnly) * (heightInMapUnits + 1) * 16
+
+	if cropping, _ := r.bit(); cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// the crop is in chroma samples
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		if chromaFormat != 0 && separateColourPlane == 0 {
+			if chromaFormat < 3 {
+				cropX = 2
+			}
+			if chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	return uint16(width), uint16(height), nil
+}
@@ -0,0 +1,152 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter builds the sps test vectors
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) bits(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>i&1 == 1 {
+			w.data[len(w.data)-1] |= 0x80 >> (w.pos % 8)
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(n, 0)
+	w.bits(n+1, v)
+}
+
+// the fields of an sps that change its resolution
+type testSPS struct {
+	profile          uint32
+	chromaFormat     uint32
+	widthInMbs       uint32
+	heightInMapUnits uint32
+	frameMbsOnly     uint32
+	crop             []uint32
+}
+
+func (s testSPS) bytes() []byte {
+	w := &bitWriter{}
+	w.bits(8, 0x67)
+	w.bits(8, s.profile)
+	w.bits(16, 0x001F)
+	w.ue(0)
+	if s.profile == 100 {
+		w.ue(s.chromaFormat)
+		if s.chromaFormat == 3 {
+			w.bits(1, 0)
+		}
+		w.ue(0)
+		w.ue(0)
+		w.bits(1, 0)
+		w.bits(1, 0)
+	}
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bits(1, 0)
+	w.ue(s.widthInMbs - 1)
+	w.ue(s.heightInMapUnits - 1)
+	w.bits(1, s.frameMbsOnly)
+	if s.frameMbsOnly == 0 {
+		w.bits(1, 0)
+	}
+	w.bits(1, 1)
+	if s.crop != nil {
+		w.bits(1, 1)
+		for _, c := range s.crop {
+			w.ue(c)
+		}
+	} else {
+		w.bits(1, 0)
+	}
+	// vui_parameters_present_flag and the rbsp stop bit
+	w.bits(1, 0)
+	w.bits(1, 1)
+	return w.data
+}
+
+func TestSPSResolution(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           testSPS
+		width, height uint16
+	}{
+		{"baseline 720p", testSPS{profile: 66, widthInMbs: 80, heightInMapUnits: 45, frameMbsOnly: 1}, 1280, 720},
+		{"baseline 360p", testSPS{profile: 66, widthInMbs: 40, heightInMapUnits: 23, frameMbsOnly: 1, crop: []uint32{0, 0, 0, 4}}, 640, 360},
+		{"high 1080p", testSPS{profile: 100, chromaFormat: 1, widthInMbs: 120, heightInMapUnits: 68, frameMbsOnly: 1, crop: []uint32{0, 0, 0, 4}}, 1920, 1080},
+		{"high 4:4:4 cropped", testSPS{profile: 100, chromaFormat: 3, widthInMbs: 120, heightInMapUnits: 68, frameMbsOnly: 1, crop: []uint32{0, 0, 0, 8}}, 1920, 1080},
+		{"interlaced", testSPS{profile: 77, widthInMbs: 45, heightInMapUnits: 18, frameMbsOnly: 0}, 720, 576},
+	}
+	for _, test := range tests {
+		width, height, err := SPSResolution(test.sps.bytes())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if width != test.width || height != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, width, height, test.width, test.height)
+		}
+	}
+}
+
+func TestSPSResolutionTruncated(t *testing.T) {
+	sps := testSPS{profile: 66, widthInMbs: 80, heightInMapUnits: 45, frameMbsOnly: 1}.bytes()
+	for _, n := range []int{0, 3, 5} {
+		if _, _, err := SPSResolution(sps[:n]); err == nil {
+			t.Errorf("%d bytes of sps: expected an error", n)
+		}
+	}
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	tests := []struct {
+		in, out []byte
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 3, 1}, []byte{0, 0, 1}},
+		{[]byte{0, 0, 3, 0, 0, 3, 2}, []byte{0, 0, 0, 0, 2}},
+		{[]byte{0, 3, 1}, []byte{0, 3, 1}},
+	}
+	for _, test := range tests {
+		if out := unescapeRBSP(test.in); !bytes.Equal(out, test.out) {
+			t.Errorf("unescapeRBSP(%x) = %x, want %x", test.in, out, test.out)
+		}
+	}
+}
+
+func TestAVCC(t *testing.T) {
+	nalus := [][]byte{{0x67, 1, 2}, {0x68, 3}, {0x65}}
+	data := JoinAVCC(nalus)
+	want := []byte{0, 0, 0, 3, 0x67, 1, 2, 0, 0, 0, 2, 0x68, 3, 0, 0, 0, 1, 0x65}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("JoinAVCC = %x, want %x", data, want)
+	}
+	split := SplitAVCC(data)
+	if len(split) != len(nalus) {
+		t.Fatalf("SplitAVCC returned %d nalus, want %d", len(split), len(nalus))
+	}
+	for i := range nalus {
+		if !bytes.Equal(split[i], nalus[i]) {
+			t.Errorf("nalu %d is %x, want %x", i, split[i], nalus[i])
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package hls
+
+import (
+	"encoding/binary"
+)
+
+// sample flags of key frames (depends on no other sample) and of every other video frame
+const (
+	keyFrameFlags    = 0x02000000
+	nonKeyFrameFlags = 0x01010000
+)
+
+type trackKind int
+
+const (
+	videoTrack trackKind = iota
+	audioTrack
+)
+
+// trackInfo describes a track of the fragmented MP4 output
+type trackInfo struct {
+	id        uint32
+	kind      trackKind
+	timescale uint32
+
+	// H.264 parameter sets and the resolution they describe
+	sps    []byte
+	pps    []byte
+	width  uint16
+	height uint16
+
+	// Opus settings
+	channels uint16
+	preSkip  uint16
+}
+
+type sample struct {
+	// AVCC NAL units for video, a single Opus packet for audio
+	data []byte
+	// decode time and duration in the timescale of the track
+	dts      uint64
+	duration uint32
+	keyFrame bool
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// box builds an ISO BMFF box out of its payload (which can be other boxes)
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox builds a box that starts with a version and flags
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+// the identity matrix used by the movie and track headers
+var unityMatrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+// initSegment builds the ftyp and moov boxes that describe the tracks of the following segments
+func initSegment(tracks []*trackInfo) []byte {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5"), []byte("iso6"), []byte("mp41"))
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale and duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume and reserved
+		unityMatrix,
+		make([]byte, 24), // pre defined
+		u32(3),           // next track id (after the video and audio tracks)
+	)
+
+	moov := [][]byte{mvhd}
+	trex := [][]byte{}
+	for _, t := range tracks {
+		moov = append(moov, trak(t))
+		trex = append(trex, fullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	moov = append(moov, box("mvex", trex...))
+
+	return append(ftyp, box("moov", moov...)...)
+}
+
+func trak(t *trackInfo) []byte {
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	var mediaHeader []byte
+	if t.kind == audioTrack {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, u16(0), u16(0))
+	} else {
+		mediaHeader = fullBox("vmhd", 0, 1, u16(0), make([]byte, 6))
+	}
+
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), // creation and modification time
+		u32(t.id), u32(0), u32(0), // track id, reserved and duration
+		make([]byte, 8),                     // reserved
+		u16(0), u16(0), u16(volume), u16(0), // layer, alternate group, volume and reserved
+		unityMatrix,
+		u32(uint32(t.width)<<16), u32(uint32(t.height)<<16),
+	)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(t.timescale), u32(0), // timescale and duration
+		u16(0x55c4), u16(0), // language (und) and pre defined
+	)
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), sampleEntry(t)),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
+
+func sampleEntry(t *trackInfo) []byte {
+	// every sample entry starts with 6 reserved bytes and the data reference index
+	header := append(make([]byte, 6), u16(1)...)
+
+	if t.kind == audioTrack {
+		dOps := box("dOps",
+			[]byte{0, byte(t.channels)}, // version and output channel count
+			u16(t.preSkip), u32(48000),  // pre skip and input sample rate
+			u16(0), []byte{0}, // output gain and channel mapping family
+		)
+		return box("Opus", header,
+			make([]byte, 8),                          // reserved
+			u16(t.channels), u16(16), u16(0), u16(0), // channel count, sample size, pre defined and reserved
+			u32(48000<<16), // sample rate
+			dOps,
+		)
+	}
+
+	avcC := box("avcC",
+		[]byte{1, t.sps[1], t.sps[2], t.sps[3], 0xFF, 0xE1}, // version, profile, compatibility, level, 4 byte lengths and 1 SPS
+		u16(uint16(len(t.sps))), t.sps,
+		[]byte{1}, u16(uint16(len(t.pps))), t.pps,
+	)
+	return box("avc1", header,
+		make([]byte, 16), // pre defined and reserved
+		u16(t.width), u16(t.height),
+		u32(0x00480000), u32(0x00480000), // 72 dpi
+		u32(0), u16(1), // reserved and frame count
+		make([]byte, 32),         // compressor name
+		u16(0x0018), u16(0xFFFF), // depth and pre defined
+		avcC,
+	)
+}
+
+// mediaSegment builds a moof and mdat pair holding the samples of each track (in the same order as tracks)
+func mediaSegment(sequence uint32, tracks []*trackInfo, samples [][]sample) []byte {
+	// the data offsets depend on the size of the moof, which doesn't depend on the offsets themselves
+	moof := buildMoof(sequence, tracks, samples, 0)
+	moof = buildMoof(sequence, tracks, samples, uint32(len(moof)+8))
+
+	mdat := [][]byte{}
+	for i := range tracks {
+		for _, s := range samples[i] {
+			mdat = append(mdat, s.data)
+		}
+	}
+	return append(moof, box("mdat", mdat...)...)
+}
+
+func buildMoof(sequence uint32, tracks []*trackInfo, samples [][]sample, dataOffset uint32) []byte {
+	moof := [][]byte{fullBox("mfhd", 0, 0, u32(sequence))}
+
+	for i, t := range tracks {
+		if len(samples[i]) == 0 {
+			continue
+		}
+
+		// data offset, sample duration, sample size and sample flags are present
+		entries := [][]byte{u32(uint32(len(samples[i]))), u32(dataOffset)}
+		for _, s := range samples[i] {
+			flags := uint32(keyFrameFlags)
+			if t.kind == videoTrack && !s.keyFrame {
+				flags = nonKeyFrameFlags
+			}
+			entries = append(entries, u32(s.duration), u32(uint32(len(s.data))), u32(flags))
+			dataOffset += uint32(len(s.data))
+		}
+
+		moof = append(moof, box("traf",
+			fullBox("tfhd", 0, 0x020000, u32(t.id)), // default base is moof
+			fullBox("tfdt", 1, 0, u64(samples[i][0].dts)),
+			fullBox("trun", 0, 0x000701, entries...),
+		))
+	}
+	return box("moof", moof...)
+}
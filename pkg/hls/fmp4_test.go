@@ -0,0 +1,236 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// parsedBox is a box read back out of the output
+type parsedBox struct {
+	typ     string
+	payload []byte
+}
+
+// parseBoxes splits a byte slice into the boxes it's made of
+func parseBoxes(t *testing.T, b []byte) []parsedBox {
+	t.Helper()
+	boxes := []parsedBox{}
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("%d trailing bytes", len(b))
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("box %q has size %d with %d bytes left", b[4:8], size, len(b))
+		}
+		boxes = append(boxes, parsedBox{typ: string(b[4:8]), payload: b[8:size]})
+		b = b[size:]
+	}
+	return boxes
+}
+
+// findBoxes returns the payloads of the boxes at the path (like "moov/trak/tkhd")
+func findBoxes(t *testing.T, b []byte, path string) [][]byte {
+	t.Helper()
+	typ, rest, nested := strings.Cut(path, "/")
+	found := [][]byte{}
+	for _, child := range parseBoxes(t, b) {
+		if child.typ != typ {
+			continue
+		}
+		if !nested {
+			found = append(found, child.payload)
+			continue
+		}
+		found = append(found, findBoxes(t, child.payload, rest)...)
+	}
+	return found
+}
+
+func boxTypes(t *testing.T, b []byte) []string {
+	t.Helper()
+	types := []string{}
+	for _, child := range parseBoxes(t, b) {
+		types = append(types, child.typ)
+	}
+	return types
+}
+
+func TestBox(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{
+			name: "empty",
+			got:  box("free"),
+			want: []byte{0, 0, 0, 8, 'f', 'r', 'e', 'e'},
+		},
+		{
+			name: "payloads are concatenated",
+			got:  box("free", []byte{1, 2}, []byte{3}),
+			want: []byte{0, 0, 0, 11, 'f', 'r', 'e', 'e', 1, 2, 3},
+		},
+		{
+			name: "full box",
+			got:  fullBox("mfhd", 1, 0x020001, u32(7)),
+			want: []byte{0, 0, 0, 16, 'm', 'f', 'h', 'd', 1, 0x02, 0x00, 0x01, 0, 0, 0, 7},
+		},
+		{
+			name: "nested",
+			got:  box("moof", fullBox("mfhd", 0, 0, u32(1))),
+			want: []byte{0, 0, 0, 24, 'm', 'o', 'o', 'f', 0, 0, 0, 16, 'm', 'f', 'h', 'd', 0, 0, 0, 0, 0, 0, 0, 1},
+		},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, test.got, test.want)
+		}
+	}
+}
+
+func testTracks() []*trackInfo {
+	return []*trackInfo{
+		{id: 1, kind: videoTrack, timescale: 90000, sps: []byte{0x67, 0x42, 0xC0, 0x1F}, pps: []byte{0x68, 0xCE}, width: 1280, height: 720},
+		{id: 2, kind: audioTrack, timescale: 48000, channels: 2, preSkip: 312},
+	}
+}
+
+func TestInitSegment(t *testing.T) {
+	init := initSegment(testTracks())
+
+	tests := []struct {
+		path  string
+		types []string
+	}{
+		{"", []string{"ftyp", "moov"}},
+		{"moov", []string{"mvhd", "trak", "trak", "mvex"}},
+		{"moov/trak", []string{"tkhd", "mdia", "tkhd", "mdia"}},
+		{"moov/trak/mdia", []string{"mdhd", "hdlr", "minf", "mdhd", "hdlr", "minf"}},
+		{"moov/trak/mdia/minf", []string{"vmhd", "dinf", "stbl", "smhd", "dinf", "stbl"}},
+		{"moov/trak/mdia/minf/stbl", []string{"stsd", "stts", "stsc", "stsz", "stco", "stsd", "stts", "stsc", "stsz", "stco"}},
+		{"moov/mvex", []string{"trex", "trex"}},
+	}
+	for _, test := range tests {
+		types := []string{}
+		if test.path == "" {
+			types = boxTypes(t, init)
+		} else {
+			for _, payload := range findBoxes(t, init, test.path) {
+				types = append(types, boxTypes(t, payload)...)
+			}
+		}
+		if strings.Join(types, ",") != strings.Join(test.types, ",") {
+			t.Errorf("%s holds %v, want %v", test.path, types, test.types)
+		}
+	}
+
+	// the track headers carry the ids and the video resolution (in 16.16 fixed point)
+	tkhds := findBoxes(t, init, "moov/trak/tkhd")
+	for i, want := range []struct {
+		id            uint32
+		width, height uint32
+	}{{1, 1280, 720}, {2, 0, 0}} {
+		tkhd := tkhds[i]
+		if id := binary.BigEndian.Uint32(tkhd[12:]); id != want.id {
+			t.Errorf("track %d has id %d", i, id)
+		}
+		width, height := binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]), binary.BigEndian.Uint32(tkhd[len(tkhd)-4:])
+		if width != want.width<<16 || height != want.height<<16 {
+			t.Errorf("track %d is %dx%d, want %dx%d", i, width>>16, height>>16, want.width, want.height)
+		}
+	}
+
+	// the handlers tell the players which track is which
+	hdlrs := findBoxes(t, init, "moov/trak/mdia/hdlr")
+	for i, want := range []string{"vide", "soun"} {
+		if handler := string(hdlrs[i][8:12]); handler != want {
+			t.Errorf("track %d has handler %q, want %q", i, handler, want)
+		}
+	}
+
+	// the sample descriptions carry the codec setup
+	stsds := findBoxes(t, init, "moov/trak/mdia/minf/stbl/stsd")
+	avc1 := parseBoxes(t, stsds[0][8:])
+	if len(avc1) != 1 || avc1[0].typ != "avc1" {
+		t.Fatalf("video sample entry is %v", avc1)
+	}
+	if width, height := binary.BigEndian.Uint16(avc1[0].payload[24:]), binary.BigEndian.Uint16(avc1[0].payload[26:]); width != 1280 || height != 720 {
+		t.Errorf("avc1 is %dx%d", width, height)
+	}
+	avcC := findBoxes(t, avc1[0].payload[78:], "avcC")
+	wantAVCC := []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x42, 0xC0, 0x1F, 1, 0, 2, 0x68, 0xCE}
+	if len(avcC) != 1 || !bytes.Equal(avcC[0], wantAVCC) {
+		t.Errorf("avcC is %x, want %x", avcC, wantAVCC)
+	}
+
+	opus := parseBoxes(t, stsds[1][8:])
+	if len(opus) != 1 || opus[0].typ != "Opus" {
+		t.Fatalf("audio sample entry is %v", opus)
+	}
+	dOps := findBoxes(t, opus[0].payload[28:], "dOps")
+	wantDOps := []byte{0, 2, 0x01, 0x38, 0, 0, 0xBB, 0x80, 0, 0, 0}
+	if len(dOps) != 1 || !bytes.Equal(dOps[0], wantDOps) {
+		t.Errorf("dOps is %x, want %x", dOps, wantDOps)
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	tracks := testTracks()
+	samples := [][]sample{
+		{
+			{data: []byte{0, 0, 0, 2, 0x65, 0x88}, dts: 9000, duration: 3000, keyFrame: true},
+			{data: []byte{0, 0, 0, 1, 0x41}, dts: 12000, duration: 3000},
+		},
+		{
+			{data: []byte{0xAA, 0xBB, 0xCC}, dts: 4800, duration: 960},
+		},
+	}
+	segment := mediaSegment(7, tracks, samples)
+
+	if types := boxTypes(t, segment); strings.Join(types, ",") != "moof,mdat" {
+		t.Fatalf("segment holds %v", types)
+	}
+	if mfhd := findBoxes(t, segment, "moof/mfhd"); binary.BigEndian.Uint32(mfhd[0][4:]) != 7 {
+		t.Errorf("sequence number is %d, want 7", binary.BigEndian.Uint32(mfhd[0][4:]))
+	}
+
+	tfdts := findBoxes(t, segment, "moof/traf/tfdt")
+	truns := findBoxes(t, segment, "moof/traf/trun")
+	if len(tfdts) != 2 || len(truns) != 2 {
+		t.Fatalf("%d tfdt and %d trun boxes, want 2 of each", len(tfdts), len(truns))
+	}
+
+	// every data offset (relative to the start of the moof) points at the samples of its track in the mdat
+	for i, trun := range truns {
+		if dts := binary.BigEndian.Uint64(tfdts[i][4:]); dts != samples[i][0].dts {
+			t.Errorf("track %d starts at %d, want %d", i, dts, samples[i][0].dts)
+		}
+		count := binary.BigEndian.Uint32(trun[4:])
+		if int(count) != len(samples[i]) {
+			t.Fatalf("track %d has %d samples, want %d", i, count, len(samples[i]))
+		}
+		offset := binary.BigEndian.Uint32(trun[8:])
+		for j, s := range samples[i] {
+			entry := trun[12+12*j:]
+			duration, size, flags := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+			if duration != s.duration || int(size) != len(s.data) {
+				t.Errorf("track %d sample %d has duration %d and size %d", i, j, duration, size)
+			}
+			wantFlags := uint32(keyFrameFlags)
+			if tracks[i].kind == videoTrack && !s.keyFrame {
+				wantFlags = nonKeyFrameFlags
+			}
+			if flags != wantFlags {
+				t.Errorf("track %d sample %d has flags %x, want %x", i, j, flags, wantFlags)
+			}
+			if !bytes.Equal(segment[offset:offset+size], s.data) {
+				t.Errorf("track %d sample %d points at %x, want %x", i, j, segment[offset:offset+size], s.data)
+			}
+			offset += size
+		}
+	}
+}
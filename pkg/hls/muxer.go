@@ -0,0 +1,450 @@
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"videochat/pkg/h264"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+
+	// how many packets the sample builders hold on to while waiting for late packets
+	maxLate = 256
+	// the pre skip browsers use when encoding Opus
+	opusPreSkip = 312
+)
+
+var (
+	ErrTooFarAhead = errors.New("requested segment is too far ahead of the live edge")
+	ErrTimeout     = errors.New("timed out waiting for the requested segment")
+)
+
+type Config struct {
+	// the duration we aim for each segment, segments are only cut on key frames so they can run longer
+	SegmentDuration time.Duration
+	// how many segments the playlist holds
+	PlaylistSize int
+
+	// low latency mode publishes each segment in parts while it is being built
+	LowLatency   bool
+	PartDuration time.Duration
+}
+
+var DefaultConfig = Config{
+	SegmentDuration: 4 * time.Second,
+	PlaylistSize:    6,
+}
+
+// LowLatencyConfig keeps the live edge around 2 to 3 seconds behind the publisher
+var LowLatencyConfig = Config{
+	SegmentDuration: 2 * time.Second,
+	PlaylistSize:    6,
+	LowLatency:      true,
+	PartDuration:    300 * time.Millisecond,
+}
+
+// Muxer packages a H.264 and an Opus RTP stream into fragmented MP4 segments and a rolling playlist
+// NOTE the write methods have to be called from a single goroutine, the rest is safe to call from anywhere
+type Muxer struct {
+	config Config
+	start  time.Time
+
+	video *muxerTrack
+	audio *muxerTrack
+
+	lock sync.Mutex
+	// the init segments that are still referenced, keyed by their id
+	inits  map[int][]byte
+	initID int
+	// describes the track setup of the current init segment
+	initKey []byte
+	// the complete segments followed by the one being built
+	segments []*segment
+	current  *segment
+	nextSeq  int
+	// the sequence number of the next moof
+	fragmentSeq int
+	// the number of discontinuities that have rolled out of the playlist
+	discontinuitySeq int
+	// closed (and replaced) whenever a part or segment is published
+	changed chan struct{}
+}
+
+type muxerTrack struct {
+	info    trackInfo
+	builder *samplebuilder.SampleBuilder
+
+	// the decode time of the first sample and the RTP timestamps we use to derive the rest
+	started   bool
+	base      uint64
+	firstTS   uint32
+	lastTS    uint32
+	unwrapped uint64
+
+	// samples of the segment being built
+	pending []sample
+}
+
+type segment struct {
+	seq           int
+	initID        int
+	discontinuity bool
+	parts         []*part
+	duration      time.Duration
+	// the parts put together, set once the segment is complete
+	data []byte
+}
+
+type part struct {
+	duration time.Duration
+	// set when the part starts with a key frame
+	independent bool
+	data        []byte
+}
+
+func NewMuxer(config Config) *Muxer {
+	m := &Muxer{
+		config:  config,
+		start:   time.Now(),
+		inits:   make(map[int][]byte),
+		changed: make(chan struct{}),
+	}
+	m.video = m.newTrack(videoTrack)
+	m.audio = m.newTrack(audioTrack)
+	return m
+}
+
+func (m *Muxer) newTrack(kind trackKind) *muxerTrack {
+	if kind == audioTrack {
+		return &muxerTrack{
+			info:    trackInfo{id: 2, kind: audioTrack, timescale: audioClockRate, channels: 2, preSkip: opusPreSkip},
+			builder: samplebuilder.New(maxLate, &codecs.OpusPacket{}, audioClockRate),
+		}
+	}
+	return &muxerTrack{
+		info:    trackInfo{id: 1, kind: videoTrack, timescale: videoClockRate},
+		builder: samplebuilder.New(maxLate, &codecs.H264Packet{IsAVC: true}, videoClockRate),
+	}
+}
+
+// WriteVideo adds a H.264 RTP packet to the muxer
+func (m *Muxer) WriteVideo(packet *rtp.Packet) {
+	m.video.builder.Push(packet)
+	for s := m.video.builder.Pop(); s != nil; s = m.video.builder.Pop() {
+		m.writeVideoSample(s)
+	}
+}
+
+// WriteAudio adds an Opus RTP packet to the muxer
+func (m *Muxer) WriteAudio(packet *rtp.Packet) {
+	m.audio.builder.Push(packet)
+	for s := m.audio.builder.Pop(); s != nil; s = m.audio.builder.Pop() {
+		m.writeAudioSample(s)
+	}
+}
+
+// ResetVideo is called when the video source goes away, the next source starts with a fresh init segment
+func (m *Muxer) ResetVideo() {
+	m.cutSegment()
+	m.video = m.newTrack(videoTrack)
+}
+
+// ResetAudio is called when the audio source goes away
+func (m *Muxer) ResetAudio() {
+	m.cutSegment()
+	m.audio = m.newTrack(audioTrack)
+}
+
+func (m *Muxer) writeVideoSample(s *media.Sample) {
+	t := m.video
+
+	// pull the parameter sets out of the sample, they go into the init segment instead
+	keyFrame := false
+	nalus := [][]byte{}
+	for _, nalu := range h264.SplitAVCC(s.Data) {
+		switch nalu[0] & 0x1F {
+		case h264.NALUTypeSPS:
+			if !bytes.Equal(t.info.sps, nalu) {
+				width, height, err := h264.SPSResolution(nalu)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				t.info.sps = append([]byte{}, nalu...)
+				t.info.width, t.info.height = width, height
+			}
+		case h264.NALUTypePPS:
+			t.info.pps = append([]byte{}, nalu...)
+		case h264.NALUTypeAUD:
+		case h264.NALUTypeIDR:
+			keyFrame = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	// players can only start decoding on a key frame that we have the parameter sets for
+	if !t.started && (!keyFrame || t.info.sps == nil || t.info.pps == nil) {
+		return
+	}
+
+	m.split(t, keyFrame)
+	t.add(m.start, s, h264.JoinAVCC(nalus), keyFrame)
+}
+
+func (m *Muxer) writeAudioSample(s *media.Sample) {
+	// without video the audio decides where segments are cut
+	if !m.video.started {
+		m.split(m.audio, true)
+	}
+	m.audio.add(m.start, s, s.Data, true)
+}
+
+// split cuts a segment (or a part in low latency mode) before the next sample of the leading track if it's due
+func (m *Muxer) split(leader *muxerTrack, keyFrame bool) {
+	// segments can only start on key frames
+	if keyFrame && m.segmentDuration()+leader.duration() >= m.config.SegmentDuration {
+		m.cutSegment()
+		return
+	}
+	if m.config.LowLatency && leader.duration() >= m.config.PartDuration {
+		m.cutPart()
+	}
+}
+
+// segmentDuration returns the duration of the parts already published for the segment being built
+func (m *Muxer) segmentDuration() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.current == nil {
+		return 0
+	}
+	return m.current.duration
+}
+
+func (t *muxerTrack) add(start time.Time, s *media.Sample, data []byte, keyFrame bool) {
+	if !t.started {
+		// line the tracks up by when their first sample arrived since their RTP timestamps are unrelated
+		t.started = true
+		t.base = uint64(time.Since(start) * time.Duration(t.info.timescale) / time.Second)
+		t.firstTS = s.PacketTimestamp
+		t.lastTS = s.PacketTimestamp
+	}
+
+	// unwrap the 32 bit RTP timestamps
+	t.unwrapped += uint64(s.PacketTimestamp - t.lastTS)
+	t.lastTS = s.PacketTimestamp
+
+	duration := uint32(s.Duration * time.Duration(t.info.timescale) / time.Second)
+	if duration == 0 {
+		// the sample builder doesn't know the duration of the first sample
+		duration = t.info.timescale / 50
+	}
+
+	t.pending = append(t.pending, sample{
+		data:     data,
+		dts:      t.base + t.unwrapped,
+		duration: duration,
+		keyFrame: keyFrame,
+	})
+}
+
+// duration returns how much media is waiting to be put into a segment
+func (t *muxerTrack) duration() time.Duration {
+	total := uint64(0)
+	for _, s := range t.pending {
+		total += uint64(s.duration)
+	}
+	return time.Duration(total) * time.Second / time.Duration(t.info.timescale)
+}
+
+// cutPart turns the pending samples into a part of the current segment
+func (m *Muxer) cutPart() {
+	tracks := []*trackInfo{}
+	samples := [][]sample{}
+	key := []byte{}
+	duration := time.Duration(0)
+	independent := true
+	for _, t := range []*muxerTrack{m.video, m.audio} {
+		if !t.started {
+			continue
+		}
+		info := t.info
+		tracks = append(tracks, &info)
+		samples = append(samples, t.pending)
+		key = append(append(append(key, byte(info.kind)), info.sps...), info.pps...)
+		if d := t.duration(); d > duration {
+			duration = d
+		}
+		if info.kind == videoTrack && (len(t.pending) == 0 || !t.pending[0].keyFrame) {
+			independent = false
+		}
+		t.pending = nil
+	}
+	if duration == 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the track setup changed so we need to start a new segment with a new init segment
+	if !bytes.Equal(key, m.initKey) {
+		m.finishSegment()
+		m.initID++
+		m.inits[m.initID] = initSegment(tracks)
+		m.current = &segment{seq: m.nextSeq, initID: m.initID, discontinuity: m.initKey != nil}
+		m.nextSeq++
+		m.initKey = key
+	}
+	if m.current == nil {
+		m.current = &segment{seq: m.nextSeq, initID: m.initID}
+		m.nextSeq++
+	}
+
+	m.fragmentSeq++
+	m.current.parts = append(m.current.parts, &part{
+		duration:    duration,
+		independent: independent,
+		data:        mediaSegment(uint32(m.fragmentSeq), tracks, samples),
+	})
+	m.current.duration += duration
+	m.notify()
+}
+
+// cutSegment publishes whatever is pending and completes the current segment
+func (m *Muxer) cutSegment() {
+	m.cutPart()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.finishSegment()
+	m.notify()
+}
+
+// finishSegment moves the current segment into the playlist, the lock has to be held
+func (m *Muxer) finishSegment() {
+	if m.current == nil {
+		return
+	}
+
+	for _, p := range m.current.parts {
+		m.current.data = append(m.current.data, p.data...)
+	}
+	m.segments = append(m.segments, m.current)
+	m.current = nil
+
+	// keep a couple more segments than the playlist lists for players that are lagging behind
+	for len(m.segments) > m.config.PlaylistSize+2 {
+		if m.segments[0].discontinuity {
+			m.discontinuitySeq++
+		}
+		m.segments = m.segments[1:]
+	}
+
+	// drop the init segments nothing refers to anymore
+	for id := range m.inits {
+		if id < m.segments[0].initID {
+			delete(m.inits, id)
+		}
+	}
+}
+
+// notify wakes up the requests blocked on the next part, the lock has to be held
+func (m *Muxer) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// wait blocks until ready returns true (checked with the lock held) or the timeout passes
+func (m *Muxer) wait(ready func() bool, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		m.lock.Lock()
+		ok := ready()
+		changed := m.changed
+		m.lock.Unlock()
+		if ok {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// File returns an init segment, a media segment or a part by its name in the playlist
+// NOTE requests for the part hinted at by the playlist block until it's published
+func (m *Muxer) File(name string) ([]byte, bool) {
+	var id, index int
+	if _, err := fmt.Sscanf(name, "init-%d.mp4", &id); err == nil {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		data, ok := m.inits[id]
+		return data, ok
+	}
+
+	if _, err := fmt.Sscanf(name, "segment-%d.m4s", &id); err == nil {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for _, s := range m.segments {
+			if s.seq == id {
+				return s.data, true
+			}
+		}
+		return nil, false
+	}
+
+	if _, err := fmt.Sscanf(name, "part-%d.%d.m4s", &id, &index); err == nil {
+		// the numbers come straight from the request
+		if id < 0 || index < 0 {
+			return nil, false
+		}
+		var data []byte
+		m.wait(func() bool {
+			// only wait for parts at the live edge
+			if id > m.nextSeq || id < m.nextSeq-1 {
+				return true
+			}
+			data = m.part(id, index)
+			return data != nil
+		}, m.blockTimeout())
+		return data, data != nil
+	}
+	return nil, false
+}
+
+// part looks up a published part, the lock has to be held
+func (m *Muxer) part(seq, index int) []byte {
+	segments := m.segments
+	if m.current != nil {
+		segments = append(segments[:len(segments):len(segments)], m.current)
+	}
+	for _, s := range segments {
+		if s.seq == seq && index >= 0 && index < len(s.parts) {
+			return s.parts[index].data
+		}
+	}
+	return nil
+}
+
+// blockTimeout is how long blocking requests wait before giving up
+func (m *Muxer) blockTimeout() time.Duration {
+	return 3 * m.config.SegmentDuration
+}
@@ -0,0 +1,144 @@
+package hls
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// publish adds a complete segment (or a part of the one being built) the way the writers do
+func publish(m *Muxer, f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f()
+	m.notify()
+}
+
+func TestWaitPlaylist(t *testing.T) {
+	// blocking requests give up after 3 segment durations
+	config := LowLatencyConfig
+	config.SegmentDuration = 50 * time.Millisecond
+	timeout := 150 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		msn, part int
+		// runs while the request is blocked
+		publish func(m *Muxer)
+		err     error
+	}{
+		{
+			name: "too far ahead",
+			msn:  3, part: -1,
+			err: ErrTooFarAhead,
+		},
+		{
+			name: "segment is never published",
+			msn:  0, part: -1,
+			err: ErrTimeout,
+		},
+		{
+			name: "segment gets published",
+			msn:  0, part: -1,
+			publish: func(m *Muxer) {
+				m.segments = append(m.segments, testSegment(0, 0, time.Second))
+				m.nextSeq = 1
+			},
+		},
+		{
+			name: "part gets published",
+			msn:  0, part: 1,
+			publish: func(m *Muxer) {
+				m.current.parts = append(m.current.parts, &part{duration: 300 * time.Millisecond})
+			},
+		},
+		{
+			name: "parts don't count without asking for them",
+			msn:  0, part: -1,
+			publish: func(m *Muxer) {
+				m.current.parts = append(m.current.parts, &part{duration: 300 * time.Millisecond})
+			},
+			err: ErrTimeout,
+		},
+		{
+			name: "next segment starts",
+			msn:  0, part: 5,
+			publish: func(m *Muxer) {
+				m.segments = append(m.segments, m.current)
+				m.current = testSegment(1, 0, 0)
+				m.nextSeq = 2
+			},
+		},
+	}
+	for _, test := range tests {
+		m := NewMuxer(config)
+		// a segment is being built and its first part is out
+		m.current = testSegment(0, 0, 0, 300*time.Millisecond)
+		m.nextSeq = 1
+
+		if test.publish != nil {
+			go func(publishTest func(m *Muxer)) {
+				time.Sleep(10 * time.Millisecond)
+				publish(m, func() { publishTest(m) })
+			}(test.publish)
+		}
+
+		start := time.Now()
+		err := m.WaitPlaylist(test.msn, test.part)
+		elapsed := time.Since(start)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		switch {
+		case errors.Is(err, ErrTimeout) && elapsed < timeout:
+			t.Errorf("%s: timed out after %v, want %v", test.name, elapsed, timeout)
+		case err == nil && elapsed >= timeout:
+			t.Errorf("%s: took %v to return", test.name, elapsed)
+		}
+	}
+}
+
+func TestWaitPlaylistReady(t *testing.T) {
+	m := NewMuxer(LowLatencyConfig)
+	m.segments = []*segment{testSegment(0, 0, time.Second), testSegment(1, 0, time.Second)}
+	m.current = testSegment(2, 0, 0, 300*time.Millisecond)
+	m.nextSeq = 3
+
+	// what's already published returns right away
+	for _, request := range []struct{ msn, part int }{{0, -1}, {1, -1}, {1, 8}, {2, 0}} {
+		start := time.Now()
+		if err := m.WaitPlaylist(request.msn, request.part); err != nil {
+			t.Errorf("msn %d part %d: %v", request.msn, request.part, err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("msn %d part %d: blocked for %v", request.msn, request.part, elapsed)
+		}
+	}
+}
+
+func TestFilePart(t *testing.T) {
+	config := LowLatencyConfig
+	config.SegmentDuration = 50 * time.Millisecond
+
+	m := NewMuxer(config)
+	m.current = testSegment(0, 0, 0, 300*time.Millisecond)
+	m.current.parts[0].data = []byte{1}
+	m.nextSeq = 1
+
+	tests := []struct {
+		name  string
+		found bool
+	}{
+		{name: "part-0.0.m4s", found: true},
+		{name: "part-0.1.m4s"},
+		{name: "part-0.-1.m4s"},
+		{name: "part--1.0.m4s"},
+		{name: "part-5.0.m4s"},
+	}
+	for _, test := range tests {
+		if _, found := m.File(test.name); found != test.found {
+			t.Errorf("%s: got found %v, want %v", test.name, found, test.found)
+		}
+	}
+}
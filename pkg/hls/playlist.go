@@ -0,0 +1,134 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// how many of the most recent complete segments still list their parts in low latency mode
+const partSegments = 3
+
+// Playlist renders the rolling media playlist, it returns nil until the first segment is ready
+func (m *Muxer) Playlist() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.segments) == 0 {
+		return nil
+	}
+
+	// only list the most recent segments, the rest are kept around for lagging players
+	segments := m.segments
+	discontinuitySeq := m.discontinuitySeq
+	if len(segments) > m.config.PlaylistSize {
+		for _, s := range segments[:len(segments)-m.config.PlaylistSize] {
+			if s.discontinuity {
+				discontinuitySeq++
+			}
+		}
+		segments = segments[len(segments)-m.config.PlaylistSize:]
+	}
+
+	// the target duration has to cover the longest segment
+	target := m.config.SegmentDuration.Seconds()
+	for _, s := range segments {
+		target = math.Max(target, s.duration.Seconds())
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "#EXTM3U")
+	if m.config.LowLatency {
+		fmt.Fprintln(b, "#EXT-X-VERSION:9")
+	} else {
+		fmt.Fprintln(b, "#EXT-X-VERSION:7")
+	}
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	if m.config.LowLatency {
+		part := m.partTarget()
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*part)
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", part)
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].seq)
+	fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	fmt.Fprintln(b, "#EXT-X-INDEPENDENT-SEGMENTS")
+
+	// the segment being built is listed by its parts only
+	listed := segments
+	if m.config.LowLatency && m.current != nil {
+		listed = append(segments[:len(segments):len(segments)], m.current)
+	}
+
+	for i, s := range listed {
+		if s.discontinuity {
+			fmt.Fprintln(b, "#EXT-X-DISCONTINUITY")
+		}
+		if i == 0 || s.initID != listed[i-1].initID {
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", s.initID)
+		}
+		if m.config.LowLatency && i >= len(segments)-partSegments {
+			for j, p := range s.parts {
+				fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"part-%d.%d.m4s\"", p.duration.Seconds(), s.seq, j)
+				if p.independent {
+					fmt.Fprint(b, ",INDEPENDENT=YES")
+				}
+				fmt.Fprintln(b)
+			}
+		}
+		if s == m.current {
+			continue
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", s.duration.Seconds())
+		fmt.Fprintf(b, "segment-%d.m4s\n", s.seq)
+	}
+
+	// tell the player where the next part will be so it can request it before it exists
+	if m.config.LowLatency {
+		if m.current != nil {
+			fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%d.%d.m4s\"\n", m.current.seq, len(m.current.parts))
+		} else {
+			fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%d.0.m4s\"\n", m.nextSeq)
+		}
+	}
+	return []byte(b.String())
+}
+
+// partTarget returns the longest part duration in seconds, the lock has to be held
+func (m *Muxer) partTarget() float64 {
+	target := m.config.PartDuration.Seconds()
+	segments := m.segments
+	if m.current != nil {
+		segments = append(segments[:len(segments):len(segments)], m.current)
+	}
+	for _, s := range segments {
+		for _, p := range s.parts {
+			target = math.Max(target, p.duration.Seconds())
+		}
+	}
+	return target
+}
+
+// WaitPlaylist blocks until the playlist holds the given segment, or the given part of it when part isn't negative
+// (the _HLS_msn and _HLS_part directives of a blocking playlist reload)
+func (m *Muxer) WaitPlaylist(msn, part int) error {
+	m.lock.Lock()
+	tooFar := msn > m.nextSeq+1
+	m.lock.Unlock()
+	if tooFar {
+		return ErrTooFarAhead
+	}
+
+	ok := m.wait(func() bool {
+		if len(m.segments) > 0 && m.segments[len(m.segments)-1].seq >= msn {
+			return true
+		}
+		if part < 0 || m.current == nil {
+			return false
+		}
+		return m.current.seq > msn || (m.current.seq == msn && len(m.current.parts) > part)
+	}, m.blockTimeout())
+	if !ok {
+		return ErrTimeout
+	}
+	return nil
+}
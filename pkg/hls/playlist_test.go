@@ -0,0 +1,134 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSegment builds a published segment, every part after the first has the same duration
+func testSegment(seq, initID int, duration time.Duration, parts ...time.Duration) *segment {
+	s := &segment{seq: seq, initID: initID, duration: duration}
+	for i, d := range parts {
+		s.parts = append(s.parts, &part{duration: d, independent: i == 0})
+	}
+	return s
+}
+
+func TestPlaylist(t *testing.T) {
+	tests := []struct {
+		name  string
+		muxer func() *Muxer
+		want  string
+	}{
+		{
+			name:  "nothing published",
+			muxer: func() *Muxer { return NewMuxer(DefaultConfig) },
+			want:  "",
+		},
+		{
+			name: "rolls out old segments and discontinuities",
+			muxer: func() *Muxer {
+				m := NewMuxer(Config{SegmentDuration: 4 * time.Second, PlaylistSize: 2})
+				m.segments = []*segment{
+					testSegment(0, 0, 4*time.Second),
+					testSegment(1, 0, 4500*time.Millisecond),
+					testSegment(2, 1, 3200*time.Millisecond),
+				}
+				m.segments[0].discontinuity = true
+				m.segments[2].discontinuity = true
+				m.nextSeq = 3
+				return m
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:5
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-DISCONTINUITY-SEQUENCE:1
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init-0.mp4"
+#EXTINF:4.500,
+segment-1.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-1.mp4"
+#EXTINF:3.200,
+segment-2.m4s
+`,
+		},
+		{
+			name: "low latency lists the recent parts and hints the next one",
+			muxer: func() *Muxer {
+				m := NewMuxer(LowLatencyConfig)
+				for seq := 0; seq < 4; seq++ {
+					m.segments = append(m.segments, testSegment(seq, 0, 2*time.Second, 300*time.Millisecond, 250*time.Millisecond))
+				}
+				m.current = testSegment(4, 0, 0, 300*time.Millisecond)
+				m.nextSeq = 5
+				return m
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.900
+#EXT-X-PART-INF:PART-TARGET=0.300
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init-0.mp4"
+#EXTINF:2.000,
+segment-0.m4s
+#EXT-X-PART:DURATION=0.300,URI="part-1.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.250,URI="part-1.1.m4s"
+#EXTINF:2.000,
+segment-1.m4s
+#EXT-X-PART:DURATION=0.300,URI="part-2.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.250,URI="part-2.1.m4s"
+#EXTINF:2.000,
+segment-2.m4s
+#EXT-X-PART:DURATION=0.300,URI="part-3.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.250,URI="part-3.1.m4s"
+#EXTINF:2.000,
+segment-3.m4s
+#EXT-X-PART:DURATION=0.300,URI="part-4.0.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-4.1.m4s"
+`,
+		},
+		{
+			name: "low latency between segments",
+			muxer: func() *Muxer {
+				m := NewMuxer(LowLatencyConfig)
+				m.segments = []*segment{testSegment(0, 0, 2*time.Second, 400*time.Millisecond)}
+				m.nextSeq = 1
+				return m
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.200
+#EXT-X-PART-INF:PART-TARGET=0.400
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init-0.mp4"
+#EXT-X-PART:DURATION=0.400,URI="part-0.0.m4s",INDEPENDENT=YES
+#EXTINF:2.000,
+segment-0.m4s
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-1.0.m4s"
+`,
+		},
+	}
+	for _, test := range tests {
+		got := string(test.muxer().Playlist())
+		if got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPlaylistTargetDuration(t *testing.T) {
+	m := NewMuxer(Config{SegmentDuration: 2 * time.Second, PlaylistSize: 6})
+	m.segments = []*segment{testSegment(0, 0, 2*time.Second), testSegment(1, 0, 6100*time.Millisecond)}
+	if playlist := string(m.Playlist()); !strings.Contains(playlist, "#EXT-X-TARGETDURATION:7\n") {
+		t.Errorf("a 6.1s segment should raise the target duration to 7:\n%s", playlist)
+	}
+}
@@ -0,0 +1,202 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// the AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+)
+
+var errUnsupportedAMF = errors.New("unsupported amf0 type")
+
+// Object is an AMF0 object (or ECMA array)
+type Object map[string]interface{}
+
+// undefined is the AMF0 undefined value, nil is encoded as null
+type undefined struct{}
+
+// decodeAMF decodes every AMF0 value in the data
+func decodeAMF(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	values := []interface{}{}
+	for r.Len() > 0 {
+		v, err := decodeAMFValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func decodeAMFValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		err := binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case amfBoolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amfString:
+		return decodeAMFString(r, 2)
+	case amfLongString:
+		return decodeAMFString(r, 4)
+	case amfObject:
+		return decodeAMFObject(r)
+	case amfECMAArray:
+		// the count is only a hint, the properties end with an object end marker like an object
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return decodeAMFObject(r)
+	case amfStrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		values := []interface{}{}
+		for i := uint32(0); i < count; i++ {
+			v, err := decodeAMFValue(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case amfDate:
+		// milliseconds since the epoch and a time zone we don't need
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		_, err := r.Seek(2, io.SeekCurrent)
+		return math.Float64frombits(bits), err
+	case amfNull:
+		return nil, nil
+	case amfUndefined:
+		return undefined{}, nil
+	}
+	return nil, errUnsupportedAMF
+}
+
+func decodeAMFString(r *bytes.Reader, lengthSize int) (string, error) {
+	length := 0
+	for i := 0; i < lengthSize; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]byte, length)
+	_, err := io.ReadFull(r, s)
+	return string(s), err
+}
+
+func decodeAMFObject(r *bytes.Reader) (Object, error) {
+	o := Object{}
+	for {
+		key, err := decodeAMFString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		// an empty key followed by the end marker closes the object
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker == amfObjectEnd {
+				return o, nil
+			}
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+		}
+
+		v, err := decodeAMFValue(r)
+		if err != nil {
+			return nil, err
+		}
+		o[key] = v
+	}
+}
+
+// encodeAMF encodes the values (float64, int, bool, string, Object, nil and undefined) as AMF0
+func encodeAMF(values ...interface{}) []byte {
+	b := &bytes.Buffer{}
+	for _, v := range values {
+		encodeAMFValue(b, v)
+	}
+	return b.Bytes()
+}
+
+func encodeAMFValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(amfNumber)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeAMFValue(b, float64(v))
+	case bool:
+		b.WriteByte(amfBoolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			b.WriteByte(amfLongString)
+			binary.Write(b, binary.BigEndian, uint32(len(v)))
+		} else {
+			b.WriteByte(amfString)
+			binary.Write(b, binary.BigEndian, uint16(len(v)))
+		}
+		b.WriteString(v)
+	case Object:
+		b.WriteByte(amfObject)
+		// sort the keys so the output doesn't change between runs
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			binary.Write(b, binary.BigEndian, uint16(len(key)))
+			b.WriteString(key)
+			encodeAMFValue(b, v[key])
+		}
+		b.Write([]byte{0, 0, amfObjectEnd})
+	case undefined:
+		b.WriteByte(amfUndefined)
+	default:
+		b.WriteByte(amfNull)
+	}
+}
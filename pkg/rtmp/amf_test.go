@@ -0,0 +1,154 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeAMF(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{"number", 1.5, []byte{amfNumber, 0x3F, 0xF8, 0, 0, 0, 0, 0, 0}},
+		{"int", 2, []byte{amfNumber, 0x40, 0, 0, 0, 0, 0, 0, 0}},
+		{"true", true, []byte{amfBoolean, 1}},
+		{"false", false, []byte{amfBoolean, 0}},
+		{"string", "ab", []byte{amfString, 0, 2, 'a', 'b'}},
+		{"null", nil, []byte{amfNull}},
+		{"undefined", undefined{}, []byte{amfUndefined}},
+		{
+			"object with sorted keys",
+			Object{"b": true, "a": "x"},
+			[]byte{amfObject, 0, 1, 'a', amfString, 0, 1, 'x', 0, 1, 'b', amfBoolean, 1, 0, 0, amfObjectEnd},
+		},
+	}
+	for _, test := range tests {
+		if got := encodeAMF(test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+
+	long := strings.Repeat("x", 70000)
+	got := encodeAMF(long)
+	if want := append([]byte{amfLongString, 0, 1, 0x11, 0x70}, long...); !bytes.Equal(got, want) {
+		t.Errorf("long string starts with %x, want %x", got[:5], want[:5])
+	}
+}
+
+func TestAMFRoundTrip(t *testing.T) {
+	// what a connect command looks like
+	values := []interface{}{
+		"connect",
+		1.0,
+		Object{
+			"app":   "live",
+			"tcUrl": "rtmp://localhost/live",
+			"fpad":  false,
+			"codecs": Object{
+				"audio": 3575.0,
+				"video": 252.0,
+			},
+			"nothing": nil,
+		},
+		nil,
+		strings.Repeat("long", 20000),
+	}
+	decoded, err := decodeAMF(encodeAMF(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("got %#v, want %#v", decoded, values)
+	}
+}
+
+func TestDecodeAMF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []interface{}
+		err  error
+	}{
+		{
+			name: "ecma array",
+			data: []byte{amfECMAArray, 0, 0, 0, 1, 0, 5, 'w', 'i', 'd', 't', 'h', amfNumber, 0x40, 0x94, 0, 0, 0, 0, 0, 0, 0, 0, amfObjectEnd},
+			want: []interface{}{Object{"width": 1280.0}},
+		},
+		{
+			name: "strict array",
+			data: []byte{amfStrictArray, 0, 0, 0, 2, amfBoolean, 1, amfNull},
+			want: []interface{}{[]interface{}{true, nil}},
+		},
+		{
+			name: "date",
+			data: []byte{amfDate, 0x3F, 0xF0, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: []interface{}{1.0},
+		},
+		{
+			name: "undefined",
+			data: []byte{amfUndefined},
+			want: []interface{}{undefined{}},
+		},
+		{
+			name: "long string",
+			data: []byte{amfLongString, 0, 0, 0, 2, 'h', 'i'},
+			want: []interface{}{"hi"},
+		},
+		{
+			name: "empty key that doesn't end the object",
+			data: []byte{amfObject, 0, 0, amfBoolean, 1, 0, 0, amfObjectEnd},
+			want: []interface{}{Object{"": true}},
+		},
+		{
+			name: "amf3 value",
+			data: []byte{amfString, 0, 1, 'a', 0x11},
+			want: []interface{}{"a"},
+			err:  errUnsupportedAMF,
+		},
+		{
+			name: "string cut short",
+			data: []byte{amfString, 0, 5, 'a'},
+			want: []interface{}{},
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "object without an end",
+			data: []byte{amfObject, 0, 1, 'a', amfNull},
+			want: []interface{}{},
+			err:  io.EOF,
+		},
+	}
+	for _, test := range tests {
+		values, err := decodeAMF(test.data)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if !reflect.DeepEqual(values, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, values, test.want)
+		}
+	}
+}
+
+func TestCommandValues(t *testing.T) {
+	payload := encodeAMF("publish", 5, nil, "key", "live")
+	want := []interface{}{"publish", 5.0, nil, "key", "live"}
+	for _, m := range []*message{
+		{typeID: typeCommandAMF0, payload: payload},
+		// AMF3 commands start with a byte that switches to AMF0
+		{typeID: typeCommandAMF3, payload: append([]byte{0}, payload...)},
+	} {
+		values, err := commandValues(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("type %d: got %#v, want %#v", m.typeID, values, want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort    = "1935"
+	defaultTLSPort = "443"
+	dialTimeout    = 10 * time.Second
+)
+
+var (
+	errBadURL        = errors.New("rtmp urls look like rtmp[s]://host[:port]/app/key")
+	errPublishFailed = errors.New("the server refused to publish")
+)
+
+// Client publishes a stream to an RTMP server
+type Client struct {
+	c        *conn
+	streamID uint32
+
+	lock sync.Mutex
+	err  error
+}
+
+// Dial connects to the server in the URL and starts publishing under the stream key at the end of it
+func Dial(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") {
+		return nil, errBadURL
+	}
+	// the app is everything up to the stream key
+	path := strings.TrimPrefix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		return nil, errBadURL
+	}
+	app, key := path[:slash], path[slash+1:]
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+
+	host := u.Host
+	if u.Port() == "" && u.Scheme == "rtmps" {
+		host = net.JoinHostPort(u.Hostname(), defaultTLSPort)
+	} else if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	var nc net.Conn
+	if u.Scheme == "rtmps" {
+		nc, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", host, nil)
+	} else {
+		nc, err = net.DialTimeout("tcp", host, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{c: newConn(nc)}
+	nc.SetDeadline(time.Now().Add(dialTimeout))
+	if err := client.publish(app, key, fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, app)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	// publishing servers can stay quiet for a long time
+	client.c.timeout = 0
+	// keep reading so acknowledgements and pings get handled
+	go client.read()
+	return client, nil
+}
+
+// publish runs the connect, createStream and publish commands
+func (c *Client) publish(app, key, tcURL string) error {
+	if err := c.c.clientHandshake(); err != nil {
+		return err
+	}
+	if err := c.c.writeMessage(chunkStreamControl, &message{typeID: typeSetChunkSize, payload: u32(ourChunkSize)}); err != nil {
+		return err
+	}
+
+	if err := c.c.writeCommand(0, "connect", 1, Object{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; videochat)",
+		"tcUrl":    tcURL,
+	}); err != nil {
+		return err
+	}
+	if _, err := c.waitResult(1); err != nil {
+		return err
+	}
+
+	c.c.writeCommand(0, "releaseStream", 2, nil, key)
+	c.c.writeCommand(0, "FCPublish", 3, nil, key)
+	if err := c.c.writeCommand(0, "createStream", 4, nil); err != nil {
+		return err
+	}
+	values, err := c.waitResult(4)
+	if err != nil {
+		return err
+	}
+	if len(values) > 3 {
+		if id, ok := values[3].(float64); ok {
+			c.streamID = uint32(id)
+		}
+	}
+
+	if err := c.c.writeCommand(c.streamID, "publish", 5, nil, key, "live"); err != nil {
+		return err
+	}
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return err
+		}
+		if name, _ := values[0].(string); name != "onStatus" || len(values) < 4 {
+			continue
+		}
+		status, _ := values[3].(Object)
+		code, _ := status["code"].(string)
+		if code == "NetStream.Publish.Start" {
+			return nil
+		}
+		if level, _ := status["level"].(string); level == "error" {
+			return fmt.Errorf("%w: %s", errPublishFailed, code)
+		}
+	}
+}
+
+// waitResult reads commands until the result of the transaction comes back
+func (c *Client) waitResult(transaction float64) ([]interface{}, error) {
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return nil, err
+		}
+		name, _ := values[0].(string)
+		id, _ := values[1].(float64)
+		if id != transaction {
+			continue
+		}
+		if name == "_error" {
+			return nil, errPublishFailed
+		}
+		if name == "_result" {
+			return values, nil
+		}
+	}
+}
+
+func (c *Client) readCommand() ([]interface{}, error) {
+	for {
+		m, err := c.c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m.typeID != typeCommandAMF0 && m.typeID != typeCommandAMF3 {
+			continue
+		}
+		values, err := commandValues(m)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) >= 2 {
+			return values, nil
+		}
+	}
+}
+
+func (c *Client) read() {
+	for {
+		if _, err := c.c.readMessage(); err != nil {
+			c.lock.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.lock.Unlock()
+			return
+		}
+	}
+}
+
+// Err returns the error that ended the connection, if any
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// WriteMetadata sends the onMetaData of the stream
+func (c *Client) WriteMetadata(metadata Object) error {
+	return c.c.writeMessage(chunkStreamData, &message{
+		typeID:   typeDataAMF0,
+		streamID: c.streamID,
+		payload:  encodeAMF("@setDataFrame", "onMetaData", metadata),
+	})
+}
+
+// WriteVideo sends the body of an FLV video tag with its timestamp in milliseconds
+func (c *Client) WriteVideo(timestamp uint32, payload []byte) error {
+	return c.c.writeMessage(chunkStreamVideo, &message{typeID: typeVideo, streamID: c.streamID, timestamp: timestamp, payload: payload})
+}
+
+// WriteAudio sends the body of an FLV audio tag with its timestamp in milliseconds
+func (c *Client) WriteAudio(timestamp uint32, payload []byte) error {
+	return c.c.writeMessage(chunkStreamAudio, &message{typeID: typeAudio, streamID: c.streamID, timestamp: timestamp, payload: payload})
+}
+
+// Close stops publishing and hangs up
+func (c *Client) Close() error {
+	if err := c.c.writeCommand(c.streamID, "deleteStream", 0, nil, c.streamID); err != nil {
+		log.Println(err)
+	}
+	return c.c.Close()
+}
@@ -0,0 +1,392 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// the message types we handle
+const (
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAcknowledgement  = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	typeAudio            = 8
+	typeVideo            = 9
+	typeDataAMF3         = 15
+	typeCommandAMF3      = 17
+	typeDataAMF0         = 18
+	typeCommandAMF0      = 20
+)
+
+// the chunk stream ids we send on
+const (
+	chunkStreamControl = 2
+	chunkStreamCommand = 3
+	chunkStreamAudio   = 4
+	chunkStreamVideo   = 6
+	chunkStreamData    = 5
+)
+
+const (
+	handshakeSize    = 1536
+	defaultChunkSize = 128
+	// the chunk size we ask the other side to use for what we send
+	ourChunkSize = 4096
+	// the window we ask the other side to acknowledge
+	ourWindowSize = 2500000
+
+	extendedTimestamp = 0xFFFFFF
+
+	userControlPingRequest  = 6
+	userControlPingResponse = 7
+
+	// how long the other side can go quiet before we give up on it
+	readTimeout = 30 * time.Second
+)
+
+var (
+	errBadVersion     = errors.New("unsupported rtmp version")
+	errBadChunkHeader = errors.New("chunk continues a message we never saw")
+	errMessageTooBig  = errors.New("message is too big")
+	errBadChunkSize   = errors.New("chunk size is out of range")
+)
+
+type message struct {
+	typeID    byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStream is the state the chunk headers of a chunk stream are compressed against
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    byte
+	streamID  uint32
+	extended  bool
+	// the message being put back together
+	payload []byte
+}
+
+// conn reads and writes RTMP messages over the chunk stream protocol
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	// how long the other side can go quiet, 0 waits forever
+	timeout time.Duration
+
+	readChunkSize int
+	streams       map[uint32]*chunkStream
+	// the acknowledgement window of the other side and how much we've read
+	windowSize uint32
+	received   uint32
+	acked      uint32
+
+	writeLock      sync.Mutex
+	w              *bufio.Writer
+	writeChunkSize int
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{
+		nc:             nc,
+		timeout:        readTimeout,
+		readChunkSize:  defaultChunkSize,
+		writeChunkSize: defaultChunkSize,
+		streams:        make(map[uint32]*chunkStream),
+		w:              bufio.NewWriter(nc),
+	}
+	c.r = bufio.NewReader(&countingReader{c: c})
+	return c
+}
+
+type countingReader struct {
+	c *conn
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.c.timeout > 0 {
+		r.c.nc.SetReadDeadline(time.Now().Add(r.c.timeout))
+	}
+	n, err := r.c.nc.Read(p)
+	r.c.received += uint32(n)
+	return n, err
+}
+
+// serverHandshake answers the simple (unsigned) handshake that RTMP clients start with
+func (c *conn) serverHandshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return errBadVersion
+	}
+
+	// S0, S1 (our time, zeros and random bytes) and S2 (an echo of C1)
+	s1 := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(s1, uint32(time.Now().Unix()))
+	rand.Read(s1[8:])
+	response := append([]byte{3}, s1...)
+	response = append(response, c0c1[1:]...)
+	if _, err := c.nc.Write(response); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.r, c2)
+	return err
+}
+
+// clientHandshake starts the simple handshake with a server
+func (c *conn) clientHandshake() error {
+	c1 := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(c1, uint32(time.Now().Unix()))
+	rand.Read(c1[8:])
+	if _, err := c.nc.Write(append([]byte{3}, c1...)); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(c.r, s0s1s2); err != nil {
+		return err
+	}
+	if s0s1s2[0] != 3 {
+		return errBadVersion
+	}
+
+	// C2 echoes S1
+	_, err := c.nc.Write(s0s1s2[1 : 1+handshakeSize])
+	return err
+}
+
+// readMessage returns the next message, the protocol control messages are handled along the way
+func (c *conn) readMessage() (*message, error) {
+	for {
+		m, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+
+		// acknowledge what we've read once the window of the other side is full
+		if c.windowSize > 0 && c.received-c.acked >= c.windowSize {
+			c.acked = c.received
+			if err := c.writeMessage(chunkStreamControl, &message{typeID: typeAcknowledgement, payload: u32(c.received)}); err != nil {
+				return nil, err
+			}
+		}
+
+		switch m.typeID {
+		case typeSetChunkSize:
+			if len(m.payload) >= 4 {
+				// a chunk size of 0 would have us reading empty chunks forever
+				size := int(binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF)
+				if size < 1 {
+					return nil, errBadChunkSize
+				}
+				c.readChunkSize = size
+			}
+		case typeAbort:
+			if len(m.payload) >= 4 {
+				if s, ok := c.streams[binary.BigEndian.Uint32(m.payload)]; ok {
+					s.payload = nil
+				}
+			}
+		case typeWindowAckSize:
+			if len(m.payload) >= 4 {
+				c.windowSize = binary.BigEndian.Uint32(m.payload)
+			}
+		case typeUserControl:
+			// answer pings so the other side doesn't think we're gone
+			if len(m.payload) >= 6 && binary.BigEndian.Uint16(m.payload) == userControlPingRequest {
+				response := append(u16(userControlPingResponse), m.payload[2:6]...)
+				if err := c.writeMessage(chunkStreamControl, &message{typeID: typeUserControl, payload: response}); err != nil {
+					return nil, err
+				}
+			}
+		case typeAcknowledgement, typeSetPeerBandwidth:
+		default:
+			return m, nil
+		}
+	}
+}
+
+// readChunk reads a single chunk, returning the message it completes (if any)
+func (c *conn) readChunk() (*message, error) {
+	first, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// the basic header, the chunk stream id can take one or two extra bytes
+	format := first >> 6
+	id := uint32(first & 0x3F)
+	switch id {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b)
+	case 1:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	s, ok := c.streams[id]
+	if !ok {
+		if format != 0 {
+			return nil, errBadChunkHeader
+		}
+		s = &chunkStream{}
+		c.streams[id] = s
+	}
+
+	// the message header, each format leaves out more of what's the same as the previous chunk
+	sizes := []int{11, 7, 3, 0}
+	header := make([]byte, sizes[format])
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+	timestamp := uint32(0)
+	if format < 3 {
+		timestamp = uint24(header)
+		s.extended = timestamp == extendedTimestamp
+	}
+	if format < 2 {
+		s.length = uint24(header[3:])
+		s.typeID = header[6]
+	}
+	if format == 0 {
+		s.streamID = binary.LittleEndian.Uint32(header[7:])
+	}
+	if s.extended {
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			timestamp = binary.BigEndian.Uint32(b)
+		}
+	}
+
+	// a new message moves the timestamp on (format 0 has the absolute timestamp, the rest carry deltas)
+	if len(s.payload) == 0 {
+		switch format {
+		case 0:
+			s.timestamp = timestamp
+			s.delta = 0
+		case 1, 2:
+			s.delta = timestamp
+			s.timestamp += timestamp
+		case 3:
+			s.timestamp += s.delta
+		}
+	}
+
+	if s.length > 16*1024*1024 {
+		return nil, errMessageTooBig
+	}
+	size := int(s.length) - len(s.payload)
+	if size > c.readChunkSize {
+		size = c.readChunkSize
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	s.payload = append(s.payload, data...)
+
+	if uint32(len(s.payload)) < s.length {
+		return nil, nil
+	}
+	m := &message{typeID: s.typeID, streamID: s.streamID, timestamp: s.timestamp, payload: s.payload}
+	s.payload = nil
+	return m, nil
+}
+
+// writeMessage splits a message into chunks, the first chunk carries the full header and the rest none
+func (c *conn) writeMessage(chunkStreamID uint32, m *message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	timestamp := m.timestamp
+	extended := timestamp >= extendedTimestamp
+	if extended {
+		timestamp = extendedTimestamp
+	}
+
+	header := []byte{byte(chunkStreamID)}
+	header = append(header, byte(timestamp>>16), byte(timestamp>>8), byte(timestamp))
+	header = append(header, byte(len(m.payload)>>16), byte(len(m.payload)>>8), byte(len(m.payload)), m.typeID)
+	header = binary.LittleEndian.AppendUint32(header, m.streamID)
+	if extended {
+		header = append(header, u32(m.timestamp)...)
+	}
+	c.w.Write(header)
+
+	for payload := m.payload; ; {
+		size := len(payload)
+		if size > c.writeChunkSize {
+			size = c.writeChunkSize
+		}
+		c.w.Write(payload[:size])
+		payload = payload[size:]
+		if len(payload) == 0 {
+			break
+		}
+
+		// the continuation chunks repeat the extended timestamp
+		c.w.WriteByte(0xC0 | byte(chunkStreamID))
+		if extended {
+			c.w.Write(u32(m.timestamp))
+		}
+	}
+
+	if m.typeID == typeSetChunkSize {
+		c.writeChunkSize = int(binary.BigEndian.Uint32(m.payload))
+	}
+	return c.w.Flush()
+}
+
+// writeCommand sends an AMF0 command on the given message stream
+func (c *conn) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(chunkStreamCommand, &message{typeID: typeCommandAMF0, streamID: streamID, payload: encodeAMF(values...)})
+}
+
+// commandValues decodes the values of a command message, AMF3 commands start with a byte we skip
+func commandValues(m *message) ([]interface{}, error) {
+	payload := m.payload
+	if m.typeID == typeCommandAMF3 && len(payload) > 0 {
+		payload = payload[1:]
+	}
+	return decodeAMF(payload)
+}
+
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
@@ -0,0 +1,318 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pipeConn returns a conn and the other end of its connection
+func pipeConn(t *testing.T) (*conn, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	c := newConn(a)
+	// a test that reads more than it's sent fails instead of hanging
+	c.timeout = time.Second
+	return c, b
+}
+
+// feed writes the data to the other end in the background, then closes it
+func feed(other net.Conn, data []byte) {
+	go func() {
+		other.Write(data)
+		other.Close()
+	}()
+}
+
+// chunk builds the basic and message header of a chunk, the fields of the message header are passed in as they are
+func chunk(format byte, id uint32, fields ...[]byte) []byte {
+	var b []byte
+	switch {
+	case id < 64:
+		b = []byte{format<<6 | byte(id)}
+	case id < 320:
+		b = []byte{format << 6, byte(id - 64)}
+	default:
+		b = []byte{format<<6 | 1, byte(id - 64), byte((id - 64) >> 8)}
+	}
+	for _, field := range fields {
+		b = append(b, field...)
+	}
+	return b
+}
+
+func u24(v uint32) []byte  { return []byte{byte(v >> 16), byte(v >> 8), byte(v)} }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+func TestReadChunk(t *testing.T) {
+	long := testPayload(300)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		messages []message
+		err      error
+	}{
+		{
+			name:     "format 0",
+			input:    join(chunk(0, 3, u24(1000), u24(5), []byte{typeCommandAMF0}, le32(1)), []byte("hello")),
+			messages: []message{{typeCommandAMF0, 1, 1000, []byte("hello")}},
+		},
+		{
+			name: "message split over chunks",
+			input: join(
+				chunk(0, 4, u24(16), u24(300), []byte{typeVideo}, le32(1)), long[:128],
+				chunk(3, 4), long[128:256],
+				chunk(3, 4), long[256:],
+			),
+			messages: []message{{typeVideo, 1, 16, long}},
+		},
+		{
+			name: "compressed headers",
+			input: join(
+				chunk(0, 5, u24(1000), u24(2), []byte{typeAudio}, le32(1)), []byte("ab"),
+				chunk(1, 5, u24(20), u24(3), []byte{typeVideo}), []byte("cde"),
+				chunk(2, 5, u24(30)), []byte("fgh"),
+				chunk(3, 5), []byte("ijk"),
+			),
+			messages: []message{
+				{typeAudio, 1, 1000, []byte("ab")},
+				{typeVideo, 1, 1020, []byte("cde")},
+				{typeVideo, 1, 1050, []byte("fgh")},
+				// a format 3 chunk starting a message repeats the last delta
+				{typeVideo, 1, 1080, []byte("ijk")},
+			},
+		},
+		{
+			name: "extended timestamp",
+			input: join(
+				chunk(0, 6, u24(extendedTimestamp), u24(200), []byte{typeVideo}, le32(1), u32(0x01000000)), long[:128],
+				// the continuation chunks repeat it
+				chunk(3, 6, u32(0x01000000)), long[128:200],
+			),
+			messages: []message{{typeVideo, 1, 0x01000000, long[:200]}},
+		},
+		{
+			name: "extended timestamp delta",
+			input: join(
+				chunk(0, 6, u24(10), u24(1), []byte{typeVideo}, le32(1)), []byte("a"),
+				chunk(1, 6, u24(extendedTimestamp), u24(1), []byte{typeVideo}, u32(0x01000000)), []byte("b"),
+			),
+			messages: []message{
+				{typeVideo, 1, 10, []byte("a")},
+				{typeVideo, 1, 0x0100000A, []byte("b")},
+			},
+		},
+		{
+			name: "two and three byte chunk stream ids",
+			input: join(
+				chunk(0, 100, u24(1), u24(1), []byte{typeAudio}, le32(1)), []byte("a"),
+				chunk(0, 1000, u24(2), u24(1), []byte{typeVideo}, le32(1)), []byte("b"),
+				chunk(2, 100, u24(5)), []byte("c"),
+			),
+			messages: []message{
+				{typeAudio, 1, 1, []byte("a")},
+				{typeVideo, 1, 2, []byte("b")},
+				{typeAudio, 1, 6, []byte("c")},
+			},
+		},
+		{
+			name: "interleaved chunk streams",
+			input: join(
+				chunk(0, 4, u24(1), u24(200), []byte{typeVideo}, le32(1)), long[:128],
+				chunk(0, 6, u24(2), u24(2), []byte{typeAudio}, le32(1)), []byte("ab"),
+				chunk(3, 4), long[128:200],
+			),
+			messages: []message{
+				{typeAudio, 1, 2, []byte("ab")},
+				{typeVideo, 1, 1, long[:200]},
+			},
+		},
+		{
+			name:  "continuing a chunk stream we never saw",
+			input: join(chunk(1, 7, u24(20), u24(3), []byte{typeVideo}), []byte("abc")),
+			err:   errBadChunkHeader,
+		},
+		{
+			name:  "cut off payload",
+			input: join(chunk(0, 3, u24(0), u24(10), []byte{typeCommandAMF0}, le32(0)), []byte("abc")),
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "cut off header",
+			input: chunk(0, 3, u24(0), u24(10)),
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+	for _, test := range tests {
+		c, other := pipeConn(t)
+		feed(other, test.input)
+
+		messages := []message{}
+		var err error
+		for {
+			var m *message
+			if m, err = c.readChunk(); err != nil {
+				break
+			}
+			if m != nil {
+				messages = append(messages, *m)
+			}
+		}
+		// the messages that were whole are read until the input runs out
+		want := test.err
+		if want == nil {
+			want = io.EOF
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, want)
+		}
+		if len(messages) != len(test.messages) || (len(messages) > 0 && !reflect.DeepEqual(messages, test.messages)) {
+			t.Errorf("%s: got %+v, want %+v", test.name, messages, test.messages)
+		}
+	}
+}
+
+func TestReadMessageControl(t *testing.T) {
+	long := testPayload(300)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  message
+		err   error
+	}{
+		{
+			name: "chunk size change",
+			input: join(
+				chunk(0, chunkStreamControl, u24(0), u24(4), []byte{typeSetChunkSize}, le32(0)), u32(4096),
+				// the whole message fits in a chunk now
+				chunk(0, 4, u24(5), u24(300), []byte{typeVideo}, le32(1)), long,
+			),
+			want: message{typeVideo, 1, 5, long},
+		},
+		{
+			name:  "zero chunk size",
+			input: join(chunk(0, chunkStreamControl, u24(0), u24(4), []byte{typeSetChunkSize}, le32(0)), u32(0)),
+			err:   errBadChunkSize,
+		},
+		{
+			name:  "chunk size with the top bit set",
+			input: join(chunk(0, chunkStreamControl, u24(0), u24(4), []byte{typeSetChunkSize}, le32(0)), u32(1<<31)),
+			err:   errBadChunkSize,
+		},
+		{
+			name: "abort",
+			input: join(
+				chunk(0, 4, u24(5), u24(200), []byte{typeVideo}, le32(1)), long[:128],
+				chunk(0, chunkStreamControl, u24(0), u24(4), []byte{typeAbort}, le32(0)), u32(4),
+				chunk(0, 4, u24(6), u24(2), []byte{typeVideo}, le32(1)), []byte("ab"),
+			),
+			want: message{typeVideo, 1, 6, []byte("ab")},
+		},
+		{
+			name: "window size and bandwidth",
+			input: join(
+				chunk(0, chunkStreamControl, u24(0), u24(4), []byte{typeWindowAckSize}, le32(0)), u32(1<<20),
+				chunk(0, chunkStreamControl, u24(0), u24(5), []byte{typeSetPeerBandwidth}, le32(0)), u32(1<<20), []byte{2},
+				chunk(0, 3, u24(0), u24(2), []byte{typeDataAMF0}, le32(1)), []byte("ab"),
+			),
+			want: message{typeDataAMF0, 1, 0, []byte("ab")},
+		},
+	}
+	for _, test := range tests {
+		c, other := pipeConn(t)
+		feed(other, test.input)
+
+		m, err := c.readMessage()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(*m, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *m, test.want)
+		}
+	}
+}
+
+func TestReadMessageAnswersPings(t *testing.T) {
+	c, other := pipeConn(t)
+	go other.Write(join(
+		chunk(0, chunkStreamControl, u24(0), u24(6), []byte{typeUserControl}, le32(0)), u16(userControlPingRequest), u32(1234),
+		chunk(0, 3, u24(0), u24(2), []byte{typeDataAMF0}, le32(1)), []byte("ab"),
+	))
+
+	// the response goes out before the next message is read
+	go c.readMessage()
+	response := make([]byte, 12+6)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(other, response); err != nil {
+		t.Fatal(err)
+	}
+	want := join(chunk(0, chunkStreamControl, u24(0), u24(6), []byte{typeUserControl}, le32(0)), u16(userControlPingResponse), u32(1234))
+	if !bytes.Equal(response, want) {
+		t.Errorf("got %x, want %x", response, want)
+	}
+}
+
+func TestWriteMessageRoundTrip(t *testing.T) {
+	writer, other := pipeConn(t)
+	reader := newConn(other)
+	reader.timeout = time.Second
+
+	messages := []*message{
+		{typeID: typeCommandAMF0, streamID: 0, timestamp: 0, payload: encodeAMF("connect", 1)},
+		// split into 128 byte chunks with the extended timestamp repeated on each
+		{typeID: typeVideo, streamID: 1, timestamp: 0x01234567, payload: testPayload(1000)},
+		{typeID: typeSetChunkSize, streamID: 0, timestamp: 0, payload: u32(4096)},
+		{typeID: typeAudio, streamID: 1, timestamp: 40, payload: testPayload(3000)},
+	}
+	go func() {
+		for _, m := range messages {
+			if err := writer.writeMessage(chunkStreamVideo, m); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range messages {
+		if want.typeID == typeSetChunkSize {
+			continue
+		}
+		m, err := reader.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("got type %d at %d with %d bytes, want type %d at %d with %d bytes",
+				m.typeID, m.timestamp, len(m.payload), want.typeID, want.timestamp, len(want.payload))
+		}
+	}
+	if reader.readChunkSize != 4096 {
+		t.Errorf("read chunk size is %d, want 4096", reader.readChunkSize)
+	}
+}
@@ -0,0 +1,196 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// the FLV codec ids we handle
+const (
+	CodecAVC       = 7
+	SoundFormatAAC = 10
+)
+
+// the packet types of AVC video and AAC audio tags
+const (
+	PacketSequenceHeader = 0
+	PacketData           = 1
+	PacketEndOfSequence  = 2
+)
+
+var (
+	errShortTag     = errors.New("flv tag is too short")
+	errBadAVCConfig = errors.New("invalid avc decoder configuration record")
+	errNotAVCOrAAC  = errors.New("only avc video and aac audio are supported")
+)
+
+// VideoTag is the body of an FLV video tag (and of an RTMP video message)
+type VideoTag struct {
+	KeyFrame   bool
+	CodecID    byte
+	PacketType byte
+	// the presentation time minus the decode time in milliseconds
+	CompositionTime int32
+	Data            []byte
+}
+
+func ParseVideoTag(payload []byte) (VideoTag, error) {
+	if len(payload) < 1 {
+		return VideoTag{}, errShortTag
+	}
+	tag := VideoTag{
+		KeyFrame: payload[0]>>4 == 1,
+		CodecID:  payload[0] & 0x0F,
+	}
+	if tag.CodecID != CodecAVC {
+		return tag, errNotAVCOrAAC
+	}
+	if len(payload) < 5 {
+		return tag, errShortTag
+	}
+	tag.PacketType = payload[1]
+	// the composition time is a signed 24 bit value
+	tag.CompositionTime = int32(uint24(payload[2:])<<8) >> 8
+	tag.Data = payload[5:]
+	return tag, nil
+}
+
+// Marshal builds the body of the video tag
+func (t VideoTag) Marshal() []byte {
+	frameType := byte(2)
+	if t.KeyFrame {
+		frameType = 1
+	}
+	b := []byte{frameType<<4 | t.CodecID, t.PacketType}
+	b = append(b, byte(t.CompositionTime>>16), byte(t.CompositionTime>>8), byte(t.CompositionTime))
+	return append(b, t.Data...)
+}
+
+// AudioTag is the body of an FLV audio tag (and of an RTMP audio message)
+type AudioTag struct {
+	SoundFormat byte
+	PacketType  byte
+	Data        []byte
+}
+
+func ParseAudioTag(payload []byte) (AudioTag, error) {
+	if len(payload) < 1 {
+		return AudioTag{}, errShortTag
+	}
+	tag := AudioTag{SoundFormat: payload[0] >> 4}
+	if tag.SoundFormat != SoundFormatAAC {
+		return tag, errNotAVCOrAAC
+	}
+	if len(payload) < 2 {
+		return tag, errShortTag
+	}
+	tag.PacketType = payload[1]
+	tag.Data = payload[2:]
+	return tag, nil
+}
+
+// Marshal builds the body of the audio tag, AAC is always flagged as 44.1kHz 16 bit stereo (the config has the real values)
+func (t AudioTag) Marshal() []byte {
+	return append([]byte{t.SoundFormat<<4 | 0x0F, t.PacketType}, t.Data...)
+}
+
+// the H.264 NAL unit types that matter when remuxing
+const (
+	NALUTypeIDR = 5
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+	NALUTypeAUD = 9
+)
+
+// AVCConfig is the AVC decoder configuration record sent as the video sequence header
+type AVCConfig struct {
+	SPS [][]byte
+	PPS [][]byte
+	// the size of the length prefix of each NAL unit in the frames
+	NALULength int
+}
+
+func ParseAVCConfig(record []byte) (AVCConfig, error) {
+	if len(record) < 7 {
+		return AVCConfig{}, errBadAVCConfig
+	}
+	config := AVCConfig{NALULength: int(record[4]&0x03) + 1}
+
+	data := record[5:]
+	readSets := func(count int) ([][]byte, error) {
+		sets := [][]byte{}
+		for i := 0; i < count; i++ {
+			if len(data) < 2 {
+				return nil, errBadAVCConfig
+			}
+			size := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+size {
+				return nil, errBadAVCConfig
+			}
+			sets = append(sets, data[2:2+size])
+			data = data[2+size:]
+		}
+		return sets, nil
+	}
+
+	var err error
+	count := int(data[0] & 0x1F)
+	data = data[1:]
+	if config.SPS, err = readSets(count); err != nil {
+		return config, err
+	}
+	if len(data) < 1 {
+		return config, errBadAVCConfig
+	}
+	count = int(data[0])
+	data = data[1:]
+	config.PPS, err = readSets(count)
+	return config, err
+}
+
+// Marshal builds the decoder configuration record
+func (c AVCConfig) Marshal() []byte {
+	if len(c.SPS) == 0 || len(c.SPS[0]) < 4 {
+		return nil
+	}
+	sps := c.SPS[0]
+	b := []byte{1, sps[1], sps[2], sps[3], 0xFC | byte(c.NALULength-1), 0xE0 | byte(len(c.SPS))}
+	for _, s := range c.SPS {
+		b = append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+	}
+	b = append(b, byte(len(c.PPS)))
+	for _, p := range c.PPS {
+		b = append(binary.BigEndian.AppendUint16(b, uint16(len(p))), p...)
+	}
+	return b
+}
+
+// JoinNALUs builds a frame of length prefixed NAL units
+func (c AVCConfig) JoinNALUs(nalus [][]byte) []byte {
+	frame := []byte{}
+	for _, nalu := range nalus {
+		for i := c.NALULength - 1; i >= 0; i-- {
+			frame = append(frame, byte(len(nalu)>>(8*i)))
+		}
+		frame = append(frame, nalu...)
+	}
+	return frame
+}
+
+// SplitNALUs splits a frame of length prefixed NAL units
+func (c AVCConfig) SplitNALUs(frame []byte) [][]byte {
+	nalus := [][]byte{}
+	for len(frame) > c.NALULength {
+		size := 0
+		for _, b := range frame[:c.NALULength] {
+			size = size<<8 | int(b)
+		}
+		frame = frame[c.NALULength:]
+		if size > len(frame) {
+			break
+		}
+		nalus = append(nalus, frame[:size])
+		frame = frame[size:]
+	}
+	return nalus
+}
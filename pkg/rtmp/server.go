@@ -0,0 +1,182 @@
+package rtmp
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// Publisher receives the media of an RTMP client that is publishing
+type Publisher interface {
+	// WriteVideo and WriteAudio are called with the bodies of the FLV tags and their timestamp in milliseconds
+	WriteVideo(timestamp uint32, payload []byte) error
+	WriteAudio(timestamp uint32, payload []byte) error
+	// Close is called once the client stops publishing or goes away
+	Close() error
+}
+
+// PublishHandler is called when a client starts publishing, the key is the stream name it publishes under
+type PublishHandler func(app, key string) (Publisher, error)
+
+var errNotPublishing = errors.New("media sent before publishing")
+
+// ListenAndServe accepts RTMP publishers on the address until the listener fails
+func ListenAndServe(addr string, handler PublishHandler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(listener, handler)
+}
+
+// Serve accepts RTMP publishers on the listener until it fails, the listener is closed when it returns
+func Serve(listener net.Listener, handler PublishHandler) error {
+	defer listener.Close()
+
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serve(newConn(nc), handler); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+// serve runs a publishing session, it returns once the client goes away
+func serve(c *conn, handler PublishHandler) error {
+	defer c.Close()
+
+	if err := c.serverHandshake(); err != nil {
+		return err
+	}
+
+	app := ""
+	var publisher Publisher
+	defer func() {
+		if publisher != nil {
+			if err := publisher.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch m.typeID {
+		case typeCommandAMF0, typeCommandAMF3:
+			values, err := commandValues(m)
+			if err != nil {
+				return err
+			}
+			if len(values) < 2 {
+				continue
+			}
+			name, _ := values[0].(string)
+			transaction, _ := values[1].(float64)
+
+			switch name {
+			case "connect":
+				if len(values) > 2 {
+					if command, ok := values[2].(Object); ok {
+						app, _ = command["app"].(string)
+					}
+				}
+				if err := c.acceptConnect(transaction); err != nil {
+					return err
+				}
+
+			case "releaseStream", "FCPublish", "FCUnpublish":
+				if err := c.writeCommand(0, "_result", transaction, nil, undefined{}); err != nil {
+					return err
+				}
+
+			case "createStream":
+				// every client gets the same message stream, we only do one publish per connection
+				if err := c.writeCommand(0, "_result", transaction, nil, 1); err != nil {
+					return err
+				}
+
+			case "publish":
+				key := ""
+				if len(values) > 3 {
+					key, _ = values[3].(string)
+				}
+				// some tools pass parameters along with the key
+				key, _, _ = strings.Cut(key, "?")
+
+				if publisher != nil {
+					continue
+				}
+				publisher, err = handler(app, key)
+				if err != nil {
+					c.writeCommand(m.streamID, "onStatus", 0, nil, Object{
+						"level":       "error",
+						"code":        "NetStream.Publish.BadName",
+						"description": err.Error(),
+					})
+					return err
+				}
+				if err := c.writeCommand(m.streamID, "onStatus", 0, nil, Object{
+					"level":       "status",
+					"code":        "NetStream.Publish.Start",
+					"description": "Publishing " + key,
+				}); err != nil {
+					return err
+				}
+
+			case "deleteStream", "closeStream":
+				return nil
+			}
+
+		case typeVideo, typeAudio:
+			if publisher == nil {
+				return errNotPublishing
+			}
+			if len(m.payload) == 0 {
+				continue
+			}
+
+			if m.typeID == typeVideo {
+				err = publisher.WriteVideo(m.timestamp, m.payload)
+			} else {
+				err = publisher.WriteAudio(m.timestamp, m.payload)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// acceptConnect sets up the connection and answers the connect command
+func (c *conn) acceptConnect(transaction float64) error {
+	control := []*message{
+		{typeID: typeWindowAckSize, payload: u32(ourWindowSize)},
+		{typeID: typeSetPeerBandwidth, payload: append(u32(ourWindowSize), 2)},
+		{typeID: typeSetChunkSize, payload: u32(ourChunkSize)},
+	}
+	for _, m := range control {
+		if err := c.writeMessage(chunkStreamControl, m); err != nil {
+			return err
+		}
+	}
+
+	return c.writeCommand(0, "_result", transaction,
+		Object{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+		Object{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"description":    "Connection succeeded.",
+			"objectEncoding": 0,
+		},
+	)
+}
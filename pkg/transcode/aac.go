@@ -0,0 +1,92 @@
+package transcode
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	errShortConfig = errors.New("aac audio specific config is too short")
+	errBadADTS     = errors.New("invalid adts header")
+)
+
+// AACConfig is the part of an AAC AudioSpecificConfig we need to frame raw AAC
+type AACConfig struct {
+	ObjectType     byte
+	FrequencyIndex byte
+	Channels       byte
+}
+
+func ParseAACConfig(asc []byte) (AACConfig, error) {
+	if len(asc) < 2 {
+		return AACConfig{}, errShortConfig
+	}
+	return AACConfig{
+		ObjectType:     asc[0] >> 3,
+		FrequencyIndex: (asc[0]&0x07)<<1 | asc[1]>>7,
+		Channels:       (asc[1] >> 3) & 0x0F,
+	}, nil
+}
+
+// ADTS prefixes a raw AAC frame with an ADTS header so it can be decoded without the config
+func (c AACConfig) ADTS(frame []byte) []byte {
+	length := len(frame) + 7
+	header := []byte{
+		0xFF, 0xF1, // sync word, MPEG-4, no CRC
+		(c.ObjectType-1)<<6 | c.FrequencyIndex<<2 | c.Channels>>2,
+		(c.Channels&0x03)<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&0x07)<<5 | 0x1F, // and the buffer fullness (0x7FF means variable bitrate)
+		0xFC,                        // the rest of the buffer fullness and a single raw data block
+	}
+	return append(header, frame...)
+}
+
+// the sample rates of the AAC frequency indexes
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// FrameDuration returns how long each AAC frame (1024 samples) plays for
+func (c AACConfig) FrameDuration() time.Duration {
+	if int(c.FrequencyIndex) >= len(aacSampleRates) {
+		return 0
+	}
+	return 1024 * time.Second / time.Duration(aacSampleRates[c.FrequencyIndex])
+}
+
+// Marshal builds the AudioSpecificConfig
+func (c AACConfig) Marshal() []byte {
+	return []byte{c.ObjectType<<3 | c.FrequencyIndex>>1, c.FrequencyIndex<<7 | c.Channels<<3}
+}
+
+// readADTS reads the next ADTS frame, returning the config in its header and the raw frame
+func readADTS(r io.Reader) (AACConfig, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return AACConfig{}, nil, err
+	}
+	if header[0] != 0xFF || header[1]&0xF0 != 0xF0 {
+		return AACConfig{}, nil, errBadADTS
+	}
+
+	config := AACConfig{
+		ObjectType:     header[2]>>6 + 1,
+		FrequencyIndex: (header[2] >> 2) & 0x0F,
+		Channels:       (header[2]&0x01)<<2 | header[3]>>6,
+	}
+	length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	// a CRC follows the header when protection is on
+	headerSize := 7
+	if header[1]&0x01 == 0 {
+		headerSize = 9
+	}
+	if length < headerSize {
+		return config, nil, errBadADTS
+	}
+
+	data := make([]byte, length-7)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return config, nil, err
+	}
+	return config, data[headerSize-7:], nil
+}
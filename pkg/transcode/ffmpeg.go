@@ -0,0 +1,68 @@
+package transcode
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// FFmpegPath is the ffmpeg binary used for transcoding and rendering
+var FFmpegPath = "ffmpeg"
+
+// the input flags that keep ffmpeg from buffering a live pipe while it probes it
+var liveInput = []string{"-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0"}
+
+// pipe runs ffmpeg with a stdin to feed and a stdout to read
+type pipe struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func startPipe(args ...string) (*pipe, error) {
+	cmd := exec.Command(FFmpegPath, append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &pipe{cmd: cmd, stdin: stdin, stdout: stdout, stderr: stderr}, nil
+}
+
+func (p *pipe) Write(data []byte) (int, error) {
+	return p.stdin.Write(data)
+}
+
+// Close ends the input and waits for ffmpeg to exit
+func (p *pipe) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	p.stdin.Close()
+	err := p.cmd.Wait()
+	if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+		log.Println("ffmpeg:", msg)
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+var errBadPage = errors.New("invalid ogg page")
+
+// oggReader splits an Ogg stream back into the packets it carries
+type oggReader struct {
+	r *bufio.Reader
+	// a packet that continues on the next page
+	partial []byte
+	// the packets of the last page that haven't been returned yet
+	packets [][]byte
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next packet of the stream
+func (o *oggReader) next() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+func (o *oggReader) readPage() error {
+	// capture pattern, version, header type, granule position, serial number, sequence number, checksum
+	// and the number of segments
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return errBadPage
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return err
+	}
+
+	for _, size := range segments {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return err
+		}
+		o.partial = append(o.partial, data...)
+		// a segment shorter than 255 bytes ends the packet
+		if size < 255 {
+			o.packets = append(o.packets, o.partial)
+			o.partial = nil
+		}
+	}
+	return nil
+}
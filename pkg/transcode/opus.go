@@ -0,0 +1,131 @@
+package transcode
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// OpusFrameDuration is the duration of each Opus packet the encoders produce
+const OpusFrameDuration = 20 * time.Millisecond
+
+// AACToOpus transcodes ADTS framed AAC into Opus packets
+type AACToOpus struct {
+	*pipe
+	packets chan []byte
+}
+
+func NewAACToOpus() (*AACToOpus, error) {
+	args := append(append([]string{}, liveInput...),
+		"-f", "aac", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", "96k", "-ar", "48000", "-ac", "2", "-frame_duration", "20", "-application", "lowdelay",
+		// a page per packet so nothing waits in ffmpeg
+		"-f", "ogg", "-page_duration", "20000", "-flush_packets", "1", "pipe:1",
+	)
+	p, err := startPipe(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &AACToOpus{pipe: p, packets: make(chan []byte, 64)}
+	go t.read()
+	return t, nil
+}
+
+// Packets returns the Opus packets (20ms each), the channel is closed once ffmpeg exits
+func (t *AACToOpus) Packets() <-chan []byte {
+	return t.packets
+}
+
+func (t *AACToOpus) read() {
+	defer close(t.packets)
+
+	reader := newOggReader(t.stdout)
+	// skip the OpusHead and OpusTags headers
+	for i := 0; i < 2; i++ {
+		if _, err := reader.next(); err != nil {
+			return
+		}
+	}
+	for {
+		packet, err := reader.next()
+		if err != nil {
+			return
+		}
+		select {
+		case t.packets <- packet:
+		default:
+			log.Println("dropping opus packet, nothing is reading them")
+		}
+	}
+}
+
+// OpusToAAC transcodes Opus RTP packets into AAC frames
+type OpusToAAC struct {
+	*pipe
+	ogg    *oggwriter.OggWriter
+	frames chan []byte
+
+	lock   sync.Mutex
+	config AACConfig
+	ready  bool
+}
+
+func NewOpusToAAC() (*OpusToAAC, error) {
+	args := append(append([]string{}, liveInput...),
+		"-f", "ogg", "-i", "pipe:0",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "48000", "-ac", "2",
+		"-f", "adts", "-flush_packets", "1", "pipe:1",
+	)
+	p, err := startPipe(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the RTP packets go into ffmpeg as an Ogg stream
+	ogg, err := oggwriter.NewWith(p, 48000, 2)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	t := &OpusToAAC{pipe: p, ogg: ogg, frames: make(chan []byte, 64)}
+	go t.read()
+	return t, nil
+}
+
+func (t *OpusToAAC) WriteRTP(packet *rtp.Packet) error {
+	return t.ogg.WriteRTP(packet)
+}
+
+// Frames returns the raw AAC frames (1024 samples at 48kHz each), the channel is closed once ffmpeg exits
+func (t *OpusToAAC) Frames() <-chan []byte {
+	return t.frames
+}
+
+// Config returns the AAC config of the frames, it's only known once the first frame is out
+func (t *OpusToAAC) Config() (AACConfig, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.config, t.ready
+}
+
+func (t *OpusToAAC) read() {
+	defer close(t.frames)
+
+	for {
+		config, frame, err := readADTS(t.stdout)
+		if err != nil {
+			return
+		}
+		t.lock.Lock()
+		t.config, t.ready = config, true
+		t.lock.Unlock()
+
+		// the frames are timed by counting them so none can be dropped
+		t.frames <- frame
+	}
+}
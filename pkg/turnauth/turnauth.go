@@ -0,0 +1,55 @@
+package turnauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadUsername = errors.New("turn username has no expiry")
+	ErrExpired     = errors.New("turn credentials have expired")
+)
+
+// Credentials generates time limited TURN credentials for a user out of the secret shared with the TURN server
+// (the TURN REST API scheme coturn and friends use), the username carries the expiry and the password signs it
+func Credentials(secret, user string, ttl time.Duration) (string, string) {
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	return username, Password(secret, username)
+}
+
+// Password signs a username with the shared secret
+func Password(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Parse splits a username into its expiry and the user it was generated for
+func Parse(username string) (time.Time, string, error) {
+	expiry, user, _ := strings.Cut(username, ":")
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrBadUsername
+	}
+	return time.Unix(seconds, 0), user, nil
+}
+
+// Check returns the password of a username that hasn't expired yet
+func Check(secret, username string) (string, error) {
+	expiry, _, err := Parse(username)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(expiry) {
+		return "", ErrExpired
+	}
+	return Password(secret, username), nil
+}
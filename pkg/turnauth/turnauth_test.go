@@ -0,0 +1,95 @@
+package turnauth
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+	}{
+		{"with a user", "room/192.0.2.1"},
+		{"without a user", ""},
+		{"ipv6 client", "room/2001:db8::1"},
+	}
+	for _, test := range tests {
+		username, password := Credentials("secret", test.user, time.Hour)
+
+		expiry, user, err := Parse(username)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if user != test.user {
+			t.Errorf("%s: parsed user %q, want %q", test.name, user, test.user)
+		}
+		if d := time.Until(expiry); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("%s: expires in %v, want an hour", test.name, d)
+		}
+
+		// the TURN server derives the same password from the username alone
+		checked, err := Check("secret", username)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if checked != password {
+			t.Errorf("%s: checked password %q, want %q", test.name, checked, password)
+		}
+		if other, _ := Check("other secret", username); other == password {
+			t.Errorf("%s: another secret signs the username the same way", test.name)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// base64(hmac-sha1("secret", "1700000000:user"))
+	if password := Password("secret", "1700000000:user"); password != "I/MZeIG6MwzOV8Uubr9liB2556o=" {
+		t.Errorf("got %q", password)
+	}
+	if Password("secret", "1700000000:user") == Password("secret", "1700000000:other") {
+		t.Error("the password doesn't depend on the username")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		username string
+		err      error
+	}{
+		{"valid", future + ":user", nil},
+		{"valid without a user", future, nil},
+		{"expired", past + ":user", ErrExpired},
+		{"expired without a user", past, ErrExpired},
+		{"static username", "user", ErrBadUsername},
+		{"user before expiry", "user:" + future, ErrBadUsername},
+		{"empty", "", ErrBadUsername},
+	}
+	for _, test := range tests {
+		password, err := Check("secret", test.username)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && password != Password("secret", test.username) {
+			t.Errorf("%s: got password %q", test.name, password)
+		}
+		if err != nil && password != "" {
+			t.Errorf("%s: got password %q along with %v", test.name, password, err)
+		}
+	}
+}
+
+func TestCredentialsExpire(t *testing.T) {
+	username, _ := Credentials("secret", "user", -time.Second)
+	if _, err := Check("secret", username); !errors.Is(err, ErrExpired) {
+		t.Errorf("got %v, want %v", err, ErrExpired)
+	}
+}
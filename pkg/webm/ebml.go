@@ -0,0 +1,107 @@
+package webm
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// the EBML and Matroska element ids we write
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+
+	idSegment       = 0x18538067
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idMuxingApp     = 0x4D80
+	idWritingApp    = 0x5741
+
+	idTracks            = 0x1654AE6B
+	idTrackEntry        = 0xAE
+	idTrackNumber       = 0xD7
+	idTrackUID          = 0x73C5
+	idTrackType         = 0x83
+	idCodecID           = 0x86
+	idCodecPrivate      = 0x63A2
+	idCodecDelay        = 0x56AA
+	idSeekPreRoll       = 0x56BB
+	idVideo             = 0xE0
+	idPixelWidth        = 0xB0
+	idPixelHeight       = 0xBA
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+
+	idCluster     = 0x1F43B675
+	idTimecode    = 0xE7
+	idSimpleBlock = 0xA3
+)
+
+// the size of elements we stream out without knowing how big they get (the segment and clusters)
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// elementID encodes an element id, the ids already carry their length marker
+func elementID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// vint encodes an element size in as few bytes as possible
+func vint(v uint64) []byte {
+	length := 1
+	// the all ones value of each length is reserved
+	for v >= 1<<(7*length)-1 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= 1 << (8 - length)
+	return b
+}
+
+// element builds an element out of its payload (which can be other elements)
+func element(id uint32, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := append(elementID(id), vint(uint64(size))...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	// drop the leading zero bytes but keep at least one
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return element(id, b)
+}
+
+func floatElement(id uint32, v float64) []byte {
+	return element(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func stringElement(id uint32, v string) []byte {
+	return element(id, []byte(v))
+}
@@ -0,0 +1,165 @@
+package webm
+
+import (
+	"encoding/binary"
+
+	"videochat/pkg/h264"
+)
+
+// isKeyFrame checks if a complete VP8, VP9 or H.264 frame is a key frame
+func isKeyFrame(codec string, frame []byte) bool {
+	if len(frame) < 1 {
+		return false
+	}
+
+	switch codec {
+	case CodecVP8:
+		// the P bit of the frame tag is 0 for key frames
+		return frame[0]&0x01 == 0
+	case CodecVP9:
+		r := &bitReader{data: frame}
+		if _, ok := vp9Profile(r); !ok {
+			return false
+		}
+		// show_existing_frame and frame_type (0 for key frames)
+		showExisting, _ := r.bits(1)
+		frameType, ok := r.bits(1)
+		return ok && showExisting == 0 && frameType == 0
+	case CodecH264:
+		for _, nalu := range h264.SplitAVCC(frame) {
+			if nalu[0]&0x1F == h264.NALUTypeIDR {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frameSize reads the video size out of a key frame
+func frameSize(codec string, frame []byte) (uint16, uint16, bool) {
+	switch codec {
+	case CodecVP8:
+		// the frame tag is followed by a start code and the 14 bit width and height
+		if len(frame) < 10 || frame[3] != 0x9D || frame[4] != 0x01 || frame[5] != 0x2A {
+			return 0, 0, false
+		}
+		width := (uint16(frame[7])<<8 | uint16(frame[6])) & 0x3FFF
+		height := (uint16(frame[9])<<8 | uint16(frame[8])) & 0x3FFF
+		return width, height, true
+	case CodecVP9:
+		return vp9FrameSize(frame)
+	case CodecH264:
+		sps, _ := parameterSets(frame)
+		if sps == nil {
+			return 0, 0, false
+		}
+		width, height, err := h264.SPSResolution(sps)
+		return width, height, err == nil
+	}
+	return 0, 0, false
+}
+
+// codecPrivate builds the codec private data of the video track out of a key frame, only H.264 has any
+func codecPrivate(codec string, frame []byte) ([]byte, bool) {
+	if codec != CodecH264 {
+		return nil, true
+	}
+	sps, pps := parameterSets(frame)
+	if sps == nil || pps == nil {
+		return nil, false
+	}
+
+	// an AVCDecoderConfigurationRecord with 4 byte lengths and a single SPS and PPS
+	record := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(sps)))
+	record = append(record, sps...)
+	record = append(record, 1)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(pps)))
+	return append(record, pps...), true
+}
+
+// parameterSets returns the first SPS and PPS of a H.264 frame
+func parameterSets(frame []byte) (sps, pps []byte) {
+	for _, nalu := range h264.SplitAVCC(frame) {
+		switch nalu[0] & 0x1F {
+		case h264.NALUTypeSPS:
+			if sps == nil && len(nalu) >= 4 {
+				sps = nalu
+			}
+		case h264.NALUTypePPS:
+			if pps == nil {
+				pps = nalu
+			}
+		}
+	}
+	return sps, pps
+}
+
+// vp9FrameSize parses the uncompressed header of a VP9 key frame up to the frame size
+func vp9FrameSize(frame []byte) (uint16, uint16, bool) {
+	r := &bitReader{data: frame}
+	profile, ok := vp9Profile(r)
+	if !ok {
+		return 0, 0, false
+	}
+	// show_existing_frame, frame_type, show_frame and error_resilient_mode
+	r.bits(4)
+
+	// the sync code
+	if code, _ := r.bits(24); code != 0x498342 {
+		return 0, 0, false
+	}
+
+	// color config
+	if profile >= 2 {
+		r.bits(1) // ten_or_twelve_bit
+	}
+	colorSpace, _ := r.bits(3)
+	if colorSpace != 7 {
+		r.bits(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.bits(3) // subsampling_x, subsampling_y and reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.bits(1) // reserved_zero
+	}
+
+	width, _ := r.bits(16)
+	height, ok := r.bits(16)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint16(width + 1), uint16(height + 1), true
+}
+
+// vp9Profile reads the frame marker and profile that start every VP9 frame
+func vp9Profile(r *bitReader) (uint32, bool) {
+	if marker, ok := r.bits(2); !ok || marker != 2 {
+		return 0, false
+	}
+	low, _ := r.bits(1)
+	high, ok := r.bits(1)
+	profile := high<<1 | low
+	if profile == 3 {
+		r.bits(1) // reserved_zero
+	}
+	return profile, ok
+}
+
+// bitReader reads the bit fields of a frame header
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bits(n int) (uint32, bool) {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, false
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v, true
+}
@@ -0,0 +1,238 @@
+package webm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// the codec ids of the video tracks we can write
+// NOTE H.264 isn't allowed in WebM, files with it are written as plain Matroska
+const (
+	CodecVP8  = "V_VP8"
+	CodecVP9  = "V_VP9"
+	CodecH264 = "V_MPEG4/ISO/AVC"
+)
+
+const (
+	videoTrackNumber = 1
+	audioTrackNumber = 2
+
+	// the pre skip browsers use when encoding Opus
+	opusPreSkip = 312
+	// block timecodes are 16 bit offsets from their cluster
+	maxClusterDuration = 30 * time.Second
+)
+
+var (
+	errUnknownFrameSize = errors.New("couldn't read the frame size from the key frame")
+	errNoParameterSets  = errors.New("the key frame doesn't carry the H.264 parameter sets")
+)
+
+// Writer streams a live WebM file with an optional VP8/VP9 track and an Opus track, or a Matroska file when the
+// video is H.264 (as 4 byte length prefixed NAL units)
+// NOTE the segment and clusters are written with unknown sizes so the file can't be seeked without remuxing
+type Writer struct {
+	out        io.Writer
+	videoCodec string
+
+	// the header is written once the first video key frame tells us the video size
+	started bool
+	// set until the video (re)starts with a key frame
+	waitKeyFrame bool
+
+	clusterOpen bool
+	clusterTime time.Duration
+
+	// the timestamp of the first frame written to each track
+	videoStart, audioStart time.Duration
+	wroteVideo, wroteAudio bool
+}
+
+// NewWriter creates a writer for a video track with the given codec and an audio track, an empty codec means audio only
+func NewWriter(out io.Writer, videoCodec string) *Writer {
+	return &Writer{
+		out:          out,
+		videoCodec:   videoCodec,
+		waitKeyFrame: true,
+	}
+}
+
+// ResetVideo drops the video frames until the next key frame, for when the video source changes
+func (w *Writer) ResetVideo() {
+	w.waitKeyFrame = true
+}
+
+// WriteVideo adds a video frame, frames before the first key frame are dropped
+func (w *Writer) WriteVideo(frame []byte, timestamp time.Duration) error {
+	keyFrame := isKeyFrame(w.videoCodec, frame)
+	if w.waitKeyFrame && !keyFrame {
+		return nil
+	}
+	w.waitKeyFrame = false
+
+	if !w.started {
+		width, height, ok := frameSize(w.videoCodec, frame)
+		if !ok {
+			return errUnknownFrameSize
+		}
+		private, ok := codecPrivate(w.videoCodec, frame)
+		if !ok {
+			return errNoParameterSets
+		}
+		if err := w.writeHeader(width, height, private); err != nil {
+			return err
+		}
+	}
+
+	// every key frame starts a cluster so players can seek to it
+	if keyFrame || !w.fitsCluster(timestamp) {
+		if err := w.writeCluster(timestamp); err != nil {
+			return err
+		}
+	}
+	if !w.wroteVideo {
+		w.videoStart, w.wroteVideo = timestamp, true
+	}
+	return w.writeBlock(videoTrackNumber, frame, timestamp, keyFrame)
+}
+
+// WriteAudio adds an Opus packet, packets before the header is written (waiting on video) are dropped
+func (w *Writer) WriteAudio(frame []byte, timestamp time.Duration) error {
+	if !w.started {
+		if w.videoCodec != "" {
+			return nil
+		}
+		if err := w.writeHeader(0, 0, nil); err != nil {
+			return err
+		}
+	}
+
+	if !w.fitsCluster(timestamp) {
+		if err := w.writeCluster(timestamp); err != nil {
+			return err
+		}
+	}
+	if !w.wroteAudio {
+		w.audioStart, w.wroteAudio = timestamp, true
+	}
+	return w.writeBlock(audioTrackNumber, frame, timestamp, true)
+}
+
+// VideoStart returns the timestamp of the first video frame in the file
+func (w *Writer) VideoStart() (time.Duration, bool) {
+	return w.videoStart, w.wroteVideo
+}
+
+// AudioStart returns the timestamp of the first audio frame in the file
+func (w *Writer) AudioStart() (time.Duration, bool) {
+	return w.audioStart, w.wroteAudio
+}
+
+func (w *Writer) writeHeader(width, height uint16, private []byte) error {
+	docType := "webm"
+	if w.videoCodec == CodecH264 {
+		docType = "matroska"
+	}
+	header := element(idEBML,
+		uintElement(idEBMLVersion, 1),
+		uintElement(idEBMLReadVersion, 1),
+		uintElement(idEBMLMaxIDLength, 4),
+		uintElement(idEBMLMaxSizeLength, 8),
+		stringElement(idDocType, docType),
+		uintElement(idDocTypeVersion, 4),
+		uintElement(idDocTypeReadVersion, 2),
+	)
+
+	info := element(idInfo,
+		uintElement(idTimecodeScale, uint64(time.Millisecond)),
+		stringElement(idMuxingApp, "videochat"),
+		stringElement(idWritingApp, "videochat"),
+	)
+
+	tracks := [][]byte{}
+	if w.videoCodec != "" {
+		video := [][]byte{
+			uintElement(idTrackNumber, videoTrackNumber),
+			uintElement(idTrackUID, videoTrackNumber),
+			uintElement(idTrackType, 1),
+			stringElement(idCodecID, w.videoCodec),
+		}
+		if private != nil {
+			video = append(video, element(idCodecPrivate, private))
+		}
+		video = append(video, element(idVideo,
+			uintElement(idPixelWidth, uint64(width)),
+			uintElement(idPixelHeight, uint64(height)),
+		))
+		tracks = append(tracks, element(idTrackEntry, video...))
+	}
+	tracks = append(tracks, element(idTrackEntry,
+		uintElement(idTrackNumber, audioTrackNumber),
+		uintElement(idTrackUID, audioTrackNumber),
+		uintElement(idTrackType, 2),
+		stringElement(idCodecID, "A_OPUS"),
+		element(idCodecPrivate, opusHead()),
+		uintElement(idCodecDelay, uint64(opusPreSkip*time.Second/48000)),
+		uintElement(idSeekPreRoll, uint64(80*time.Millisecond)),
+		element(idAudio,
+			floatElement(idSamplingFrequency, 48000),
+			uintElement(idChannels, 2),
+		),
+	))
+
+	segment := append(elementID(idSegment), unknownSize...)
+	segment = append(segment, info...)
+	segment = append(segment, element(idTracks, tracks...)...)
+
+	if _, err := w.out.Write(append(header, segment...)); err != nil {
+		return err
+	}
+	w.started = true
+	return nil
+}
+
+// fitsCluster checks if the timestamp can be written as an offset from the open cluster
+func (w *Writer) fitsCluster(timestamp time.Duration) bool {
+	offset := timestamp - w.clusterTime
+	return w.clusterOpen && offset < maxClusterDuration && offset > -maxClusterDuration
+}
+
+func (w *Writer) writeCluster(timestamp time.Duration) error {
+	if timestamp < 0 {
+		timestamp = 0
+	}
+	cluster := append(elementID(idCluster), unknownSize...)
+	cluster = append(cluster, uintElement(idTimecode, uint64(timestamp/time.Millisecond))...)
+	if _, err := w.out.Write(cluster); err != nil {
+		return err
+	}
+	w.clusterOpen = true
+	w.clusterTime = timestamp
+	return nil
+}
+
+func (w *Writer) writeBlock(track byte, frame []byte, timestamp time.Duration, keyFrame bool) error {
+	flags := byte(0)
+	if keyFrame {
+		flags = 0x80
+	}
+	offset := int16((timestamp - w.clusterTime) / time.Millisecond)
+	// the track number as a 1 byte vint, the timecode offset and the flags
+	header := binary.BigEndian.AppendUint16([]byte{0x80 | track}, uint16(offset))
+	header = append(header, flags)
+
+	_, err := w.out.Write(element(idSimpleBlock, header, frame))
+	return err
+}
+
+// opusHead builds the identification header Opus tracks carry as codec private data
+func opusHead() []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, 2) // version and channel count
+	head = binary.LittleEndian.AppendUint16(head, opusPreSkip)
+	head = binary.LittleEndian.AppendUint32(head, 48000) // input sample rate
+	head = binary.LittleEndian.AppendUint16(head, 0)     // output gain
+	return append(head, 0)                               // channel mapping family
+}
@@ -0,0 +1,224 @@
+package webm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// the EBML header and the start of the segment (info and tracks) of an audio only file
+var audioOnlyHeader = []byte{
+	// EBML
+	0x1A, 0x45, 0xDF, 0xA3, 0x9F,
+	0x42, 0x86, 0x81, 0x01, // EBMLVersion
+	0x42, 0xF7, 0x81, 0x01, // EBMLReadVersion
+	0x42, 0xF2, 0x81, 0x04, // EBMLMaxIDLength
+	0x42, 0xF3, 0x81, 0x08, // EBMLMaxSizeLength
+	0x42, 0x82, 0x84, 'w', 'e', 'b', 'm', // DocType
+	0x42, 0x87, 0x81, 0x04, // DocTypeVersion
+	0x42, 0x85, 0x81, 0x02, // DocTypeReadVersion
+
+	// Segment of unknown size
+	0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+	// Info
+	0x15, 0x49, 0xA9, 0x66, 0x9F,
+	0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40, // TimecodeScale (1ms)
+	0x4D, 0x80, 0x89, 'v', 'i', 'd', 'e', 'o', 'c', 'h', 'a', 't', // MuxingApp
+	0x57, 0x41, 0x89, 'v', 'i', 'd', 'e', 'o', 'c', 'h', 'a', 't', // WritingApp
+	// Tracks
+	0x16, 0x54, 0xAE, 0x6B, 0xC6,
+	0xAE, 0xC4, // TrackEntry
+	0xD7, 0x81, 0x02, // TrackNumber
+	0x73, 0xC5, 0x81, 0x02, // TrackUID
+	0x83, 0x81, 0x02, // TrackType (audio)
+	0x86, 0x86, 'A', '_', 'O', 'P', 'U', 'S', // CodecID
+	0x63, 0xA2, 0x93, // CodecPrivate
+	'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 0x01, 0x02, 0x38, 0x01, 0x80, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x56, 0xAA, 0x83, 0x63, 0x2E, 0xA0, // CodecDelay (6.5ms)
+	0x56, 0xBB, 0x84, 0x04, 0xC4, 0xB4, 0x00, // SeekPreRoll (80ms)
+	0xE1, 0x8D, // Audio
+	0xB5, 0x88, 0x40, 0xE7, 0x70, 0x00, 0x00, 0x00, 0x00, 0x00, // SamplingFrequency (48000)
+	0x9F, 0x81, 0x02, // Channels
+}
+
+// cluster is the start of a cluster of unknown size at the timecode
+func cluster(timecode ...byte) []byte {
+	b := []byte{0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xE7, 0x80 | byte(len(timecode))}
+	return append(b, timecode...)
+}
+
+// simpleBlock is a SimpleBlock of a track at an offset from its cluster
+func simpleBlock(track byte, offset uint16, flags byte, frame []byte) []byte {
+	b := []byte{0xA3, 0x80 | byte(4+len(frame)), 0x80 | track, byte(offset >> 8), byte(offset), flags}
+	return append(b, frame...)
+}
+
+func TestWriterAudioOnly(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewWriter(out, "")
+
+	for _, packet := range []struct {
+		timestamp time.Duration
+		frame     []byte
+	}{
+		{1500 * time.Millisecond, []byte{0xFC, 0x01}},
+		{1520 * time.Millisecond, []byte{0xFC, 0x02}},
+		// too far from the cluster for a 16 bit offset
+		{40 * time.Second, []byte{0xFC, 0x03}},
+	} {
+		if err := w.WriteAudio(packet.frame, packet.timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := bytes.Join([][]byte{
+		audioOnlyHeader,
+		cluster(0x05, 0xDC),
+		simpleBlock(2, 0, 0x80, []byte{0xFC, 0x01}),
+		simpleBlock(2, 20, 0x80, []byte{0xFC, 0x02}),
+		cluster(0x9C, 0x40),
+		simpleBlock(2, 0, 0x80, []byte{0xFC, 0x03}),
+	}, nil)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got\n%x\nwant\n%x", out.Bytes(), want)
+	}
+	if start, ok := w.AudioStart(); !ok || start != 1500*time.Millisecond {
+		t.Errorf("audio starts at %v %v", start, ok)
+	}
+}
+
+func TestWriterVideo(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewWriter(out, CodecVP8)
+
+	// a 640x480 VP8 key frame and an inter frame
+	keyFrame := []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0xE0, 0x01}
+	interFrame := []byte{0x11, 0x02, 0x00}
+
+	steps := []struct {
+		video     bool
+		frame     []byte
+		timestamp time.Duration
+	}{
+		// nothing is written before the first key frame
+		{true, interFrame, 0},
+		{false, []byte{0xFC}, 0},
+		{true, keyFrame, 100 * time.Millisecond},
+		{false, []byte{0xFC}, 110 * time.Millisecond},
+		{true, interFrame, 133 * time.Millisecond},
+		// every key frame starts a cluster
+		{true, keyFrame, 166 * time.Millisecond},
+	}
+	for _, step := range steps {
+		var err error
+		if step.video {
+			err = w.WriteVideo(step.frame, step.timestamp)
+		} else {
+			err = w.WriteAudio(step.frame, step.timestamp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the video track goes in front of the audio track
+	videoTrack := []byte{
+		0xAE, 0x9B, // TrackEntry
+		0xD7, 0x81, 0x01, // TrackNumber
+		0x73, 0xC5, 0x81, 0x01, // TrackUID
+		0x83, 0x81, 0x01, // TrackType (video)
+		0x86, 0x85, 'V', '_', 'V', 'P', '8', // CodecID
+		0xE0, 0x88, // Video
+		0xB0, 0x82, 0x02, 0x80, // PixelWidth
+		0xBA, 0x82, 0x01, 0xE0, // PixelHeight
+	}
+	header := append([]byte{}, audioOnlyHeader...)
+	tracks := bytes.Index(header, []byte{0x16, 0x54, 0xAE, 0x6B})
+	header = bytes.Join([][]byte{header[:tracks+4], {0xC6 + byte(len(videoTrack))}, videoTrack, header[tracks+5:]}, nil)
+
+	want := bytes.Join([][]byte{
+		header,
+		cluster(0x64),
+		simpleBlock(1, 0, 0x80, keyFrame),
+		simpleBlock(2, 10, 0x80, []byte{0xFC}),
+		simpleBlock(1, 33, 0x00, interFrame),
+		cluster(0xA6),
+		simpleBlock(1, 0, 0x80, keyFrame),
+	}, nil)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got\n%x\nwant\n%x", out.Bytes(), want)
+	}
+	if start, ok := w.VideoStart(); !ok || start != 100*time.Millisecond {
+		t.Errorf("video starts at %v %v", start, ok)
+	}
+}
+
+func TestWriterH264(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewWriter(out, CodecH264)
+
+	// a 320x240 baseline SPS, a PPS and the slices, as 4 byte length prefixed NAL units
+	sps := []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	idr := []byte{0, 0, 0, 2, 0x65, 0x88}
+	keyFrame := bytes.Join([][]byte{{0, 0, 0, 8}, sps, {0, 0, 0, 4}, pps, idr}, nil)
+	interFrame := []byte{0, 0, 0, 2, 0x41, 0x9A}
+
+	// both parameter sets are needed for the header
+	if err := w.WriteVideo(bytes.Join([][]byte{{0, 0, 0, 8}, sps, idr}, nil), 0); err != errNoParameterSets {
+		t.Fatalf("key frame without parameter sets: got %v, want %v", err, errNoParameterSets)
+	}
+	w.ResetVideo()
+	out.Reset()
+
+	for _, step := range []struct {
+		frame     []byte
+		timestamp time.Duration
+	}{
+		{interFrame, 0},
+		{keyFrame, 100 * time.Millisecond},
+		{interFrame, 133 * time.Millisecond},
+	} {
+		if err := w.WriteVideo(step.frame, step.timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	avcC := bytes.Join([][]byte{{1, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0, 8}, sps, {1, 0, 4}, pps}, nil)
+	for _, want := range []struct {
+		name string
+		data []byte
+	}{
+		{"DocType", []byte{0x42, 0x82, 0x88, 'm', 'a', 't', 'r', 'o', 's', 'k', 'a'}},
+		{"CodecID", append([]byte{0x86, 0x8F}, CodecH264...)},
+		{"CodecPrivate", append([]byte{0x63, 0xA2, 0x80 | byte(len(avcC))}, avcC...)},
+		{"PixelWidth", []byte{0xB0, 0x82, 0x01, 0x40}},
+		{"PixelHeight", []byte{0xBA, 0x81, 0xF0}},
+		{"key frame", append(cluster(0x64), simpleBlock(1, 0, 0x80, keyFrame)...)},
+		{"inter frame", simpleBlock(1, 33, 0x00, interFrame)},
+	} {
+		if !bytes.Contains(out.Bytes(), want.data) {
+			t.Errorf("%s %x is missing from\n%x", want.name, want.data, out.Bytes())
+		}
+	}
+}
+
+func TestVint(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		// all ones is reserved
+		{127, []byte{0x40, 0x7F}},
+		{300, []byte{0x41, 0x2C}},
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+	}
+	for _, test := range tests {
+		if got := vint(test.v); !bytes.Equal(got, test.want) {
+			t.Errorf("vint(%d) = %x, want %x", test.v, got, test.want)
+		}
+	}
+}
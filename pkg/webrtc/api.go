@@ -0,0 +1,101 @@
+package webrtc
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// header extensions that carry the mid and rid of each simulcast layer
+var simulcastExtensions = []string{
+	sdp.SDESMidURI,
+	sdp.SDESRTPStreamIDURI,
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// newPeerConnection creates a peer connection that is able to receive simulcast and estimate its downlink bandwidth
+// NOTE each peer connection gets its own media engine since pion doesn't allow sharing them
+func newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+
+	// register the header extensions needed to tell the simulcast layers apart
+	for _, extension := range simulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// register the audio levels of the publishers, they are used to tell who is speaking
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, nil, err
+	}
+
+	// setup the congestion controller, it estimates the bandwidth of the peer from the TWCC feedback it sends back
+	// NOTE we don't pace the outgoing packets since we adapt by switching simulcast layers instead
+	i := &interceptor.Registry{}
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the callback runs while the peer connection is being built, so there's exactly one estimator per call
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+
+	// add the transport wide sequence numbers the congestion controller needs
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, nil, err
+	}
+
+	// setup the default interceptors (NACK, RTCP reports, etc)
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return peerConnection, estimator, nil
+}
+
+// preferH264 puts H.264 first in the answer for the video a peer publishes, browsers default to VP8 otherwise and
+// only H.264 can be packaged for HLS and restreamed without transcoding
+// (peers that can't send H.264 still publish whatever else they offered)
+// NOTE this has to be called between setting the offer and creating the answer
+func preferH264(peerConnection *webrtc.PeerConnection) {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		// only the transceivers we receive on, the ones we send on already have their track
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo || transceiver.Receiver() == nil ||
+			(transceiver.Sender() != nil && transceiver.Sender().Track() != nil) {
+			continue
+		}
+
+		codecs := transceiver.Receiver().GetParameters().Codecs
+		sort.SliceStable(codecs, func(i, j int) bool {
+			return isH264(codecs[i]) && !isH264(codecs[j])
+		})
+		if err := transceiver.SetCodecPreferences(codecs); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func isH264(codec webrtc.RTPCodecParameters) bool {
+	return strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264)
+}
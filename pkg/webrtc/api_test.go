@@ -0,0 +1,104 @@
+package webrtc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPreferH264(t *testing.T) {
+	// the publisher offers VP8 first, like browsers do
+	publisher, _, err := newPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if _, err := publisher.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := publisher.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := answerVideo(t, offer)
+	if codec := firstVideoCodec(t, offer.SDP); codec != "VP8" {
+		t.Fatalf("offer starts with %s, the test needs it to start with VP8", codec)
+	}
+	if codec := firstVideoCodec(t, answer); !strings.EqualFold(codec, "H264") {
+		t.Errorf("answer starts with %s, want H264", codec)
+	}
+}
+
+func TestPreferH264WithoutH264(t *testing.T) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if _, err := publisher.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := publisher.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a publisher that can't send H.264 still gets to publish
+	if codec := firstVideoCodec(t, answerVideo(t, offer)); codec != "VP8" {
+		t.Errorf("answer starts with %s, want VP8", codec)
+	}
+}
+
+func answerVideo(t *testing.T, offer webrtc.SessionDescription) string {
+	t.Helper()
+	server, _, err := newPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	preferH264(server)
+	answer, err := server.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answer.SDP
+}
+
+// firstVideoCodec returns the name of the first codec of the first video section
+func firstVideoCodec(t *testing.T, raw string) string {
+	t.Helper()
+	description := sdp.SessionDescription{}
+	if err := description.Unmarshal([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" || len(media.MediaName.Formats) == 0 {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key == "rtpmap" && strings.HasPrefix(attribute.Value, media.MediaName.Formats[0]+" ") {
+				name := strings.Fields(attribute.Value)[1]
+				return name[:strings.Index(name, "/")]
+			}
+		}
+	}
+	t.Fatal("no video codec in the sdp")
+	return ""
+}
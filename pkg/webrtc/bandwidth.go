@@ -0,0 +1,141 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// the estimate we start every subscriber with until we get feedback from it (bps)
+	initialBitrate = 1_000_000
+	// subscribers with less than this per video track stop receiving video entirely (bps)
+	pauseBitrate = 80_000
+	// how much more than a layer needs we want to see before moving a subscriber up to it
+	upgradeHeadroom = 1.25
+	// how often the layers of each subscriber are adapted to its estimate
+	bandwidthInterval = time.Second
+)
+
+// the bitrate we expect a publisher to send on each simulcast layer (bps)
+var layerBitrates = map[string]int{
+	"f": 1_200_000,
+	"h": 400_000,
+	"q": 150_000,
+}
+
+// Bandwidth keeps track of how much a subscriber is able to receive
+type Bandwidth struct {
+	// the congestion controller estimate, from the TWCC feedback of the subscriber
+	Estimator cc.BandwidthEstimator
+
+	lock sync.Mutex
+	// the latest REMB sent by the subscriber (0 until it sends one)
+	remb int
+}
+
+// Bitrate returns the estimated downlink of the subscriber in bps
+func (b *Bandwidth) Bitrate() int {
+	bitrate := initialBitrate
+	if b.Estimator != nil {
+		bitrate = b.Estimator.GetTargetBitrate()
+	}
+
+	// the REMB of the subscriber caps whatever we estimated on our end
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.remb > 0 && b.remb < bitrate {
+		bitrate = b.remb
+	}
+	return bitrate
+}
+
+func (b *Bandwidth) setREMB(bitrate int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.remb = bitrate
+}
+
+// layerLimit picks the best layer that fits in the budget (or pauses the video if none does)
+func layerLimit(budget int, current string) (string, bool) {
+	for _, rid := range simulcastLayers {
+		needed := float64(layerBitrates[rid])
+		// require some headroom before moving up so that we don't flap between layers
+		if current == "" || layerRank(rid) < layerRank(current) {
+			needed *= upgradeHeadroom
+		}
+		if float64(budget) >= needed {
+			return rid, false
+		}
+	}
+
+	if budget < pauseBitrate {
+		return "", true
+	}
+	return simulcastLayers[len(simulcastLayers)-1], false
+}
+
+// AdaptLayers periodically fits the video a subscriber receives to its estimated bandwidth until the connection closes
+func (p *Peers) AdaptLayers(state PeerConnectionState) {
+	ticker := time.NewTicker(bandwidthInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if state.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		p.adaptLayers(state)
+	}
+}
+
+func (p *Peers) adaptLayers(state PeerConnectionState) {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	// split the estimate between all the video tracks this subscriber receives
+	senders := []*webrtc.RTPSender{}
+	for _, sender := range state.PeerConnection.GetSenders() {
+		if sender.Track() != nil && sender.Track().Kind() == webrtc.RTPCodecTypeVideo {
+			senders = append(senders, sender)
+		}
+	}
+	if len(senders) == 0 {
+		return
+	}
+	budget := state.Bandwidth.Bitrate() / len(senders)
+
+	limit, pause := layerLimit(budget, state.Layers.Limit())
+	state.Layers.setLimit(limit, pause)
+
+	// move every sender onto the layer that fits (this is a no-op for senders already on it)
+	for _, sender := range senders {
+		if track, ok := p.TrackLocals[sender.Track().ID()]; ok {
+			syncLayer(track, sender, state)
+		}
+	}
+}
+
+// readRTCP drains the RTCP a subscriber sends back for a track, this is also what lets the interceptors see the feedback
+func readRTCP(sender *webrtc.RTPSender, track *SimulcastTrack, state PeerConnectionState) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				state.Bandwidth.setREMB(int(packet.Bitrate))
+			// pass key frame requests on to the publisher of the layer the subscriber is on
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if rid, ok := state.Layers.Current(track.ID); ok {
+					track.requestKeyFrame(rid)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package webrtc
+
+import "testing"
+
+func TestLayerLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  int
+		current string
+		limit   string
+		paused  bool
+	}{
+		{"plenty", 2_000_000, "", "f", false},
+		{"full layer with headroom", 1_500_000, "", "f", false},
+		{"full layer without headroom", 1_499_999, "", "h", false},
+		// staying on a layer doesn't need headroom, moving up does
+		{"staying on full", 1_200_000, "f", "f", false},
+		{"dropping from full", 1_199_999, "f", "h", false},
+		{"not moving up to full", 1_499_999, "h", "h", false},
+		{"moving up to full", 1_500_000, "h", "f", false},
+		{"staying on half", 400_000, "h", "h", false},
+		{"dropping from half", 399_999, "h", "q", false},
+		{"moving up to half", 500_000, "q", "h", false},
+		{"not moving up to half", 499_999, "q", "q", false},
+		// below the lowest layer the video keeps going on it until the budget gets too small
+		{"below quarter", 100_000, "q", "q", false},
+		{"at the pause threshold", pauseBitrate, "q", "q", false},
+		{"paused", pauseBitrate - 1, "q", "", true},
+		{"paused without a layer", 10_000, "", "", true},
+		{"resuming", 187_500, pausedLayer, "q", false},
+	}
+	for _, test := range tests {
+		limit, paused := layerLimit(test.budget, test.current)
+		if limit != test.limit || paused != test.paused {
+			t.Errorf("%s: %d bps on %q got %q (paused %v), want %q (paused %v)",
+				test.name, test.budget, test.current, limit, paused, test.limit, test.paused)
+		}
+	}
+}
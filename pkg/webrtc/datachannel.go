@@ -0,0 +1,112 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+
+	"videochat/pkg/chat"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// the label of the DataChannel the chat is carried over
+const chatLabel = "chat"
+
+// chatChannel bridges the chat DataChannel of a peer connection to the hub
+type chatChannel struct {
+	dataChannel *webrtc.DataChannel
+	hub         *chat.Hub
+	displayName string
+	role        chat.Role
+
+	// closed once the channel is open and can be written to, or once the client left
+	opened chan struct{}
+	done   chan struct{}
+
+	lock   sync.Mutex
+	client *chat.Client
+	left   bool
+}
+
+// openChat opens a DataChannel for the chat on the peer connection so the client doesn't need the chat websocket,
+// the returned function leaves the hub
+func openChat(peerConnection *webrtc.PeerConnection, hub *chat.Hub, displayName string, role chat.Role) (func(), error) {
+	dataChannel, err := peerConnection.CreateDataChannel(chatLabel, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chatChannel{
+		dataChannel: dataChannel,
+		hub:         hub,
+		displayName: displayName,
+		role:        role,
+		opened:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	dataChannel.OnOpen(func() {
+		close(c.opened)
+		c.join()
+	})
+	// NOTE pion calls this from a single goroutine, as Receive needs
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if client := c.join(); client != nil && msg.IsString {
+			client.Receive(msg.Data)
+		}
+	})
+	dataChannel.OnClose(c.leave)
+	return c.leave, nil
+}
+
+// join registers the client with the hub when the channel opens, or when its first message beats the open to us
+func (c *chatChannel) join() *chat.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client != nil || c.left {
+		return c.client
+	}
+	client, ok := chat.NewClient(c.hub, c.displayName, c.role)
+	if !ok {
+		c.left = true
+		close(c.done)
+		return nil
+	}
+	c.client = client
+	go c.write(client)
+	return client
+}
+
+// write sends the messages of the hub down the channel until the hub drops the client
+func (c *chatChannel) write(client *chat.Client) {
+	defer func() {
+		c.leave()
+		c.dataChannel.Close()
+	}()
+
+	select {
+	case <-c.opened:
+	case <-c.done:
+		return
+	}
+	for message := range client.Send {
+		if err := c.dataChannel.SendText(string(message)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func (c *chatChannel) leave() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.left {
+		return
+	}
+	c.left = true
+	close(c.done)
+	if c.client != nil {
+		c.client.Leave()
+	}
+}
@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+
+	"videochat/pkg/hls"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// HLSConfig is used for every HLS muxer the rooms start
+var HLSConfig = hls.DefaultConfig
+
+// hlsSink feeds the best layer of one H.264 and one Opus track of the room into a HLS muxer
+// NOTE the publishers are asked for H.264 (see preferH264), the video of the ones that can only send VP8 or VP9 would
+// need transcoding so it's left out, the playlist is audio only until someone publishes H.264
+type hlsSink struct {
+	muxer   *hls.Muxer
+	packets chan sinkPacket
+
+	lock sync.Mutex
+	// the ids of the tracks being packaged
+	video string
+	audio string
+	// the video tracks that were left out for their codec, so it's only logged once
+	skipped map[string]bool
+}
+
+// sinkPacket is a packet (or the end of a source) queued up for the goroutine of a sink
+type sinkPacket struct {
+	kind   webrtc.RTPCodecType
+	packet *rtp.Packet
+	// set when the source of this kind went away
+	reset bool
+}
+
+func newHLSSink(config hls.Config) *hlsSink {
+	s := &hlsSink{
+		muxer:   hls.NewMuxer(config),
+		packets: make(chan sinkPacket, 512),
+		skipped: make(map[string]bool),
+	}
+	go s.run()
+	return s
+}
+
+// run does the muxing off the forwarding loop
+func (s *hlsSink) run() {
+	for p := range s.packets {
+		switch {
+		case p.kind == webrtc.RTPCodecTypeVideo && p.reset:
+			s.muxer.ResetVideo()
+		case p.kind == webrtc.RTPCodecTypeAudio && p.reset:
+			s.muxer.ResetAudio()
+		case p.kind == webrtc.RTPCodecTypeVideo:
+			s.muxer.WriteVideo(p.packet)
+		case p.kind == webrtc.RTPCodecTypeAudio:
+			s.muxer.WriteAudio(p.packet)
+		}
+	}
+}
+
+func (s *hlsSink) WriteRTP(track *SimulcastTrack, rid string, packet *rtp.Packet) {
+	// only the best layer goes into the playlist
+	if rid != track.BestLayer() {
+		return
+	}
+
+	s.lock.Lock()
+	source := &s.audio
+	codec := webrtc.MimeTypeOpus
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		source = &s.video
+		codec = webrtc.MimeTypeH264
+	}
+	// HLS players can only play H.264 and Opus, and we only package the first track of each kind
+	if track.Codec.MimeType != codec || (*source != "" && *source != track.ID) {
+		if track.Codec.MimeType != codec && !s.skipped[track.ID] {
+			s.skipped[track.ID] = true
+			log.Printf("%s track %s can't be packaged for HLS, it's left out", track.Codec.MimeType, track.ID)
+		}
+		s.lock.Unlock()
+		return
+	}
+	*source = track.ID
+	s.lock.Unlock()
+
+	// drop the packet rather than hold up the forwarding loop if the muxer is falling behind
+	select {
+	case s.packets <- sinkPacket{kind: track.Kind, packet: packet}:
+	default:
+	}
+}
+
+func (s *hlsSink) TrackEnded(track *SimulcastTrack) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.skipped, track.ID)
+	// free up the slot so the next track of this kind gets packaged
+	switch track.ID {
+	case s.video:
+		s.video = ""
+	case s.audio:
+		s.audio = ""
+	default:
+		return
+	}
+	s.packets <- sinkPacket{kind: track.Kind, reset: true}
+}
+
+// HLS returns the HLS muxer of the room, the tracks of the room start being packaged the first time it's called
+func (r *Room) HLS() *hls.Muxer {
+	r.hlsLock.Lock()
+	defer r.hlsLock.Unlock()
+
+	if r.hls == nil {
+		r.hls = newHLSSink(HLSConfig)
+		r.Peers.AddSink(r.hls)
+		// get the muxer a key frame so the first segment can start right away
+		r.Peers.DispatchKeyFrame()
+	}
+	return r.hls.muxer
+}
+
+// StopHLS stops packaging the room, the viewers still waiting on the muxer time out
+func (r *Room) StopHLS() {
+	r.hlsLock.Lock()
+	defer r.hlsLock.Unlock()
+
+	if r.hls != nil {
+		// once the sink is removed nothing writes to the packets channel anymore
+		r.Peers.RemoveSink(r.hls)
+		close(r.hls.packets)
+		r.hls = nil
+	}
+}
@@ -0,0 +1,89 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+)
+
+var (
+	ErrNotHost             = errors.New("only hosts can do that")
+	ErrHostTarget          = errors.New("hosts can't do that to other hosts")
+	ErrParticipantNotFound = errors.New("participant not found")
+	ErrUnmuteNotAllowed    = errors.New("muted by a host until they ask to unmute")
+)
+
+// authorize finds the connection of the target, making sure the requester is a host allowed to act on it
+func (p *Peers) authorize(requester *Participant, id string) (PeerConnectionState, error) {
+	if requester == nil || requester.Role != RoleHost {
+		return PeerConnectionState{}, ErrNotHost
+	}
+
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+	for _, connection := range p.Connections {
+		if connection.Participant == nil || connection.Participant.ID != id {
+			continue
+		}
+		if connection.Participant.Role == RoleHost {
+			return PeerConnectionState{}, ErrHostTarget
+		}
+		return connection, nil
+	}
+	return PeerConnectionState{}, ErrParticipantNotFound
+}
+
+// Mute stops forwarding the audio of a participant until a host asks them to unmute
+func (p *Peers) Mute(requester *Participant, id string) error {
+	target, err := p.authorize(requester, id)
+	if err != nil {
+		return err
+	}
+
+	target.Participant.mute()
+	p.broadcast("participant-updated", target.Participant, nil)
+	return nil
+}
+
+// RequestUnmute asks a participant to unmute, which they are allowed to do from then on even if a host muted them
+func (p *Peers) RequestUnmute(requester *Participant, id string) error {
+	target, err := p.authorize(requester, id)
+	if err != nil {
+		return err
+	}
+
+	target.Participant.allowUnmute()
+	return target.Websocket.WriteJSON(&websocketMessage{
+		Event: "unmute-requested",
+		Data:  requester.ID,
+	})
+}
+
+// Unmute forwards the audio of a participant that was muted by a host again
+func (p *Peers) Unmute(participant *Participant) error {
+	if err := participant.unmute(); err != nil {
+		return err
+	}
+	p.broadcast("participant-updated", participant, nil)
+	return nil
+}
+
+// Kick closes the connection of a participant, which lets everyone else know they left
+func (p *Peers) Kick(requester *Participant, id string) error {
+	target, err := p.authorize(requester, id)
+	if err != nil {
+		return err
+	}
+
+	if err := target.Websocket.WriteJSON(&websocketMessage{
+		Event: "kicked",
+		Data:  requester.ID,
+	}); err != nil {
+		log.Println(err)
+	}
+	target.Websocket.Conn.Close()
+	if err := target.PeerConnection.Close(); err != nil {
+		return err
+	}
+	p.SignalPeerConnections()
+	return nil
+}
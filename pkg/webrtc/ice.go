@@ -0,0 +1,105 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+
+	"videochat/pkg/turnauth"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE hands out the ICE servers of every peer connection, the server's and the browser's
+var ICE ICEServerProvider = &ICEConfig{
+	STUN: []string{"stun:stun.l.google.com:19302"},
+}
+
+// ICEServerProvider hands out the ICE config of a new connection
+type ICEServerProvider interface {
+	// Configuration returns the config of a connection, user identifies whoever gets TURN credentials out of it (see TURNUser)
+	Configuration(user string) webrtc.Configuration
+}
+
+// ICEConfig is an ICEServerProvider for a fixed set of STUN and TURN servers
+type ICEConfig struct {
+	STUN []string
+	TURN []string
+
+	// static TURN credentials
+	Username string
+	Password string
+	// the secret shared with the TURN server, when set every connection gets its own time limited credentials instead
+	Secret string
+	TTL    time.Duration
+
+	// only use relay candidates (so every connection goes through TURN)
+	RelayOnly bool
+}
+
+func (c *ICEConfig) Configuration(user string) webrtc.Configuration {
+	config := webrtc.Configuration{}
+	if len(c.STUN) > 0 {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{URLs: c.STUN})
+	}
+
+	if len(c.TURN) > 0 {
+		username, password := c.Username, c.Password
+		if c.Secret != "" {
+			username, password = turnauth.Credentials(c.Secret, user, c.TTL)
+		}
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:           c.TURN,
+			Username:       username,
+			Credential:     password,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+
+	// relaying only makes sense with somewhere to relay through
+	if c.RelayOnly && len(c.TURN) > 0 {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	return config
+}
+
+// TURNUser names whoever gets TURN credentials after the stream they're in (the stream id of a room, the username goes
+// over the wire in cleartext so it can't carry the room uuid) and the host they connect from
+// it stays the same when the page is reloaded or the client reconnects, which is what the TURN server keeps its
+// allocation quota for (a random id per connection would start a fresh quota every time)
+func TURNUser(id, client string) string {
+	return id + "/" + client
+}
+
+// addrHost returns the host of a client address, without the port that changes with every connection
+func addrHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// browserConfig is the part of the config that goes into the RTCConfiguration of the page
+type browserConfig struct {
+	ICEServers         []webrtc.ICEServer        `json:"iceServers"`
+	ICETransportPolicy webrtc.ICETransportPolicy `json:"iceTransportPolicy"`
+}
+
+// BrowserConfiguration returns the ICE config of a browser connection as the JSON of an RTCConfiguration
+func BrowserConfiguration(user string) string {
+	config := ICE.Configuration(user)
+	data, err := json.Marshal(browserConfig{
+		ICEServers:         config.ICEServers,
+		ICETransportPolicy: config.ICETransportPolicy,
+	})
+	if err != nil {
+		log.Println(err)
+		return "{}"
+	}
+	return string(data)
+}
@@ -0,0 +1,23 @@
+package webrtc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTURNUser(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}, "room/192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51235}, "room/192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "room/2001:db8::1"},
+		{nil, "room/"},
+	}
+	for _, test := range tests {
+		if user := TURNUser("room", addrHost(test.addr)); user != test.want {
+			t.Errorf("%v: got %q, want %q", test.addr, user, test.want)
+		}
+	}
+}
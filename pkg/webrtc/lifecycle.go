@@ -0,0 +1,198 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"videochat/pkg/chat"
+)
+
+var (
+	// RoomIdleTimeout is how long a room can go without peers or chat clients before it's closed
+	RoomIdleTimeout = 5 * time.Minute
+	// ChatHistoryDir is where the chat history of the rooms is kept (only in memory when empty)
+	ChatHistoryDir = ""
+	// ChatHistorySize is the number of messages of each room kept in memory
+	ChatHistorySize = 500
+	// ChatConfig configures the chat hubs of the rooms
+	ChatConfig = chat.DefaultHubConfig
+)
+
+type RoomState int
+
+const (
+	// nobody has joined the room yet
+	RoomCreated RoomState = iota
+	// the room has peers, chat clients or server side publishers
+	RoomActive
+	// everyone left, the room gets closed unless someone comes back within the idle timeout
+	RoomIdle
+	// the room has been torn down
+	RoomClosed
+)
+
+var roomStateNames = map[RoomState]string{
+	RoomCreated: "created",
+	RoomActive:  "active",
+	RoomIdle:    "idle",
+	RoomClosed:  "closed",
+}
+
+func (s RoomState) String() string {
+	return roomStateNames[s]
+}
+
+func (s RoomState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// RoomEvent is emitted every time a room changes state
+type RoomEvent struct {
+	Room  string    `json:"room"`
+	State RoomState `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+var (
+	roomListenersLock sync.Mutex
+	roomListeners     []func(RoomEvent)
+)
+
+// OnRoomEvent registers a function that is called with the lifecycle events of every room
+// NOTE the function is called inline so it shouldn't block
+func OnRoomEvent(f func(RoomEvent)) {
+	roomListenersLock.Lock()
+	defer roomListenersLock.Unlock()
+	roomListeners = append(roomListeners, f)
+}
+
+func emitRoomEvent(id string, state RoomState) {
+	roomListenersLock.Lock()
+	listeners := roomListeners
+	roomListenersLock.Unlock()
+
+	event := RoomEvent{Room: id, State: state, Time: time.Now()}
+	for _, f := range listeners {
+		f(event)
+	}
+}
+
+// NewRoom creates a room and starts its chat hub
+func NewRoom(id string) *Room {
+	room := &Room{
+		ID:       id,
+		StreamID: StreamID(id),
+		Peers: &Peers{
+			TrackLocals: make(map[string]*SimulcastTrack),
+			lobby:       lobby{enabled: LobbyEnabled},
+		},
+		Hub:        chat.NewHub(openChatStore(id), ChatConfig),
+		state:      RoomCreated,
+		lastActive: time.Now(),
+	}
+	go room.Hub.Run()
+	emitRoomEvent(id, RoomCreated)
+	return room
+}
+
+// openChatStore opens the history of the chat of a room, falling back to memory if the file can't be opened
+// NOTE the file is named after the hashed id so the id can't point it outside of the directory
+func openChatStore(id string) chat.Store {
+	if ChatHistoryDir != "" {
+		store, err := chat.OpenFileStore(filepath.Join(ChatHistoryDir, StreamID(id)+".jsonl"), ChatHistorySize)
+		if err == nil {
+			return store
+		}
+		log.Println(err)
+	}
+	return chat.NewMemoryStore(ChatHistorySize)
+}
+
+// State returns where the room is in its lifecycle
+func (r *Room) State() RoomState {
+	r.lifecycleLock.Lock()
+	defer r.lifecycleLock.Unlock()
+	return r.state
+}
+
+// Touch holds off the idle timeout, it's called whenever the room is looked up so a room isn't closed right before
+// someone connects to it
+func (r *Room) Touch() {
+	r.lifecycleLock.Lock()
+	defer r.lifecycleLock.Unlock()
+	r.lastActive = time.Now()
+}
+
+// occupied checks if anything is still using the room
+func (r *Room) occupied() bool {
+	r.Peers.ListLock.Lock()
+	connections, tracks := len(r.Peers.Connections), len(r.Peers.TrackLocals)
+	r.Peers.ListLock.Unlock()
+	return connections > 0 || tracks > 0 || r.Hub.Clients() > 0
+}
+
+// Update moves the room between active and idle, it returns true once the room has been idle for longer than the
+// idle timeout and should be closed
+func (r *Room) Update() bool {
+	occupied := r.occupied()
+	now := time.Now()
+
+	r.lifecycleLock.Lock()
+	previous := r.state
+	switch {
+	case r.state == RoomClosed:
+	case occupied:
+		r.state = RoomActive
+		r.lastActive = now
+	case r.state == RoomActive:
+		r.state = RoomIdle
+		r.lastActive = now
+	}
+	state := r.state
+	expired := state != RoomActive && state != RoomClosed && now.Sub(r.lastActive) >= RoomIdleTimeout
+	r.lifecycleLock.Unlock()
+
+	if state != previous {
+		emitRoomEvent(r.ID, state)
+	}
+	return expired
+}
+
+// Close tears the room down: the recording, restreams and HLS are stopped, the chat hub is stopped and whoever is
+// still connected is disconnected
+// NOTE the room has to be taken out of the registry first so nobody gets handed a closed room
+func (r *Room) Close() {
+	r.lifecycleLock.Lock()
+	if r.state == RoomClosed {
+		r.lifecycleLock.Unlock()
+		return
+	}
+	r.state = RoomClosed
+	r.lifecycleLock.Unlock()
+
+	if _, _, err := r.StopRecording(); err != nil && !errors.Is(err, ErrNotRecording) {
+		log.Println(err)
+	}
+	r.StopRestreams()
+	r.StopHLS()
+	r.Hub.Stop()
+	r.Peers.closeLobby()
+
+	// the peers get cleaned up by their connection handlers once they notice
+	r.Peers.ListLock.Lock()
+	connections := append([]PeerConnectionState{}, r.Peers.Connections...)
+	r.Peers.ListLock.Unlock()
+	for _, connection := range connections {
+		if connection.Websocket != nil {
+			connection.Websocket.Conn.Close()
+		}
+		if err := connection.PeerConnection.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	emitRoomEvent(r.ID, RoomClosed)
+}
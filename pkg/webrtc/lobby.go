@@ -0,0 +1,225 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// LobbyEnabled is whether rooms hold new participants in a lobby until a host admits them, hosts can turn the lobby
+// of their room on and off
+var LobbyEnabled = false
+
+var ErrNotWaiting = errors.New("participant isn't waiting in the lobby")
+
+// lobby holds the participants waiting to be let into the room
+type lobby struct {
+	lock    sync.Mutex
+	enabled bool
+	closed  bool
+	waiting []*knock
+}
+
+// knock is a participant waiting in the lobby
+type knock struct {
+	participant *Participant
+	websocket   *ThreadSafeWriter
+	// receives whether the participant was admitted
+	decision chan bool
+}
+
+// knock puts the participant in the lobby, it returns nil when the participant can go right in (the lobby is off, or
+// there is no host to let anyone in, in which case the participant becomes one)
+func (p *Peers) knock(participant *Participant, ws *ThreadSafeWriter) *knock {
+	p.ListLock.Lock()
+	hosted := p.joinRole() == RoleGuest
+	p.ListLock.Unlock()
+
+	p.lobby.lock.Lock()
+	if !p.lobby.enabled || !hosted {
+		p.lobby.lock.Unlock()
+		return nil
+	}
+	k := &knock{
+		participant: participant,
+		websocket:   ws,
+		decision:    make(chan bool, 1),
+	}
+	// nobody gets in once the room is closed
+	if p.lobby.closed {
+		p.lobby.lock.Unlock()
+		k.decision <- false
+		return k
+	}
+	p.lobby.waiting = append(p.lobby.waiting, k)
+	p.lobby.lock.Unlock()
+
+	if err := ws.WriteJSON(&websocketMessage{Event: "waiting"}); err != nil {
+		log.Println(err)
+	}
+	p.sendHosts("knock", participant)
+	return k
+}
+
+// WaitInLobby holds the participant in the lobby (without any media) until a host admits or denies them, it returns
+// true once the participant can join the room
+func (p *Peers) WaitInLobby(participant *Participant, ws *ThreadSafeWriter, messages <-chan []byte) bool {
+	k := p.knock(participant, ws)
+	if k == nil {
+		return true
+	}
+
+	for {
+		select {
+		case admitted := <-k.decision:
+			event := "denied"
+			if admitted {
+				event = "admitted"
+			}
+			if err := ws.WriteJSON(&websocketMessage{Event: event}); err != nil {
+				log.Println(err)
+			}
+			return admitted
+		case _, ok := <-messages:
+			// nothing the participant sends matters until they are let in, unless they are gone
+			if !ok {
+				if p.answer(participant.ID, false) == nil {
+					p.sendHosts("knock-ended", participant.ID)
+				}
+				return false
+			}
+		}
+	}
+}
+
+// Admit lets a participant waiting in the lobby into the room
+func (p *Peers) Admit(requester *Participant, id string) error {
+	if requester == nil || requester.Role != RoleHost {
+		return ErrNotHost
+	}
+	if err := p.answer(id, true); err != nil {
+		return err
+	}
+	p.sendHosts("knock-ended", id)
+	return nil
+}
+
+// Deny turns away a participant waiting in the lobby
+func (p *Peers) Deny(requester *Participant, id string) error {
+	if requester == nil || requester.Role != RoleHost {
+		return ErrNotHost
+	}
+	if err := p.answer(id, false); err != nil {
+		return err
+	}
+	p.sendHosts("knock-ended", id)
+	return nil
+}
+
+// answer takes the participant out of the lobby with the decision of the host
+func (p *Peers) answer(id string, admitted bool) error {
+	p.lobby.lock.Lock()
+	defer p.lobby.lock.Unlock()
+	for i, k := range p.lobby.waiting {
+		if k.participant.ID == id {
+			p.lobby.waiting = append(p.lobby.waiting[:i], p.lobby.waiting[i+1:]...)
+			k.decision <- admitted
+			return nil
+		}
+	}
+	return ErrNotWaiting
+}
+
+// SetLobby turns the lobby of the room on or off, turning it off lets everyone waiting in
+func (p *Peers) SetLobby(requester *Participant, enabled bool) error {
+	if requester == nil || requester.Role != RoleHost {
+		return ErrNotHost
+	}
+
+	p.lobby.lock.Lock()
+	p.lobby.enabled = enabled
+	waiting := p.lobby.waiting
+	if !enabled {
+		p.lobby.waiting = nil
+		for _, k := range waiting {
+			k.decision <- true
+		}
+	}
+	p.lobby.lock.Unlock()
+
+	if !enabled {
+		for _, k := range waiting {
+			p.sendHosts("knock-ended", k.participant.ID)
+		}
+	}
+	p.broadcast("lobby", enabled, nil)
+	return nil
+}
+
+// Lobby checks if the room holds new participants in a lobby
+func (p *Peers) Lobby() bool {
+	p.lobby.lock.Lock()
+	defer p.lobby.lock.Unlock()
+	return p.lobby.enabled
+}
+
+// Knocking lists the participants waiting in the lobby
+func (p *Peers) Knocking() []*Participant {
+	p.lobby.lock.Lock()
+	defer p.lobby.lock.Unlock()
+	participants := []*Participant{}
+	for _, k := range p.lobby.waiting {
+		participants = append(participants, k.participant)
+	}
+	return participants
+}
+
+// closeLobby turns away everyone waiting once the room is closed
+func (p *Peers) closeLobby() {
+	p.lobby.lock.Lock()
+	defer p.lobby.lock.Unlock()
+	p.lobby.closed = true
+	for _, k := range p.lobby.waiting {
+		k.decision <- false
+	}
+	p.lobby.waiting = nil
+}
+
+// sendHosts sends an event to the hosts of the room
+func (p *Peers) sendHosts(event string, v interface{}) {
+	p.send(event, v, func(connection PeerConnectionState) bool {
+		return connection.Participant != nil && connection.Participant.Role == RoleHost
+	})
+}
+
+// readMessages reads the websocket on its own goroutine so that it can be watched while waiting for something else,
+// the channel is closed once the websocket is, stop closes the websocket and waits for the goroutine to be done
+func readMessages(c *websocket.Conn) (messages <-chan []byte, stop func()) {
+	read := make(chan []byte)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer close(read)
+		for {
+			_, raw, err := c.ReadMessage()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			select {
+			case read <- raw:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return read, func() {
+		close(done)
+		c.Close()
+		<-stopped
+	}
+}
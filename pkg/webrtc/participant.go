@@ -0,0 +1,241 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"videochat/pkg/chat"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+const maxDisplayNameLength = 64
+
+// Role is what a participant is allowed to do in the room
+type Role string
+
+const (
+	// hosts run the meeting (and moderate the chat)
+	RoleHost  Role = "host"
+	RoleGuest Role = "guest"
+)
+
+// Participant is the person behind a peer connection of the room
+type Participant struct {
+	ID          string
+	DisplayName string
+	Role        Role
+	JoinedAt    time.Time
+
+	lock sync.Mutex
+	// the ids of the tracks the participant publishes, in the order they were published
+	tracks []string
+	// set when a host muted the participant, their audio isn't forwarded until they unmute
+	muted bool
+	// set when a host asked the participant to unmute
+	unmuteAllowed bool
+}
+
+type participantJSON struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"displayName"`
+	Role        Role      `json:"role"`
+	JoinedAt    time.Time `json:"joinedAt"`
+	Tracks      []string  `json:"tracks"`
+	Muted       bool      `json:"muted"`
+}
+
+// NewParticipant gives the participant its id, along with a display name if it didn't pick one
+func NewParticipant(displayName string, role Role) *Participant {
+	id := guuid.New().String()
+	displayName = strings.TrimSpace(displayName)
+	if displayName == "" {
+		displayName = "Guest " + id[:4]
+	}
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		displayName = string([]rune(displayName)[:maxDisplayNameLength])
+	}
+	return &Participant{
+		ID:          id,
+		DisplayName: displayName,
+		Role:        role,
+		JoinedAt:    time.Now(),
+		tracks:      []string{},
+	}
+}
+
+// Tracks returns the ids of the tracks the participant publishes
+func (pt *Participant) Tracks() []string {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	return append([]string{}, pt.tracks...)
+}
+
+func (pt *Participant) addTrack(id string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	for _, track := range pt.tracks {
+		if track == id {
+			return
+		}
+	}
+	pt.tracks = append(pt.tracks, id)
+}
+
+func (pt *Participant) removeTrack(id string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	for i, track := range pt.tracks {
+		if track == id {
+			pt.tracks = append(pt.tracks[:i], pt.tracks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Muted checks if a host muted the participant
+func (pt *Participant) Muted() bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	return pt.muted
+}
+
+func (pt *Participant) mute() {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.muted = true
+	pt.unmuteAllowed = false
+}
+
+func (pt *Participant) allowUnmute() {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.unmuteAllowed = true
+}
+
+func (pt *Participant) unmute() error {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if pt.muted && !pt.unmuteAllowed {
+		return ErrUnmuteNotAllowed
+	}
+	pt.muted = false
+	pt.unmuteAllowed = false
+	return nil
+}
+
+// ChatRole is the role the participant has in the chat of the room
+func (pt *Participant) ChatRole() chat.Role {
+	if pt.Role == RoleHost {
+		return chat.RoleModerator
+	}
+	return chat.RoleMember
+}
+
+func (pt *Participant) MarshalJSON() ([]byte, error) {
+	return json.Marshal(participantJSON{
+		ID:          pt.ID,
+		DisplayName: pt.DisplayName,
+		Role:        pt.Role,
+		JoinedAt:    pt.JoinedAt,
+		Tracks:      pt.Tracks(),
+		Muted:       pt.Muted(),
+	})
+}
+
+// offerMessage is an offer along with who the tracks in it belong to
+type offerMessage struct {
+	webrtc.SessionDescription
+	// the id of the participant publishing each track, keyed by the track id
+	Participants map[string]string `json:"participants"`
+}
+
+// roster is the snapshot of the room a participant gets when it joins
+type roster struct {
+	// the id of the participant the roster was sent to
+	Self         string         `json:"self"`
+	Participants []*Participant `json:"participants"`
+	// whether the room has a lobby, along with who is waiting in it (hosts only)
+	Lobby    bool           `json:"lobby"`
+	Knocking []*Participant `json:"knocking,omitempty"`
+}
+
+// Join adds the connection of a participant to the room, sends it the roster and lets everyone else know about it
+func (p *Peers) Join(state PeerConnectionState) {
+	p.ListLock.Lock()
+	state.Participant.Role = p.joinRole()
+	p.Connections = append(p.Connections, state)
+	snapshot := roster{Self: state.Participant.ID, Participants: p.participants()}
+	p.ListLock.Unlock()
+
+	snapshot.Lobby = p.Lobby()
+	if state.Participant.Role == RoleHost {
+		snapshot.Knocking = p.Knocking()
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := state.Websocket.WriteJSON(&websocketMessage{
+		Event: "participants",
+		Data:  string(data),
+	}); err != nil {
+		log.Println(err)
+	}
+
+	p.broadcast("participant-joined", state.Participant, state.PeerConnection)
+}
+
+// participants lists the participants in the room, the lock of the list has to be held
+func (p *Peers) participants() []*Participant {
+	participants := []*Participant{}
+	for _, connection := range p.Connections {
+		if connection.Participant != nil && connection.PeerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			participants = append(participants, connection.Participant)
+		}
+	}
+	return participants
+}
+
+// joinRole is the role of someone joining the room, the first one in becomes its host (and so does the next one once
+// every host is gone), the lock of the list has to be held
+func (p *Peers) joinRole() Role {
+	for _, connection := range p.Connections {
+		if connection.Participant != nil && connection.Participant.Role == RoleHost &&
+			connection.PeerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			return RoleGuest
+		}
+	}
+	return RoleHost
+}
+
+// publisherOf finds the participant behind the publishing peer connection, the lock of the list has to be held
+func (p *Peers) publisherOf(publisher *webrtc.PeerConnection) *Participant {
+	if publisher == nil {
+		return nil
+	}
+	for _, connection := range p.Connections {
+		if connection.PeerConnection == publisher {
+			return connection.Participant
+		}
+	}
+	return nil
+}
+
+// trackParticipants maps every track to the participant publishing it, the lock of the list has to be held
+func (p *Peers) trackParticipants() map[string]string {
+	participants := make(map[string]string)
+	for id, track := range p.TrackLocals {
+		if track.participant != nil {
+			participants[id] = track.participant.ID
+		}
+	}
+	return participants
+}
@@ -3,44 +3,39 @@ package webrtc
 import (
 	"encoding/json"
 	"log"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 	"videochat/pkg/chat"
 
 	"github.com/gofiber/websocket/v2"
-	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
-var (
-	RoomsLock sync.RWMutex
-	Rooms     map[string]*Room
-	Streams   map[string]*Room
-)
+type Room struct {
+	ID       string
+	StreamID string
+	Peers    *Peers
+	Hub      *chat.Hub
 
-// TODO figure out how to setup this config
-var (
-	turnConfig = webrtc.Configuration{
-		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-			{
-				URLs: []string{
-					"turn:relay.metered.ca:80",
-				},
-				Username:       "f656bb327ada11408d2cd592",
-				Credential:     "D5FTwyiln3XE0vFq",
-				CredentialType: webrtc.ICECredentialTypePassword,
-			},
-		},
-	}
-)
+	// where the room is in its lifecycle and when it was last used
+	lifecycleLock sync.Mutex
+	state         RoomState
+	lastActive    time.Time
 
-type Room struct {
-	Peers *Peers
-	Hub   *chat.Hub
+	// packages the room for HLS viewers, started on demand
+	hlsLock sync.Mutex
+	hls     *hlsSink
+
+	// records the participants of the room while it's running
+	recordingLock sync.Mutex
+	recording     *recorder
+
+	// pushes the room to RTMP destinations
+	restreamLock sync.Mutex
+	restream     *restreamSink
 }
 
 type Stream struct {
@@ -50,12 +45,30 @@ type Stream struct {
 type Peers struct {
 	ListLock    sync.Mutex
 	Connections []PeerConnectionState
-	TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+	TrackLocals map[string]*SimulcastTrack
+
+	// server side consumers of the published tracks
+	sinksLock sync.RWMutex
+	sinks     []TrackSink
+
+	// who is speaking, from the audio levels of the published tracks
+	speakers speakerDetector
+
+	// the participants waiting to be let in
+	lobby lobby
 }
 
 type PeerConnectionState struct {
 	PeerConnection *webrtc.PeerConnection
 	Websocket      *ThreadSafeWriter
+	// the simulcast layer this subscriber receives
+	Layers *SubscriberLayers
+	// the estimated downlink of this subscriber
+	Bandwidth *Bandwidth
+	// the participants this subscriber receives (everyone when nil)
+	Subscription *Subscription
+	// who is behind the connection (nil for viewers, like the ones watching the stream)
+	Participant *Participant
 }
 
 type ThreadSafeWriter struct {
@@ -74,41 +87,299 @@ func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
-func (p *Peers) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// broadcast sends an event to every peer with a websocket but the given one (the lock of the list must not be held)
+func (p *Peers) broadcast(event string, v interface{}, except *webrtc.PeerConnection) {
+	p.send(event, v, func(connection PeerConnectionState) bool {
+		return connection.PeerConnection != except
+	})
+}
+
+// send sends an event to the peers with a websocket that match the filter (the lock of the list must not be held)
+func (p *Peers) send(event string, v interface{}, filter func(PeerConnectionState) bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	p.ListLock.Lock()
+	connections := append([]PeerConnectionState{}, p.Connections...)
+	p.ListLock.Unlock()
+
+	for _, connection := range connections {
+		if connection.Websocket == nil || !filter(connection) {
+			continue
+		}
+		if err := connection.Websocket.WriteJSON(&websocketMessage{
+			Event: event,
+			Data:  string(data),
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (p *Peers) AddTrack(t *webrtc.TrackRemote, publisher *webrtc.PeerConnection) (*SimulcastTrack, *Layer) {
+	return p.addLayer(t.Codec().RTPCodecCapability, t.Kind(), t.ID(), t.StreamID(), t.RID(), t.SSRC(), publisher)
+}
+
+// PublishTrack adds a track that is published from the server side (like an RTMP ingest) rather than by a peer connection
+// NOTE key frames can't be requested from these tracks
+func (p *Peers) PublishTrack(codec webrtc.RTPCodecCapability, id, streamID string) (*SimulcastTrack, *Layer) {
+	kind := webrtc.RTPCodecTypeAudio
+	if strings.HasPrefix(codec.MimeType, "video/") {
+		kind = webrtc.RTPCodecTypeVideo
+	}
+	// the ssrc only marks the layer as live, the packets are written with whatever ssrc they have
+	return p.addLayer(codec, kind, id, streamID, "", webrtc.SSRC(rand.Uint32()), nil)
+}
+
+func (p *Peers) addLayer(codec webrtc.RTPCodecCapability, kind webrtc.RTPCodecType, id, streamID, rid string, ssrc webrtc.SSRC, publisher *webrtc.PeerConnection) (*SimulcastTrack, *Layer) {
+	// the participant publishing a new track, announced once the list is unlocked
+	var updated *Participant
+
 	// lock the list of tracks for this peer
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
+		if updated != nil {
+			p.broadcast("participant-updated", updated, nil)
+		}
 		p.SignalPeerConnections()
 	}()
 
-	// create a new track local (track used to send packets to another peer) and add it to the list of tracks
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-	if err != nil {
-		log.Println(err.Error())
-		return nil
+	// group the layers of the same published track together
+	track, ok := p.TrackLocals[id]
+	if !ok {
+		track = &SimulcastTrack{
+			ID:          id,
+			StreamID:    streamID,
+			Kind:        kind,
+			Codec:       codec,
+			Layers:      make(map[string]*Layer),
+			publisher:   publisher,
+			participant: p.publisherOf(publisher),
+			ssrcs:       make(map[string]webrtc.SSRC),
+			subscribers: make(map[*webrtc.RTPSender]*subscriberTrack),
+			reports:     make(map[string]SenderReport),
+		}
+		p.TrackLocals[id] = track
+		if track.participant != nil {
+			track.participant.addTrack(id)
+			updated = track.participant
+		}
 	}
-	p.TrackLocals[t.ID()] = trackLocal
-	return trackLocal
+	layer := &Layer{RID: rid}
+	track.Layers[rid] = layer
+	track.setSSRC(rid, ssrc)
+	return track, layer
 }
 
-func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
+// ForwardTrack fans the packets of a remote track (a single simulcast layer) out to the subscribers until the track ends
+func (p *Peers) ForwardTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, publisher *webrtc.PeerConnection) {
+	simulcastTrack, layer := p.AddTrack(track, publisher)
+	// keep up with the sender reports so the recordings can be synced
+	go readSenderReports(receiver, track, simulcastTrack)
+	defer p.UnpublishTrack(simulcastTrack, layer)
+
+	// the audio levels tell who is speaking
+	levelID := uint8(0)
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		levelID = audioLevelID(receiver)
+	}
+
+	// continuously read from the track and write to the subscribers until we run into an error
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		if levelID != 0 && !simulcastTrack.Muted() {
+			p.observeAudioLevel(simulcastTrack, levelID, packet)
+		}
+		p.WriteTrack(simulcastTrack, layer, packet)
+	}
+}
+
+// WriteTrack fans a packet of a layer out to the subscribers and the server side consumers (HLS, etc)
+func (p *Peers) WriteTrack(track *SimulcastTrack, layer *Layer, packet *rtp.Packet) {
+	// the audio of participants muted by a host isn't forwarded anywhere
+	if track.Muted() {
+		return
+	}
+
+	// subscribers waiting for this layer can only be switched over on a key frame
+	keyFrame := track.Kind == webrtc.RTPCodecTypeVideo && isKeyFrame(track.Codec.MimeType, packet.Payload)
+	track.forward(layer.RID, packet, keyFrame)
+
+	p.writeSinks(track, layer.RID, packet)
+}
+
+// UnpublishTrack removes a layer once its publisher is gone
+func (p *Peers) UnpublishTrack(track *SimulcastTrack, layer *Layer) {
+	p.RemoveTrack(track, layer)
+	// let the sinks know once the last layer of the track is gone
+	if !track.Live() {
+		p.endSinks(track)
+		if speaker, changed := p.speakers.remove(track); changed {
+			p.announceSpeaker(speaker)
+		}
+	}
+}
+
+func (p *Peers) RemoveTrack(t *SimulcastTrack, l *Layer) {
+	// the participant that stopped publishing the track, announced once the list is unlocked
+	var updated *Participant
+
 	// lock the list of tracks for this peer
+	p.ListLock.Lock()
+	defer func() {
+		p.ListLock.Unlock()
+		if updated != nil {
+			p.broadcast("participant-updated", updated, nil)
+		}
+		p.SignalPeerConnections()
+	}()
+
+	track, ok := p.TrackLocals[t.ID]
+	if !ok || track != t {
+		return
+	}
+
+	// remove the layer from the track
+	for rid, layer := range track.Layers {
+		if layer == l {
+			delete(track.Layers, rid)
+			track.removeSSRC(rid)
+		}
+	}
+
+	// remove the track from the list of tracks once all of its layers are gone
+	if len(track.Layers) == 0 {
+		delete(p.TrackLocals, t.ID)
+		if track.participant != nil {
+			track.participant.removeTrack(track.ID)
+			updated = track.participant
+		}
+	}
+}
+
+// subscribe adds the track to the peer connection, starting the subscriber off on the layer closest to the one it wants
+func subscribe(state PeerConnectionState, track *SimulcastTrack) error {
+	// every subscriber gets a track of its own, the layers are written to it in turn (see SimulcastTrack.forward)
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec, track.ID, track.StreamID)
+	if err != nil {
+		return err
+	}
+	sender, err := state.PeerConnection.AddTrack(local)
+	if err != nil {
+		return err
+	}
+	track.addSubscriber(sender, local, state.Layers, track.pickLayer(targetLayer(state, track)))
+	go readRTCP(sender, track, state)
+	return nil
+}
+
+// SetLayer changes the simulcast layer the subscriber on the given peer connection wants to receive
+func (p *Peers) SetLayer(pc *webrtc.PeerConnection, rid string) {
+	if layerRank(rid) == len(simulcastLayers) {
+		log.Printf("unknown simulcast layer %q", rid)
+		return
+	}
+
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	for i := range p.Connections {
+		if p.Connections[i].PeerConnection != pc {
+			continue
+		}
+		p.Connections[i].Layers.SetTarget(rid)
+
+		// move every video sender of this subscriber over to the new layer
+		for _, sender := range pc.GetSenders() {
+			if sender.Track() == nil {
+				continue
+			}
+			if track, ok := p.TrackLocals[sender.Track().ID()]; ok {
+				syncLayer(track, sender, p.Connections[i])
+			}
+		}
+	}
+}
+
+// syncLayer schedules a switch if the sender isn't on the best layer for its subscriber
+func syncLayer(track *SimulcastTrack, sender *webrtc.RTPSender, state PeerConnectionState) {
+	layers := state.Layers
+	current, ok := layers.Current(track.ID)
+
+	// stop sending video to subscribers that can't keep up with any layer
+	if track.Kind == webrtc.RTPCodecTypeVideo && layers.Paused() {
+		if current != pausedLayer {
+			track.pause(sender)
+		}
+		return
+	}
+
+	rid := track.pickLayer(targetLayer(state, track))
+	if ok && current == rid {
+		track.cancelSwitch(sender)
+		return
+	}
+	track.requestSwitch(sender, rid)
+}
+
+// Answer handles an offer sent by a client (clients publishing simulcast have to be the offerer)
+func (p *Peers) Answer(pc *webrtc.PeerConnection, ws *ThreadSafeWriter, offer webrtc.SessionDescription) error {
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
 		p.SignalPeerConnections()
 	}()
 
-	// remove the track from the list of tracks
-	delete(p.TrackLocals, t.ID())
+	// drop our own pending offer if the client beat us to it, it gets recreated once we are stable again
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return err
+		}
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	preferH264(pc)
+
+	// create the answer and send it back over the websocket
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	answerString, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return ws.WriteJSON(websocketMessage{
+		Event: "answer",
+		Data:  string(answerString),
+	})
 }
 
 func (p *Peers) SignalPeerConnections() {
+	// the participants of the closed connections, announced once the list is unlocked
+	left := []*Participant{}
+
 	// lock the list of tracks for this peer
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
+		for _, participant := range left {
+			p.broadcast("participant-left", participant, nil)
+		}
 		p.DispatchKeyFrame()
 	}()
 
@@ -118,6 +389,15 @@ func (p *Peers) SignalPeerConnections() {
 			// check if this connection was closed
 			if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
 				// remove the connection from the connections list
+				if p.Connections[i].Participant != nil {
+					left = append(left, p.Connections[i].Participant)
+				}
+				// stop forwarding to its senders
+				for _, sender := range p.Connections[i].PeerConnection.GetSenders() {
+					for _, track := range p.TrackLocals {
+						track.removeSubscriber(sender)
+					}
+				}
 				p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
 				return true
 			}
@@ -131,12 +411,21 @@ func (p *Peers) SignalPeerConnections() {
 				// add this sender track to the list of existing senders
 				existingSenders[sender.Track().ID()] = true
 
-				if _, ok := p.TrackLocals[sender.Track().ID()]; !ok {
-					// remove the sender track from the peer connection (only if it doesn't exist in the list of tracks)
+				track, ok := p.TrackLocals[sender.Track().ID()]
+				if !ok || !p.Connections[i].Subscription.Wants(track) {
+					// remove the sender track from the peer connection (only if it doesn't exist in the list of tracks or the subscriber doesn't want it anymore)
+					if ok {
+						track.removeSubscriber(sender)
+					}
+					p.Connections[i].Layers.forget(sender.Track().ID())
 					if err := p.Connections[i].PeerConnection.RemoveTrack(sender); err != nil {
 						return true
 					}
+					continue
 				}
+
+				// keep the sender on the best layer for this subscriber (layers come and go as the publisher adapts)
+				syncLayer(track, sender, p.Connections[i])
 			}
 
 			// parse all the reciever tracks for each peer connection
@@ -149,11 +438,16 @@ func (p *Peers) SignalPeerConnections() {
 				existingSenders[reciever.Track().ID()] = true
 			}
 
+			// connections without a websocket (like WHEP viewers) can't be renegotiated, they keep the tracks they started with
+			if p.Connections[i].Websocket == nil {
+				continue
+			}
+
 			// parse all the tracks for this peer connection
-			for trackID := range p.TrackLocals {
-				// try to add this track local to the list of existing senders if it's not already there
-				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := p.Connections[i].PeerConnection.AddTrack(p.TrackLocals[trackID]); err != nil {
+			for trackID, track := range p.TrackLocals {
+				// try to add this track local to the list of existing senders if it's not already there (and the subscriber wants it)
+				if _, ok := existingSenders[trackID]; !ok && p.Connections[i].Subscription.Wants(track) {
+					if err := subscribe(p.Connections[i], track); err != nil {
 						return true
 					}
 				}
@@ -170,8 +464,11 @@ func (p *Peers) SignalPeerConnections() {
 				return true
 			}
 
-			// encode the offer information for each peer connection
-			offerString, err := json.Marshal(offer)
+			// encode the offer information for each peer connection (along with who the tracks belong to)
+			offerString, err := json.Marshal(offerMessage{
+				SessionDescription: offer,
+				Participants:       p.trackParticipants(),
+			})
 			if err != nil {
 				return true
 			}
@@ -209,19 +506,11 @@ func (p *Peers) DispatchKeyFrame() {
 	p.ListLock.Lock()
 	defer p.ListLock.Unlock()
 
-	// write a key frame to each peer connection's reciever tracks
-	for i := range p.Connections {
-		for _, receiver := range p.Connections[i].PeerConnection.GetReceivers() {
-			if receiver.Track() == nil {
-				continue
-			}
-
-			// writing each RTCP packet to the peer connection's reciever tracks
-			_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
-				},
-			})
+	// request a key frame for every layer of every published track
+	// NOTE this goes through the tracks rather than the connections since publishers (like WHIP) don't have to be in the list of connections
+	for _, track := range p.TrackLocals {
+		for rid := range track.Layers {
+			track.requestKeyFrame(rid)
 		}
 	}
 }
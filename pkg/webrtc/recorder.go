@@ -0,0 +1,473 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"videochat/pkg/composite"
+	"videochat/pkg/webm"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// RecordingsDir is where the room recordings are written
+var RecordingsDir = "recordings"
+
+var (
+	ErrRecording    = errors.New("the room is already being recorded")
+	ErrNotRecording = errors.New("the room isn't being recorded")
+)
+
+const (
+	// how long we wait for the video of a participant before recording it as audio only
+	recordingVideoWait = time.Second
+	// how many packets we hold on to while waiting for the video of a participant
+	maxHeldPackets = 256
+	// how many packets the sample builders hold on to while waiting for late packets
+	recordingMaxLate = 256
+)
+
+// the video codecs that can be recorded and the codec ids they get in the file
+var recordingCodecs = map[string]string{
+	webrtc.MimeTypeVP8:  webm.CodecVP8,
+	webrtc.MimeTypeVP9:  webm.CodecVP9,
+	webrtc.MimeTypeH264: webm.CodecH264,
+}
+
+// recorder writes the tracks of every participant of a room into a file per participant
+// (VP8/VP9 and Opus into WebM, H.264 and Opus into Matroska, Opus only into Ogg)
+type recorder struct {
+	peers *Peers
+	// the file names start with the room uuid and the time the recording started
+	name    string
+	start   time.Time
+	packets chan recorderPacket
+	done    chan struct{}
+
+	// only touched by the run goroutine (files and manifest can be read once it's done)
+	participants map[string]*participantRecording
+	files        []string
+	manifest     *composite.Manifest
+}
+
+type recorderPacket struct {
+	track   *SimulcastTrack
+	rid     string
+	packet  *rtp.Packet
+	arrival time.Time
+	// set when the track went away
+	ended bool
+}
+
+// participantRecording is the file of a single participant, the tracks of a participant share a stream id
+type participantRecording struct {
+	index     int
+	firstSeen time.Time
+	// packets that arrived before we knew which container to use
+	held []recorderPacket
+
+	opened bool
+	path   string
+	file   *os.File
+	webm   *webm.Writer
+	ogg    *oggwriter.OggWriter
+	// the mime type of the video track that goes into the WebM (or Matroska) file
+	videoCodec string
+	video      *recordedTrack
+	audio      *recordedTrack
+	// the tracks that were left out of the file, so it's only logged once
+	dropped map[string]bool
+
+	// the timing of the first frame of each kind, used to line up the files afterwards
+	videoSync *composite.Track
+	audioSync *composite.Track
+}
+
+// recordedTrack turns the packets of a single layer into timestamped frames
+type recordedTrack struct {
+	track   *SimulcastTrack
+	id      string
+	rid     string
+	builder *samplebuilder.SampleBuilder
+	// filled in with the first frame of the track
+	sync *composite.Track
+
+	clockRate uint32
+	started   bool
+	base      time.Duration
+	lastTS    uint32
+	unwrapped uint64
+}
+
+func newRecorder(p *Peers, name string) *recorder {
+	r := &recorder{
+		peers:        p,
+		name:         name,
+		start:        time.Now(),
+		packets:      make(chan recorderPacket, 1024),
+		done:         make(chan struct{}),
+		participants: make(map[string]*participantRecording),
+	}
+	go r.run()
+	return r
+}
+
+// run does the writing off the forwarding loop until the packets channel is closed
+func (r *recorder) run() {
+	for p := range r.packets {
+		r.handle(p)
+	}
+	r.manifest = &composite.Manifest{Name: r.name, Start: r.start}
+	for _, participant := range r.participants {
+		participant.close()
+		if entry, ok := participant.entry(); ok {
+			r.manifest.Participants = append(r.manifest.Participants, entry)
+		}
+	}
+	close(r.done)
+}
+
+func (r *recorder) WriteRTP(track *SimulcastTrack, rid string, packet *rtp.Packet) {
+	// only the best layer of the video gets recorded
+	if rid != track.BestLayer() {
+		return
+	}
+
+	// drop the packet rather than hold up the forwarding loop if the disk is falling behind
+	select {
+	case r.packets <- recorderPacket{track: track, rid: rid, packet: packet, arrival: time.Now()}:
+	default:
+	}
+}
+
+func (r *recorder) TrackEnded(track *SimulcastTrack) {
+	r.packets <- recorderPacket{track: track, ended: true}
+}
+
+func (r *recorder) handle(p recorderPacket) {
+	participant, ok := r.participants[p.track.StreamID]
+	if !ok {
+		if p.ended {
+			return
+		}
+		participant = &participantRecording{index: len(r.participants) + 1, firstSeen: p.arrival, dropped: make(map[string]bool)}
+		r.participants[p.track.StreamID] = participant
+	}
+
+	if p.ended {
+		participant.trackEnded(p.track.ID)
+		return
+	}
+
+	if !participant.opened {
+		// a VP8/VP9/H.264 track makes it a WebM (or Matroska) file, otherwise we give the video some time to show up before going with Ogg
+		videoCodec := recordableVideo(p.track)
+		if videoCodec == "" && p.arrival.Sub(participant.firstSeen) < recordingVideoWait && len(participant.held) < maxHeldPackets {
+			participant.held = append(participant.held, p)
+			return
+		}
+		if err := r.open(participant, videoCodec); err != nil {
+			log.Println(err)
+		}
+
+		held := participant.held
+		participant.held = nil
+		for _, h := range held {
+			participant.write(r.start, h)
+		}
+		if videoCodec != "" {
+			// the video can only start on a key frame
+			p.track.requestKeyFrame(p.rid)
+		}
+	}
+	participant.write(r.start, p)
+}
+
+func (r *recorder) open(participant *participantRecording, videoCodec string) error {
+	participant.opened = true
+
+	if videoCodec == "" {
+		path := filepath.Join(RecordingsDir, fmt.Sprintf("%s-%d.ogg", r.name, participant.index))
+		ogg, err := oggwriter.New(path, 48000, 2)
+		if err != nil {
+			return err
+		}
+		participant.ogg = ogg
+		participant.path = path
+		r.files = append(r.files, path)
+		return nil
+	}
+
+	codec := recordingCodecs[videoCodec]
+	extension := "webm"
+	if codec == webm.CodecH264 {
+		extension = "mkv"
+	}
+	path := filepath.Join(RecordingsDir, fmt.Sprintf("%s-%d.%s", r.name, participant.index, extension))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	participant.file = file
+	participant.webm = webm.NewWriter(file, codec)
+	participant.videoCodec = videoCodec
+	participant.path = path
+	r.files = append(r.files, path)
+	return nil
+}
+
+// recordableVideo returns the mime type of a video track that can be recorded
+func recordableVideo(track *SimulcastTrack) string {
+	if track.Kind != webrtc.RTPCodecTypeVideo {
+		return ""
+	}
+	if _, ok := recordingCodecs[track.Codec.MimeType]; !ok {
+		return ""
+	}
+	return track.Codec.MimeType
+}
+
+func (p *participantRecording) write(start time.Time, packet recorderPacket) {
+	track := packet.track
+	switch {
+	// only Opus can be recorded
+	case track.Kind == webrtc.RTPCodecTypeAudio && track.Codec.MimeType == webrtc.MimeTypeOpus:
+		if p.audio == nil {
+			p.audio = newRecordedTrack(track, packet.rid, p.syncFor(&p.audioSync))
+		}
+		if p.audio.id != track.ID {
+			return
+		}
+
+		var err error
+		if p.ogg != nil {
+			// the Ogg writer does its own depacketizing, the file starts with the first packet
+			p.audio.observe(start, packet, packet.packet.Timestamp)
+			err = p.ogg.WriteRTP(packet.packet)
+		} else if p.webm != nil {
+			err = p.audio.push(start, packet, p.webm.WriteAudio)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+	case track.Kind == webrtc.RTPCodecTypeVideo && p.webm != nil && track.Codec.MimeType == p.videoCodec:
+		if p.video == nil {
+			p.video = newRecordedTrack(track, packet.rid, p.syncFor(&p.videoSync))
+		}
+		if p.video.id != track.ID {
+			return
+		}
+		// the best layer changed, start over on a key frame of the new layer
+		if p.video.rid != packet.rid {
+			p.video = newRecordedTrack(track, packet.rid, nil)
+			p.webm.ResetVideo()
+			track.requestKeyFrame(packet.rid)
+		}
+
+		if err := p.video.push(start, packet, p.webm.WriteVideo); err != nil {
+			log.Println(err)
+		}
+
+	// the codec can't be recorded, or the video showed up after the file was opened as audio only
+	default:
+		if !p.dropped[track.ID] {
+			p.dropped[track.ID] = true
+			log.Printf("%s track %s can't be recorded into %s, it's left out", track.Codec.MimeType, track.ID, p.path)
+		}
+	}
+}
+
+// syncFor returns the sync record the next track of a kind should fill in, only the first track of each kind gets one
+func (p *participantRecording) syncFor(sync **composite.Track) *composite.Track {
+	if *sync != nil {
+		return nil
+	}
+	*sync = &composite.Track{}
+	return *sync
+}
+
+// trackEnded frees up the slot of the track so another track of the participant can take its place
+func (p *participantRecording) trackEnded(id string) {
+	delete(p.dropped, id)
+	if p.audio != nil && p.audio.id == id {
+		p.audio = nil
+	}
+	if p.video != nil && p.video.id == id {
+		p.video = nil
+		if p.webm != nil {
+			p.webm.ResetVideo()
+		}
+	}
+}
+
+func (p *participantRecording) close() {
+	if p.ogg != nil {
+		if err := p.ogg.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if p.file != nil {
+		if err := p.file.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// entry describes the file of the participant for the composite, it's false when no track made it into the file
+func (p *participantRecording) entry() (composite.Participant, bool) {
+	entry := composite.Participant{File: p.path}
+	if p.webm != nil {
+		if start, ok := p.webm.VideoStart(); ok && p.videoSync != nil {
+			p.videoSync.FileStart = start
+			entry.Video = p.videoSync
+		}
+		if start, ok := p.webm.AudioStart(); ok && p.audioSync != nil {
+			p.audioSync.FileStart = start
+			entry.Audio = p.audioSync
+		}
+	}
+	// the Ogg file starts with the first packet
+	if p.ogg != nil && p.audioSync != nil && p.audioSync.ClockRate != 0 {
+		p.audioSync.FileStart = p.audioSync.Start
+		entry.Audio = p.audioSync
+	}
+	return entry, entry.Video != nil || entry.Audio != nil
+}
+
+func newRecordedTrack(track *SimulcastTrack, rid string, sync *composite.Track) *recordedTrack {
+	var depacketizer rtp.Depacketizer
+	switch track.Codec.MimeType {
+	case webrtc.MimeTypeVP8:
+		depacketizer = &codecs.VP8Packet{}
+	case webrtc.MimeTypeVP9:
+		depacketizer = &codecs.VP9Packet{}
+	case webrtc.MimeTypeH264:
+		depacketizer = &codecs.H264Packet{IsAVC: true}
+	default:
+		depacketizer = &codecs.OpusPacket{}
+	}
+
+	return &recordedTrack{
+		track:     track,
+		id:        track.ID,
+		rid:       rid,
+		builder:   samplebuilder.New(recordingMaxLate, depacketizer, track.Codec.ClockRate),
+		sync:      sync,
+		clockRate: track.Codec.ClockRate,
+	}
+}
+
+// observe starts the timeline of the track with its first frame, and keeps the sync record up to date
+func (t *recordedTrack) observe(start time.Time, p recorderPacket, timestamp uint32) {
+	if !t.started {
+		// line the tracks up by when their first frame arrived since their RTP timestamps are unrelated
+		t.started = true
+		t.base = p.arrival.Sub(start)
+		t.lastTS = timestamp
+		if t.sync != nil {
+			t.sync.ClockRate = t.clockRate
+			t.sync.FirstTimestamp = timestamp
+			t.sync.Start = t.base
+		}
+	}
+
+	// publishers send their first sender report a little while after their first packets
+	if t.sync != nil && t.sync.Report == nil {
+		if report, ok := t.track.SenderReport(t.rid); ok {
+			t.sync.Report = &composite.SenderReport{
+				NTPTime: report.NTPTime,
+				RTPTime: report.RTPTime,
+				Arrival: report.Arrival,
+			}
+		}
+	}
+}
+
+// push adds a packet and writes out the frames it completes with their time since the recording started
+func (t *recordedTrack) push(start time.Time, p recorderPacket, write func([]byte, time.Duration) error) error {
+	t.builder.Push(p.packet)
+	for s := t.builder.Pop(); s != nil; s = t.builder.Pop() {
+		t.observe(start, p, s.PacketTimestamp)
+
+		// unwrap the 32 bit RTP timestamps
+		t.unwrapped += uint64(s.PacketTimestamp - t.lastTS)
+		t.lastTS = s.PacketTimestamp
+
+		timestamp := t.base + time.Duration(t.unwrapped)*time.Second/time.Duration(t.clockRate)
+		if err := write(s.Data, timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRecording starts writing a file for every participant of the room, it returns the name the files start with
+func (r *Room) StartRecording(uuid string) (string, error) {
+	r.recordingLock.Lock()
+	defer r.recordingLock.Unlock()
+
+	if r.recording != nil {
+		return "", ErrRecording
+	}
+	if err := os.MkdirAll(RecordingsDir, 0o755); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s", uuid, time.Now().UTC().Format("20060102T150405Z"))
+	r.recording = newRecorder(r.Peers, name)
+	r.Peers.AddSink(r.recording)
+	// get the recorder a key frame of every video so the files can start right away
+	r.Peers.DispatchKeyFrame()
+	return name, nil
+}
+
+// StopRecording finishes the files of the recording and returns their paths, along with the path of the composite
+// that gets rendered out of them in the background ("" when there is nothing to render)
+func (r *Room) StopRecording() ([]string, string, error) {
+	r.recordingLock.Lock()
+	defer r.recordingLock.Unlock()
+
+	if r.recording == nil {
+		return nil, "", ErrNotRecording
+	}
+
+	// once the sink is removed nothing writes to the packets channel anymore
+	r.Peers.RemoveSink(r.recording)
+	close(r.recording.packets)
+	<-r.recording.done
+
+	files := r.recording.files
+	manifest := r.recording.manifest
+	r.recording = nil
+
+	if len(manifest.Participants) == 0 {
+		return files, "", nil
+	}
+	// keep the manifest next to the files so the composite can be rendered again later
+	if err := manifest.Save(filepath.Join(RecordingsDir, manifest.Name+".json")); err != nil {
+		log.Println(err)
+	}
+	output := filepath.Join(RecordingsDir, manifest.Name+"-composite.webm")
+	go func() {
+		if err := composite.Compose(manifest, output); err != nil {
+			log.Println(err)
+		}
+	}()
+	return files, output, nil
+}
+
+// Recording checks if the room is being recorded
+func (r *Room) Recording() bool {
+	r.recordingLock.Lock()
+	defer r.recordingLock.Unlock()
+	return r.recording != nil
+}
@@ -0,0 +1,125 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrRoomNotFound = errors.New("room not found")
+
+// RoomRegistry keeps track of the rooms that are open
+type RoomRegistry interface {
+	// Create returns the room with the id, creating it if it isn't open yet
+	Create(id string) *Room
+	Get(id string) (*Room, bool)
+	// GetByStreamID looks a room up by the id of its stream
+	GetByStreamID(streamID string) (*Room, bool)
+	List() []*Room
+	// Close takes the room out of the registry and tears it down
+	Close(id string) error
+	// CloseIdle closes the rooms that have been idle for longer than the idle timeout, it returns their ids
+	CloseIdle() []string
+}
+
+// StreamID returns the id of the stream of a room, it's a hash so the stream link can't be used to join the room
+func StreamID(id string) string {
+	h := sha256.New()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// MemoryRegistry is a RoomRegistry for a single server
+type MemoryRegistry struct {
+	lock    sync.RWMutex
+	rooms   map[string]*Room
+	streams map[string]*Room
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		rooms:   make(map[string]*Room),
+		streams: make(map[string]*Room),
+	}
+}
+
+func (m *MemoryRegistry) Create(id string) *Room {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if room, ok := m.rooms[id]; ok {
+		// hold off the idle timeout until whoever asked for the room connects
+		room.Touch()
+		return room
+	}
+	room := NewRoom(id)
+	m.rooms[id] = room
+	m.streams[room.StreamID] = room
+	return room
+}
+
+func (m *MemoryRegistry) Get(id string) (*Room, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	room, ok := m.rooms[id]
+	return room, ok
+}
+
+func (m *MemoryRegistry) GetByStreamID(streamID string) (*Room, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	room, ok := m.streams[streamID]
+	return room, ok
+}
+
+func (m *MemoryRegistry) List() []*Room {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (m *MemoryRegistry) Close(id string) error {
+	m.lock.Lock()
+	room, ok := m.rooms[id]
+	if ok {
+		// take the room out first so nobody can join it while it's torn down
+		delete(m.rooms, id)
+		delete(m.streams, room.StreamID)
+	}
+	m.lock.Unlock()
+
+	if !ok {
+		return ErrRoomNotFound
+	}
+	room.Close()
+	return nil
+}
+
+func (m *MemoryRegistry) CloseIdle() []string {
+	// the rooms are checked while the registry is locked, so a room can't be handed to someone joining it between
+	// the check and taking it out
+	m.lock.Lock()
+	idle := []*Room{}
+	for id, room := range m.rooms {
+		if !room.Update() {
+			continue
+		}
+		delete(m.rooms, id)
+		delete(m.streams, room.StreamID)
+		idle = append(idle, room)
+	}
+	m.lock.Unlock()
+
+	ids := make([]string, 0, len(idle))
+	for _, room := range idle {
+		room.Close()
+		ids = append(ids, room.ID)
+	}
+	return ids
+}
@@ -0,0 +1,59 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRegistryCloseIdle(t *testing.T) {
+	defer func(timeout time.Duration) { RoomIdleTimeout = timeout }(RoomIdleTimeout)
+	RoomIdleTimeout = 0
+
+	rooms := NewMemoryRegistry()
+	idle := rooms.Create("idle")
+	busy := rooms.Create("busy")
+	// a published track keeps the room occupied
+	busy.Peers.TrackLocals["track"] = &SimulcastTrack{ID: "track"}
+
+	closed := rooms.CloseIdle()
+	if len(closed) != 1 || closed[0] != "idle" {
+		t.Fatalf("closed %v, want [idle]", closed)
+	}
+	if idle.State() != RoomClosed {
+		t.Errorf("idle room is %v, want closed", idle.State())
+	}
+	if _, ok := rooms.Get("idle"); ok {
+		t.Error("idle room is still in the registry")
+	}
+	if _, ok := rooms.GetByStreamID(idle.StreamID); ok {
+		t.Error("idle room can still be found by its stream id")
+	}
+	if room, ok := rooms.Get("busy"); !ok || room.State() != RoomActive {
+		t.Error("busy room was closed")
+	}
+
+	// asking for the room again after it was closed opens a new one
+	if room := rooms.Create("idle"); room == idle || room.State() == RoomClosed {
+		t.Error("closed room was handed out again")
+	}
+
+	delete(busy.Peers.TrackLocals, "track")
+	rooms.CloseIdle()
+	if _, ok := rooms.Get("busy"); ok {
+		t.Error("room is still open once it's idle")
+	}
+}
+
+func TestMemoryRegistryCloseIdleKeepsTouchedRooms(t *testing.T) {
+	defer func(timeout time.Duration) { RoomIdleTimeout = timeout }(RoomIdleTimeout)
+	RoomIdleTimeout = time.Hour
+
+	rooms := NewMemoryRegistry()
+	rooms.Create("room")
+	if closed := rooms.CloseIdle(); len(closed) != 0 {
+		t.Fatalf("closed %v before the idle timeout", closed)
+	}
+	if _, ok := rooms.Get("room"); !ok {
+		t.Error("room was taken out of the registry")
+	}
+}
@@ -0,0 +1,475 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"videochat/pkg/rtmp"
+	"videochat/pkg/transcode"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+var (
+	ErrRestreamNotFound   = errors.New("restream not found")
+	ErrRestreamNotAllowed = errors.New("restreaming is only allowed to rtmp(s) urls on the allowed hosts")
+)
+
+// RestreamHosts are the hosts rooms can be restreamed to, "*.example.com" allows every subdomain
+// NOTE nothing can be restreamed while it's empty, otherwise anyone with a room link could get the server to connect
+// wherever they want (like internal addresses)
+var RestreamHosts = []string{}
+
+// how many tags a destination can fall behind before it starts losing them
+const restreamBuffer = 512
+
+// Restream is an RTMP destination the room is being pushed to
+type Restream struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// restreamSink remuxes the best layer of one H.264 and one Opus track of the room (transcoded to AAC) into FLV tags
+// and pushes them to every destination
+// NOTE like HLS only H.264 video can be restreamed, other codecs would need transcoding
+type restreamSink struct {
+	start   time.Time
+	packets chan sinkPacket
+
+	lock sync.Mutex
+	// the ids of the tracks being restreamed
+	video string
+	audio string
+	// the sequence headers new destinations have to start with
+	videoHeader []byte
+	audioHeader []byte
+	targets     []*restreamTarget
+
+	// when the first audio packet arrived
+	audioBase time.Duration
+	audioSet  bool
+
+	// only touched by the run goroutine
+	// the Opus gets transcoded by ffmpeg, which is only started once there is audio
+	encoder    *transcode.OpusToAAC
+	encoderErr error
+	builder    *samplebuilder.SampleBuilder
+	avc        rtmp.AVCConfig
+	timeline   restreamTimeline
+}
+
+// restreamTimeline turns RTP timestamps into FLV timestamps (milliseconds since the restream started)
+type restreamTimeline struct {
+	started   bool
+	base      time.Duration
+	lastTS    uint32
+	unwrapped uint64
+}
+
+type restreamTarget struct {
+	Restream
+	client *rtmp.Client
+	tags   chan flvTag
+	// destinations start on a key frame (only touched with the sink lock held)
+	waitKeyFrame bool
+}
+
+type flvTag struct {
+	video     bool
+	keyFrame  bool
+	timestamp uint32
+	payload   []byte
+}
+
+func newRestreamSink() *restreamSink {
+	s := &restreamSink{
+		start:   time.Now(),
+		packets: make(chan sinkPacket, 512),
+	}
+	s.resetVideo()
+	go s.run()
+	return s
+}
+
+func (s *restreamSink) resetVideo() {
+	s.builder = samplebuilder.New(256, &codecs.H264Packet{IsAVC: true}, 90000)
+	s.avc = rtmp.AVCConfig{NALULength: 4}
+	s.timeline = restreamTimeline{}
+}
+
+// run does the remuxing off the forwarding loop
+func (s *restreamSink) run() {
+	defer func() {
+		if s.encoder == nil {
+			return
+		}
+		if err := s.encoder.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	for p := range s.packets {
+		switch {
+		case p.kind == webrtc.RTPCodecTypeVideo && p.reset:
+			s.resetVideo()
+		case p.kind == webrtc.RTPCodecTypeVideo:
+			s.builder.Push(p.packet)
+			for sample := s.builder.Pop(); sample != nil; sample = s.builder.Pop() {
+				s.writeVideo(sample.Data, sample.PacketTimestamp)
+			}
+		case p.kind == webrtc.RTPCodecTypeAudio && !p.reset:
+			s.lock.Lock()
+			if !s.audioSet {
+				s.audioBase, s.audioSet = time.Since(s.start), true
+			}
+			s.lock.Unlock()
+			if s.encoder == nil && s.encoderErr == nil {
+				if s.encoder, s.encoderErr = transcode.NewOpusToAAC(); s.encoderErr != nil {
+					// restream the video without audio rather than try again on every packet
+					log.Println(s.encoderErr)
+					continue
+				}
+				go s.runAudio(s.encoder)
+			}
+			if s.encoder == nil {
+				continue
+			}
+			if err := s.encoder.WriteRTP(p.packet); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (s *restreamSink) writeVideo(frame []byte, rtpTimestamp uint32) {
+	// pull the parameter sets out of the frame, they go into the sequence header instead
+	keyFrame := false
+	nalus := [][]byte{}
+	sps, pps := s.avc.SPS, s.avc.PPS
+	for _, nalu := range s.avc.SplitNALUs(frame) {
+		switch nalu[0] & 0x1F {
+		case rtmp.NALUTypeSPS:
+			sps = [][]byte{nalu}
+		case rtmp.NALUTypePPS:
+			pps = [][]byte{nalu}
+		case rtmp.NALUTypeAUD:
+		case rtmp.NALUTypeIDR:
+			keyFrame = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	timestamp := s.timeline.timestamp(s.start, rtpTimestamp)
+	if len(sps) > 0 && len(pps) > 0 && (!equalSets(sps, s.avc.SPS) || !equalSets(pps, s.avc.PPS)) {
+		s.avc.SPS, s.avc.PPS = sps, pps
+		header := rtmp.VideoTag{KeyFrame: true, CodecID: rtmp.CodecAVC, PacketType: rtmp.PacketSequenceHeader, Data: s.avc.Marshal()}
+		s.lock.Lock()
+		s.videoHeader = header.Marshal()
+		s.lock.Unlock()
+		s.send(flvTag{video: true, keyFrame: true, timestamp: timestamp, payload: s.videoHeader})
+	}
+	// nothing can be decoded without the parameter sets
+	if len(s.avc.SPS) == 0 || len(nalus) == 0 {
+		return
+	}
+
+	tag := rtmp.VideoTag{KeyFrame: keyFrame, CodecID: rtmp.CodecAVC, PacketType: rtmp.PacketData, Data: s.avc.JoinNALUs(nalus)}
+	s.send(flvTag{video: true, keyFrame: keyFrame, timestamp: timestamp, payload: tag.Marshal()})
+}
+
+// runAudio turns the AAC frames of the encoder into tags until the encoder is closed
+func (s *restreamSink) runAudio(encoder *transcode.OpusToAAC) {
+	sent := false
+	frames := 0
+	for frame := range encoder.Frames() {
+		config, _ := encoder.Config()
+		if !sent {
+			sent = true
+			header := rtmp.AudioTag{SoundFormat: rtmp.SoundFormatAAC, PacketType: rtmp.PacketSequenceHeader, Data: config.Marshal()}
+			s.lock.Lock()
+			s.audioHeader = header.Marshal()
+			s.lock.Unlock()
+			s.send(flvTag{timestamp: s.audioTimestamp(0, config), payload: s.audioHeader})
+		}
+
+		tag := rtmp.AudioTag{SoundFormat: rtmp.SoundFormatAAC, PacketType: rtmp.PacketData, Data: frame}
+		s.send(flvTag{timestamp: s.audioTimestamp(frames, config), payload: tag.Marshal()})
+		frames++
+	}
+}
+
+// audioTimestamp counts the frames from when the first audio packet arrived
+func (s *restreamSink) audioTimestamp(frames int, config transcode.AACConfig) uint32 {
+	s.lock.Lock()
+	base := s.audioBase
+	s.lock.Unlock()
+	return uint32((base + time.Duration(frames)*config.FrameDuration()) / time.Millisecond)
+}
+
+func (t *restreamTimeline) timestamp(start time.Time, rtpTimestamp uint32) uint32 {
+	if !t.started {
+		// line the video up with the audio by when its first frame arrived
+		t.started = true
+		t.base = time.Since(start)
+		t.lastTS = rtpTimestamp
+	}
+	t.unwrapped += uint64(rtpTimestamp - t.lastTS)
+	t.lastTS = rtpTimestamp
+	return uint32((t.base + time.Duration(t.unwrapped)*time.Second/90000) / time.Millisecond)
+}
+
+// send hands the tag to every destination
+func (s *restreamSink) send(tag flvTag) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, target := range s.targets {
+		if tag.video && target.waitKeyFrame {
+			if !tag.keyFrame {
+				continue
+			}
+			target.waitKeyFrame = false
+		}
+
+		// drop the tag rather than hold up the other destinations
+		select {
+		case target.tags <- tag:
+		default:
+			target.waitKeyFrame = true
+		}
+	}
+}
+
+func (s *restreamSink) WriteRTP(track *SimulcastTrack, rid string, packet *rtp.Packet) {
+	// only the best layer gets restreamed
+	if rid != track.BestLayer() {
+		return
+	}
+
+	s.lock.Lock()
+	source := &s.audio
+	codec := webrtc.MimeTypeOpus
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		source = &s.video
+		codec = webrtc.MimeTypeH264
+	}
+	// FLV can only carry H.264 (and AAC, which the Opus gets transcoded to) and we only restream the first track of each kind
+	if track.Codec.MimeType != codec || (*source != "" && *source != track.ID) {
+		s.lock.Unlock()
+		return
+	}
+	*source = track.ID
+	s.lock.Unlock()
+
+	// drop the packet rather than hold up the forwarding loop if the remuxing is falling behind
+	select {
+	case s.packets <- sinkPacket{kind: track.Kind, packet: packet}:
+	default:
+	}
+}
+
+func (s *restreamSink) TrackEnded(track *SimulcastTrack) {
+	s.lock.Lock()
+	// free up the slot so the next track of this kind gets restreamed
+	switch track.ID {
+	case s.video:
+		s.video = ""
+	case s.audio:
+		s.audio = ""
+	default:
+		s.lock.Unlock()
+		return
+	}
+	// the remuxing takes the lock too so it can't be held while we wait on it
+	s.lock.Unlock()
+	s.packets <- sinkPacket{kind: track.Kind, reset: true}
+}
+
+// add starts pushing to a destination, starting with the sequence headers
+func (s *restreamSink) add(target *restreamTarget) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.videoHeader != nil {
+		target.tags <- flvTag{video: true, keyFrame: true, payload: s.videoHeader}
+	}
+	if s.audioHeader != nil {
+		target.tags <- flvTag{payload: s.audioHeader}
+	}
+	target.waitKeyFrame = true
+	s.targets = append(s.targets, target)
+}
+
+// remove stops pushing to a destination, it returns false if there was no such destination
+func (s *restreamSink) remove(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, target := range s.targets {
+		if target.ID == id {
+			s.targets = append(s.targets[:i], s.targets[i+1:]...)
+			close(target.tags)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *restreamSink) list() []Restream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	restreams := []Restream{}
+	for _, target := range s.targets {
+		restreams = append(restreams, target.Restream)
+	}
+	return restreams
+}
+
+// close stops the remuxing (and the transcoding along with it), the sink has to be removed from the room first
+func (s *restreamSink) close() {
+	close(s.packets)
+}
+
+// run pushes the tags to the destination until it's removed or the connection fails
+func (t *restreamTarget) run(onError func()) {
+	defer func() {
+		if err := t.client.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	for tag := range t.tags {
+		var err error
+		if tag.video {
+			err = t.client.WriteVideo(tag.timestamp, tag.payload)
+		} else {
+			err = t.client.WriteAudio(tag.timestamp, tag.payload)
+		}
+		if err == nil {
+			err = t.client.Err()
+		}
+		if err != nil {
+			log.Println(err)
+			onError()
+			// drain whatever got queued before the removal
+			for range t.tags {
+			}
+			return
+		}
+	}
+}
+
+// allowRestream checks that the url is an RTMP url on one of the allowed hosts
+func allowRestream(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") {
+		return ErrRestreamNotAllowed
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range RestreamHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	return ErrRestreamNotAllowed
+}
+
+// AddRestream starts pushing the room to an RTMP url, it returns the id of the restream
+func (r *Room) AddRestream(url string) (string, error) {
+	if err := allowRestream(url); err != nil {
+		return "", err
+	}
+	client, err := rtmp.Dial(url)
+	if err != nil {
+		return "", err
+	}
+	if err := client.WriteMetadata(rtmp.Object{"videocodecid": rtmp.CodecAVC, "audiocodecid": rtmp.SoundFormatAAC}); err != nil {
+		client.Close()
+		return "", err
+	}
+
+	r.restreamLock.Lock()
+	defer r.restreamLock.Unlock()
+
+	if r.restream == nil {
+		sink := newRestreamSink()
+		r.restream = sink
+		r.Peers.AddSink(sink)
+		// get the restream a key frame so the destinations can start right away
+		r.Peers.DispatchKeyFrame()
+	}
+
+	target := &restreamTarget{
+		Restream: Restream{ID: guuid.New().String(), URL: url},
+		client:   client,
+		tags:     make(chan flvTag, restreamBuffer),
+	}
+	r.restream.add(target)
+	go target.run(func() {
+		if err := r.RemoveRestream(target.ID); err != nil && !errors.Is(err, ErrRestreamNotFound) {
+			log.Println(err)
+		}
+	})
+	r.Peers.DispatchKeyFrame()
+	return target.ID, nil
+}
+
+// RemoveRestream stops pushing to a destination, the remuxing stops with the last one
+func (r *Room) RemoveRestream(id string) error {
+	r.restreamLock.Lock()
+	defer r.restreamLock.Unlock()
+
+	if r.restream == nil || !r.restream.remove(id) {
+		return ErrRestreamNotFound
+	}
+	if len(r.restream.list()) == 0 {
+		r.Peers.RemoveSink(r.restream)
+		r.restream.close()
+		r.restream = nil
+	}
+	return nil
+}
+
+// Restreams lists the destinations the room is being pushed to
+func (r *Room) Restreams() []Restream {
+	r.restreamLock.Lock()
+	defer r.restreamLock.Unlock()
+
+	if r.restream == nil {
+		return []Restream{}
+	}
+	return r.restream.list()
+}
+
+// StopRestreams stops pushing to every destination
+func (r *Room) StopRestreams() {
+	for _, restream := range r.Restreams() {
+		if err := r.RemoveRestream(restream.ID); err != nil && !errors.Is(err, ErrRestreamNotFound) {
+			log.Println(err)
+		}
+	}
+}
+
+func equalSets(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if string(a[i]) != string(b[i]) {
+			return false
+		}
+	}
+	return true
+}
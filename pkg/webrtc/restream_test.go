@@ -0,0 +1,159 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"videochat/pkg/rtmp"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// tagPublisher collects the video tags an RTMP server receives
+type tagPublisher struct {
+	tags chan rtmp.VideoTag
+}
+
+func (p *tagPublisher) WriteVideo(timestamp uint32, payload []byte) error {
+	tag, err := rtmp.ParseVideoTag(payload)
+	if err != nil {
+		return err
+	}
+	p.tags <- tag
+	return nil
+}
+
+func (p *tagPublisher) WriteAudio(timestamp uint32, payload []byte) error { return nil }
+func (p *tagPublisher) Close() error                                      { return nil }
+
+func TestAllowRestream(t *testing.T) {
+	defer func(hosts []string) { RestreamHosts = hosts }(RestreamHosts)
+	RestreamHosts = []string{"live.example.com", "*.twitch.tv"}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"rtmp://live.example.com/app/key", true},
+		{"rtmps://LIVE.example.com:443/app/key", true},
+		{"rtmp://ingest.fra.twitch.tv/app/key", true},
+		{"rtmp://twitch.tv.evil.com/app/key", false},
+		{"rtmp://eviltwitch.tv/app/key", false},
+		{"rtmp://127.0.0.1/app/key", false},
+		{"rtmp://169.254.169.254/app/key", false},
+		{"http://live.example.com/app/key", false},
+		{"live.example.com/app/key", false},
+	}
+	for _, test := range tests {
+		err := allowRestream(test.url)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.url, allowed, test.allowed)
+		}
+	}
+
+	RestreamHosts = nil
+	if err := allowRestream("rtmp://live.example.com/app/key"); !errors.Is(err, ErrRestreamNotAllowed) {
+		t.Errorf("restreaming allowed without any allowed hosts: %v", err)
+	}
+}
+
+func TestRestreamToLocalServer(t *testing.T) {
+	defer func(hosts []string) { RestreamHosts = hosts }(RestreamHosts)
+	RestreamHosts = []string{"127.0.0.1"}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &tagPublisher{tags: make(chan rtmp.VideoTag, 16)}
+	keys := make(chan string, 1)
+	go rtmp.Serve(listener, func(app, key string) (rtmp.Publisher, error) {
+		keys <- app + "/" + key
+		return publisher, nil
+	})
+	defer listener.Close()
+
+	room := &Room{Peers: &Peers{TrackLocals: make(map[string]*SimulcastTrack)}}
+	id, err := room.AddRestream("rtmp://" + listener.Addr().String() + "/live/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer room.StopRestreams()
+	if key := <-keys; key != "live/secret" {
+		t.Errorf("published under %q, want live/secret", key)
+	}
+	if restreams := room.Restreams(); len(restreams) != 1 || restreams[0].ID != id {
+		t.Errorf("restreams are %v", restreams)
+	}
+
+	track := &SimulcastTrack{
+		ID:    "video",
+		Kind:  webrtc.RTPCodecTypeVideo,
+		Codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+		ssrcs: map[string]webrtc.SSRC{"": 1},
+	}
+	sps := []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x01}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	frames := [][][]byte{{sps, pps, idr}, {{0x41, 0x9A, 0x02}}, {{0x41, 0x9A, 0x04}}}
+	sequence := uint16(0)
+	for i, frame := range frames {
+		for j, nalu := range frame {
+			sequence++
+			room.restream.WriteRTP(track, "", &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    102,
+					SequenceNumber: sequence,
+					Timestamp:      uint32(i * 3000),
+					SSRC:           1,
+					Marker:         j == len(frame)-1,
+				},
+				Payload: nalu,
+			})
+		}
+	}
+
+	next := func() rtmp.VideoTag {
+		select {
+		case tag := <-publisher.tags:
+			return tag
+		case <-time.After(5 * time.Second):
+			t.Fatal("no video tag received")
+			return rtmp.VideoTag{}
+		}
+	}
+
+	header := next()
+	if header.PacketType != rtmp.PacketSequenceHeader || !header.KeyFrame || header.CodecID != rtmp.CodecAVC {
+		t.Fatalf("first tag is %+v, want the sequence header", header)
+	}
+	config, err := rtmp.ParseAVCConfig(header.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.SPS) != 1 || !bytes.Equal(config.SPS[0], sps) || len(config.PPS) != 1 || !bytes.Equal(config.PPS[0], pps) {
+		t.Errorf("sequence header has sps %x pps %x", config.SPS, config.PPS)
+	}
+
+	keyFrame := next()
+	if keyFrame.PacketType != rtmp.PacketData || !keyFrame.KeyFrame {
+		t.Fatalf("second tag is %+v, want the key frame", keyFrame)
+	}
+	// the parameter sets only go into the sequence header
+	if nalus := config.SplitNALUs(keyFrame.Data); len(nalus) != 1 || !bytes.Equal(nalus[0], idr) {
+		t.Errorf("key frame has nalus %x, want %x", nalus, idr)
+	}
+
+	inter := next()
+	if inter.PacketType != rtmp.PacketData || inter.KeyFrame {
+		t.Fatalf("third tag is %+v, want an inter frame", inter)
+	}
+	if nalus := config.SplitNALUs(inter.Data); len(nalus) != 1 || !bytes.Equal(nalus[0], frames[1][0]) {
+		t.Errorf("inter frame has nalus %x, want %x", nalus, frames[1][0])
+	}
+}
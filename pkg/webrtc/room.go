@@ -3,29 +3,40 @@ package webrtc
 import (
 	"encoding/json"
 	"log"
-	"os"
 	"sync"
 
+	"videochat/pkg/chat"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
 )
 
-func RoomConn(c *websocket.Conn, p *Peers) {
-	var config webrtc.Configuration
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		config = turnConfig
+func RoomConn(c *websocket.Conn, p *Peers, hub *chat.Hub) {
+	// the role is picked once the participant is in the list of connections
+	participant := NewParticipant(c.Query("name"), RoleGuest)
+	ws := &ThreadSafeWriter{
+		Conn:  c,
+		Mutex: sync.Mutex{},
+	}
+	messages, stopReading := readMessages(c)
+	defer stopReading()
+
+	// hold the participant in the lobby until a host lets them in
+	if !p.WaitInLobby(participant, ws, messages) {
+		return
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, estimator, err := newPeerConnection(ICE.Configuration(TURNUser(StreamID(c.Params("uuid")), addrHost(c.RemoteAddr()))))
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	// close the peer connection when the function returns
+	// close the peer connection when the function returns, pruning it from the list is what lets everyone know the participant left
 	defer func() {
 		if cErr := peerConnection.Close(); cErr != nil {
 			log.Print(cErr)
 		}
+		p.SignalPeerConnections()
 	}()
 
 	// setup the receiving RTP streams for audio and video data types
@@ -40,15 +51,26 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 
 	newPeer := PeerConnectionState{
 		PeerConnection: peerConnection,
-		Websocket: &ThreadSafeWriter{
-			Conn:  c,
-			Mutex: sync.Mutex{},
-		}}
+		Websocket:      ws,
+		Layers:         NewSubscriberLayers(),
+		Bandwidth:      &Bandwidth{Estimator: estimator},
+		Subscription:   NewSubscription(),
+		Participant:    participant,
+	}
+
+	// Add our new PeerConnection to global list (this is what lets everyone know the participant joined)
+	p.Join(newPeer)
+
+	// the chat can also be had over the peer connection (the hosts get to moderate it)
+	leaveChat, err := openChat(peerConnection, hub, participant.DisplayName, participant.ChatRole())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer leaveChat()
 
-	// Add our new PeerConnection to global list
-	p.ListLock.Lock()
-	p.Connections = append(p.Connections, newPeer)
-	p.ListLock.Unlock()
+	// keep the video we forward within the bandwidth of the new peer
+	go p.AdaptLayers(newPeer)
 
 	// log the current list of PeerConnections
 	log.Println(p.Connections)
@@ -89,42 +111,20 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 		}
 	})
 
-	// Set the handler for remote track arrival
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	// Set the handler for remote track arrival (called once for every simulcast layer)
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		// Create a track to fan out our incoming video to all peers
 		// this is because once we get a remote track for this room we want to share those
 		// video frames with all other peers
-		trackLocal := p.AddTrack(track)
-		if trackLocal == nil {
-			return
-		}
-		defer p.RemoveTrack(trackLocal)
-
-		buf := make([]byte, 1500)
-		// continuously read from the track and write to the trackLocal until we run into an error
-		for {
-			i, _, err := track.Read(buf)
-			if err != nil {
-				return
-			}
-
-			if _, err = trackLocal.Write(buf[:i]); err != nil {
-				return
-			}
-		}
-
+		p.ForwardTrack(track, receiver, peerConnection)
 	})
 
 	// update the list of PeerConnections
 	p.SignalPeerConnections()
 	// handle the websocket connection message events
 	message := &websocketMessage{}
-	for {
-		_, raw, err := c.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			return
-		} else if err := json.Unmarshal(raw, message); err != nil {
+	for raw := range messages {
+		if err := json.Unmarshal(raw, message); err != nil {
 			log.Println(err)
 			return
 		}
@@ -158,6 +158,74 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 				log.Println(err)
 				return
 			}
+
+		// if the client asks for a different simulcast layer then switch it over on the next key frame
+		case "layer":
+			p.SetLayer(peerConnection, message.Data)
+
+		// if the client picks the participants it wants to receive then renegotiate with just their tracks
+		case "subscribe":
+			request := SubscribeRequest{}
+			if err := json.Unmarshal([]byte(message.Data), &request); err != nil {
+				log.Println(err)
+				return
+			}
+
+			if err := p.Subscribe(peerConnection, request); err != nil {
+				log.Println(err)
+			}
+
+		// hosts can mute the other participants, ask them to unmute and kick them
+		case "mute":
+			if err := p.Mute(participant, message.Data); err != nil {
+				log.Println(err)
+			}
+
+		case "request-unmute":
+			if err := p.RequestUnmute(participant, message.Data); err != nil {
+				log.Println(err)
+			}
+
+		case "kick":
+			if err := p.Kick(participant, message.Data); err != nil {
+				log.Println(err)
+			}
+
+		// hosts decide who waiting in the lobby gets in, and whether there is a lobby at all
+		case "admit":
+			if err := p.Admit(participant, message.Data); err != nil {
+				log.Println(err)
+			}
+
+		case "deny":
+			if err := p.Deny(participant, message.Data); err != nil {
+				log.Println(err)
+			}
+
+		case "lobby":
+			if err := p.SetLobby(participant, message.Data == "on"); err != nil {
+				log.Println(err)
+			}
+
+		// a participant muted by a host can unmute once a host asked them to
+		case "unmute":
+			if err := p.Unmute(participant); err != nil {
+				log.Println(err)
+			}
+
+		// if we are given an offer (clients publishing simulcast have to offer) then answer it
+		case "offer":
+			offer := webrtc.SessionDescription{}
+			// unmarshal the offer message
+			if err := json.Unmarshal([]byte(message.Data), &offer); err != nil {
+				log.Println(err)
+				return
+			}
+
+			if err := p.Answer(peerConnection, newPeer.Websocket, offer); err != nil {
+				log.Println(err)
+				return
+			}
 		}
 	}
 }
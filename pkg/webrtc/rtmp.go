@@ -0,0 +1,204 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"videochat/pkg/rtmp"
+	"videochat/pkg/transcode"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	rtmpMTU = 1200
+	// RTMP timestamps are in milliseconds, H.264 runs on a 90kHz clock and Opus on a 48kHz one
+	rtmpVideoClockRate = 90000
+	rtmpAudioClockRate = 48000
+)
+
+// RTMPPublisher publishes the H.264 video and AAC audio (transcoded to Opus) of an RTMP client into a room
+type RTMPPublisher struct {
+	peers    *Peers
+	streamID string
+
+	video      *SimulcastTrack
+	videoLayer *Layer
+	packetizer rtp.Packetizer
+	avc        rtmp.AVCConfig
+
+	// the AAC is decoded by ffmpeg, the Opus it produces is published by the audio goroutine
+	aac     transcode.AACConfig
+	encoder *transcode.AACToOpus
+	clock   *aacClock
+	audio   sync.WaitGroup
+}
+
+func NewRTMPPublisher(p *Peers) *RTMPPublisher {
+	return &RTMPPublisher{
+		peers:    p,
+		streamID: "rtmp-" + guuid.New().String(),
+	}
+}
+
+func (r *RTMPPublisher) WriteVideo(timestamp uint32, payload []byte) error {
+	tag, err := rtmp.ParseVideoTag(payload)
+	if err != nil {
+		return err
+	}
+
+	switch tag.PacketType {
+	case rtmp.PacketSequenceHeader:
+		r.avc, err = rtmp.ParseAVCConfig(tag.Data)
+		return err
+	case rtmp.PacketData:
+	default:
+		return nil
+	}
+
+	// wait for the sequence header and a key frame before publishing anything
+	if r.avc.NALULength == 0 || (r.video == nil && !tag.KeyFrame) {
+		return nil
+	}
+	if r.video == nil {
+		r.video, r.videoLayer = r.peers.PublishTrack(webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   rtmpVideoClockRate,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		}, "rtmp-video-"+guuid.New().String(), r.streamID)
+		r.packetizer = rtp.NewPacketizer(rtmpMTU, 0, 0, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), rtmpVideoClockRate)
+	}
+
+	// turn the frame into Annex B with the parameter sets in front of every key frame so viewers can join at any of them
+	nalus := r.avc.SplitNALUs(tag.Data)
+	if tag.KeyFrame {
+		nalus = append(append(append([][]byte{}, r.avc.SPS...), r.avc.PPS...), nalus...)
+	}
+	frame := []byte{}
+	for _, nalu := range nalus {
+		frame = append(append(frame, 0, 0, 0, 1), nalu...)
+	}
+
+	// RTP carries the presentation time
+	pts := uint32(int64(timestamp)+int64(tag.CompositionTime)) * (rtmpVideoClockRate / 1000)
+	for _, packet := range r.packetizer.Packetize(frame, 0) {
+		packet.Timestamp = pts
+		r.peers.WriteTrack(r.video, r.videoLayer, packet)
+	}
+	return nil
+}
+
+func (r *RTMPPublisher) WriteAudio(timestamp uint32, payload []byte) error {
+	tag, err := rtmp.ParseAudioTag(payload)
+	if err != nil {
+		return err
+	}
+
+	switch tag.PacketType {
+	case rtmp.PacketSequenceHeader:
+		r.aac, err = transcode.ParseAACConfig(tag.Data)
+		if err != nil || r.encoder != nil {
+			return err
+		}
+		if r.encoder, err = transcode.NewAACToOpus(); err != nil {
+			return err
+		}
+		r.clock = &aacClock{frameDuration: r.aac.FrameDuration()}
+		r.audio.Add(1)
+		go r.publishAudio(r.encoder, r.clock)
+		return nil
+	case rtmp.PacketData:
+		if r.encoder == nil {
+			return nil
+		}
+		r.clock.add(timestamp)
+		// the encoder has no way to tell the config so every frame carries it
+		_, err = r.encoder.Write(r.aac.ADTS(tag.Data))
+		return err
+	}
+	return nil
+}
+
+// publishAudio publishes the Opus packets of the encoder until it's closed
+func (r *RTMPPublisher) publishAudio(encoder *transcode.AACToOpus, clock *aacClock) {
+	defer r.audio.Done()
+
+	var track *SimulcastTrack
+	var layer *Layer
+	packetizer := rtp.NewPacketizer(rtmpMTU, 0, 0, &codecs.OpusPayloader{}, rtp.NewRandomSequencer(), rtmpAudioClockRate)
+	samples := uint32(transcode.OpusFrameDuration.Seconds() * rtmpAudioClockRate)
+
+	for packet := range encoder.Packets() {
+		if track == nil {
+			track, layer = r.peers.PublishTrack(webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   rtmpAudioClockRate,
+				Channels:    2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1",
+			}, "rtmp-audio-"+guuid.New().String(), r.streamID)
+			defer r.peers.UnpublishTrack(track, layer)
+		}
+
+		// like the video, the timestamps come from the RTMP clock (so the two stay in sync), not the packetizer
+		timestamp := clock.next(transcode.OpusFrameDuration)
+		for _, p := range packetizer.Packetize(packet, samples) {
+			p.Timestamp = timestamp
+			r.peers.WriteTrack(track, layer, p)
+		}
+	}
+}
+
+// aacClock maps the Opus packets coming out of the encoder back onto the RTMP timestamps of the AAC frames that went in
+// NOTE ffmpeg doesn't keep the gaps between the frames, so each Opus packet is as far into the AAC frames as the
+// packets before it add up to
+type aacClock struct {
+	lock          sync.Mutex
+	frameDuration time.Duration
+	// the RTMP timestamps of the frames written to the encoder that it hasn't got through yet
+	pending []uint32
+	// how far into the first pending frame the encoder is
+	offset time.Duration
+}
+
+// add records the RTMP timestamp of a frame written to the encoder
+func (c *aacClock) add(timestamp uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, timestamp)
+}
+
+// next returns the RTP timestamp of the next packet coming out of the encoder, which plays for duration
+func (c *aacClock) next(duration time.Duration) uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// move on to the frame the packet starts in (the last one is kept to count from)
+	for c.offset >= c.frameDuration && len(c.pending) > 1 {
+		c.pending = c.pending[1:]
+		c.offset -= c.frameDuration
+	}
+	if len(c.pending) == 0 {
+		return 0
+	}
+
+	timestamp := c.pending[0]*(rtmpAudioClockRate/1000) + uint32(c.offset*rtmpAudioClockRate/time.Second)
+	c.offset += duration
+	return timestamp
+}
+
+// Close takes the tracks of the publisher out of the room
+func (r *RTMPPublisher) Close() error {
+	if r.video != nil {
+		r.peers.UnpublishTrack(r.video, r.videoLayer)
+	}
+
+	var err error
+	if r.encoder != nil {
+		err = r.encoder.Close()
+	}
+	r.audio.Wait()
+	return err
+}
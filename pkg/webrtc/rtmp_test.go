@@ -0,0 +1,48 @@
+package webrtc
+
+import (
+	"testing"
+
+	"videochat/pkg/transcode"
+)
+
+func TestAACClock(t *testing.T) {
+	// 48kHz AAC frames play for 21.33ms, the Opus packets for 20ms
+	frameDuration := transcode.AACConfig{FrequencyIndex: 3}.FrameDuration()
+
+	tests := []struct {
+		name string
+		// the RTMP timestamps of the AAC frames written to the encoder
+		frames []uint32
+		// the RTP timestamps of the Opus packets coming out of it
+		want []uint32
+	}{
+		{
+			name:   "continuous",
+			frames: []uint32{1000, 1021, 1043, 1064},
+			want:   []uint32{48000, 48960, 1021*48 + 896, 1043*48 + 832, 1064*48 + 768},
+		},
+		{
+			name:   "the publisher paused",
+			frames: []uint32{1000, 1021, 5000, 5021},
+			// the encoder doesn't keep the gap, the timestamps jump over it
+			want: []uint32{48000, 48960, 1021*48 + 896, 5000*48 + 832},
+		},
+		{
+			name:   "past the last frame",
+			frames: []uint32{1000},
+			want:   []uint32{48000, 48960, 49920},
+		},
+	}
+	for _, test := range tests {
+		clock := &aacClock{frameDuration: frameDuration}
+		for _, timestamp := range test.frames {
+			clock.add(timestamp)
+		}
+		for i, want := range test.want {
+			if timestamp := clock.next(transcode.OpusFrameDuration); timestamp != want {
+				t.Errorf("%s: packet %d got %d, want %d", test.name, i, timestamp, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionKind tells publishing (WHIP) and playing (WHEP) sessions apart, it matches their resource URL
+type SessionKind string
+
+const (
+	SessionWHIP SessionKind = "whip"
+	SessionWHEP SessionKind = "whep"
+)
+
+// a peer connection created over plain HTTP (WHIP/WHEP) and the stream it belongs to
+type session struct {
+	peerConnection *webrtc.PeerConnection
+	streamID       string
+	kind           SessionKind
+}
+
+// how long we wait for our candidates before answering with the ones gathered so far
+var gatherTimeout = 5 * time.Second
+
+// the HTTP sessions, keyed by the id in their resource URL
+var (
+	sessionsLock sync.Mutex
+	sessions     = make(map[string]session)
+)
+
+// answerSession answers the offer of a HTTP client, these clients don't trickle so we wait for all of our candidates
+func answerSession(peerConnection *webrtc.PeerConnection, offer string) (string, error) {
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+	preferH264(peerConnection)
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	// an unreachable STUN or TURN server would hold the request until the client gives up
+	select {
+	case <-gatherComplete:
+	case <-time.After(gatherTimeout):
+		log.Println("answering before ICE gathering completed")
+	}
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// CloseSession tears down the peer connection of a WHIP/WHEP session
+// the session has to belong to the given stream and be of the given kind, so that its id alone can't end it
+func CloseSession(id, streamID string, kind SessionKind) error {
+	peerConnection, err := lookupSession(id, streamID, kind)
+	if err != nil {
+		return err
+	}
+
+	// the session gets removed from the map by the connection state handler
+	return peerConnection.Close()
+}
+
+// lookupSession returns the peer connection of a session, as long as it matches the stream and kind of the URL
+func lookupSession(id, streamID string, kind SessionKind) (*webrtc.PeerConnection, error) {
+	sessionsLock.Lock()
+	s, ok := sessions[id]
+	sessionsLock.Unlock()
+	if !ok || s.streamID != streamID || s.kind != kind {
+		return nil, ErrSessionNotFound
+	}
+	return s.peerConnection, nil
+}
+
+func addSession(id, streamID string, kind SessionKind, peerConnection *webrtc.PeerConnection) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sessions[id] = session{peerConnection: peerConnection, streamID: streamID, kind: kind}
+}
+
+func removeSession(id string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	delete(sessions, id)
+}
+
+// AddSessionCandidates adds the candidates trickled by a WHEP/WHIP client in a SDP fragment
+func AddSessionCandidates(id, streamID string, kind SessionKind, fragment string) error {
+	peerConnection, err := lookupSession(id, streamID, kind)
+	if err != nil {
+		return err
+	}
+
+	// the fragment can hold a mid and any number of candidates
+	mid := ""
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if err := peerConnection.AddICECandidate(candidate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
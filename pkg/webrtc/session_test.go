@@ -0,0 +1,89 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCloseSessionChecksStreamAndKind(t *testing.T) {
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	addSession("session", "stream", SessionWHEP, peerConnection)
+	defer removeSession("session")
+
+	tests := []struct {
+		name     string
+		id       string
+		streamID string
+		kind     SessionKind
+	}{
+		{"unknown session", "other", "stream", SessionWHEP},
+		{"other stream", "session", "other", SessionWHEP},
+		{"other kind", "session", "stream", SessionWHIP},
+	}
+	for _, test := range tests {
+		if err := CloseSession(test.id, test.streamID, test.kind); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrSessionNotFound)
+		}
+		if err := AddSessionCandidates(test.id, test.streamID, test.kind, ""); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s: adding candidates got %v, want %v", test.name, err, ErrSessionNotFound)
+		}
+	}
+	if state := peerConnection.ConnectionState(); state == webrtc.PeerConnectionStateClosed {
+		t.Fatal("a mismatched request closed the session")
+	}
+
+	if err := CloseSession("session", "stream", SessionWHEP); err != nil {
+		t.Fatal(err)
+	}
+	if state := peerConnection.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("session is %s after closing it", state)
+	}
+}
+
+func TestAnswerSessionGatherTimeout(t *testing.T) {
+	timeout := gatherTimeout
+	gatherTimeout = 100 * time.Millisecond
+	defer func() { gatherTimeout = timeout }()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a STUN server that never answers keeps the gathering going
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:192.0.2.1:3478"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	start := time.Now()
+	answer, err := answerSession(peerConnection, offer.SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answering took %v", elapsed)
+	}
+	if answer == "" {
+		t.Error("got an empty answer")
+	}
+}
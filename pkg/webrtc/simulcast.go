@@ -0,0 +1,463 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// the rids we expect a simulcast publisher to send, ordered from the highest to the lowest quality
+// (full, half and quarter resolution)
+var simulcastLayers = []string{"f", "h", "q"}
+
+// the layer a sender is bound to while its video is paused
+const pausedLayer = "-"
+
+// SimulcastTrack groups the layers of a single published track and forwards them to the subscribers
+type SimulcastTrack struct {
+	ID       string
+	StreamID string
+	Kind     webrtc.RTPCodecType
+	Codec    webrtc.RTPCodecCapability
+	// the layers keyed by their rid (non simulcast tracks only have the "" layer)
+	Layers map[string]*Layer
+
+	// the publishing peer connection, used to request key frames
+	publisher *webrtc.PeerConnection
+	// who publishes the track (nil for tracks that aren't published by a participant of the room, like WHIP or RTMP)
+	participant *Participant
+
+	lock sync.Mutex
+	// the ssrc of each layer that is currently being published
+	ssrcs map[string]webrtc.SSRC
+	// the track each subscriber receives, keyed by the sender it's sent with
+	subscribers map[*webrtc.RTPSender]*subscriberTrack
+	// the latest sender report of each layer
+	reports map[string]SenderReport
+}
+
+// Layer is a single simulcast layer of a published track, whoever publishes it writes its packets through it
+// (see WriteTrack)
+type Layer struct {
+	RID string
+}
+
+// subscriberTrack is the track a subscriber receives, it's the same track whichever layer the subscriber is on so the
+// layers are switched without renegotiating
+// NOTE the fields past layers are guarded by the lock of the SimulcastTrack
+type subscriberTrack struct {
+	local  *webrtc.TrackLocalStaticRTP
+	layers *SubscriberLayers
+
+	// the layer being forwarded (pausedLayer while paused) and the one to switch to on its next key frame
+	rid     string
+	pending string
+	// set until the first packet of a new layer is forwarded
+	switched bool
+	rewriter rtpRewriter
+}
+
+// rtpRewriter turns the packets of the layers a subscriber is switched between into a single stream, the sequence
+// numbers and timestamps of each layer are offset to carry on from the last packet sent
+type rtpRewriter struct {
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	// the newest packet sent and when
+	lastSeq  uint16
+	lastTS   uint32
+	lastSent time.Time
+}
+
+// rewrite returns the header the subscriber is sent, restart is set on the first packet of a new layer
+func (r *rtpRewriter) rewrite(header rtp.Header, restart bool, clockRate uint32, now time.Time) rtp.Header {
+	if restart && r.started {
+		// the timestamp moves on by the time that passed since the last packet, so the playout doesn't stall or jump
+		elapsed := uint32(now.Sub(r.lastSent).Seconds() * float64(clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.seqOffset = r.lastSeq + 1 - header.SequenceNumber
+		r.tsOffset = r.lastTS + elapsed - header.Timestamp
+	}
+	header.SequenceNumber += r.seqOffset
+	header.Timestamp += r.tsOffset
+
+	// late packets don't move the stream back
+	if !r.started || int16(header.SequenceNumber-r.lastSeq) > 0 {
+		r.lastSeq = header.SequenceNumber
+		r.lastTS = header.Timestamp
+		r.lastSent = now
+	}
+	r.started = true
+	return header
+}
+
+// SenderReport maps the RTP timestamps of a layer to the wallclock of the publisher
+type SenderReport struct {
+	NTPTime time.Time
+	RTPTime uint32
+	// when the report reached us
+	Arrival time.Time
+}
+
+// SubscriberLayers records the layer a subscriber wants to receive and the layer each of its senders is bound to
+type SubscriberLayers struct {
+	lock sync.Mutex
+	// the layer the subscriber asked for
+	target string
+	// the best layer that fits in the bandwidth of the subscriber ("" until it's been estimated)
+	limit string
+	// set when the subscriber doesn't have the bandwidth for any layer
+	paused  bool
+	current map[string]string
+}
+
+func NewSubscriberLayers() *SubscriberLayers {
+	return &SubscriberLayers{
+		target:  simulcastLayers[0],
+		current: make(map[string]string),
+	}
+}
+
+// Target returns the layer the subscriber should be on, which is the one it asked for unless its bandwidth is too low
+func (l *SubscriberLayers) Target() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limit != "" && layerRank(l.limit) > layerRank(l.target) {
+		return l.limit
+	}
+	return l.target
+}
+
+// Limit returns the layer cap from the bandwidth estimate
+func (l *SubscriberLayers) Limit() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// Paused checks if the video of this subscriber is paused
+func (l *SubscriberLayers) Paused() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.paused
+}
+
+func (l *SubscriberLayers) setLimit(rid string, paused bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = rid
+	l.paused = paused
+}
+
+func (l *SubscriberLayers) SetTarget(rid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.target = rid
+}
+
+// Current returns the layer the sender of the given track is currently bound to
+func (l *SubscriberLayers) Current(trackID string) (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rid, ok := l.current[trackID]
+	return rid, ok
+}
+
+func (l *SubscriberLayers) bind(trackID, rid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.current[trackID] = rid
+}
+
+func (l *SubscriberLayers) forget(trackID string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.current, trackID)
+}
+
+// layerRank orders the layers by quality (lower is better), unknown rids are ranked below every known layer
+func layerRank(rid string) int {
+	for i, layer := range simulcastLayers {
+		if layer == rid {
+			return i
+		}
+	}
+	return len(simulcastLayers)
+}
+
+// pickLayer returns the best layer that isn't above the target quality, falling back to the lowest available layer
+func (s *SimulcastTrack) pickLayer(target string) string {
+	best, fallback := "", ""
+	haveBest, haveFallback := false, false
+	for rid := range s.Layers {
+		rank := layerRank(rid)
+		if rank >= layerRank(target) && (!haveBest || rank < layerRank(best)) {
+			best, haveBest = rid, true
+		}
+		if !haveFallback || rank > layerRank(fallback) {
+			fallback, haveFallback = rid, true
+		}
+	}
+	if haveBest {
+		return best
+	}
+	return fallback
+}
+
+// addSubscriber starts forwarding the layer to the track of a subscriber
+func (s *SimulcastTrack) addSubscriber(sender *webrtc.RTPSender, local *webrtc.TrackLocalStaticRTP, layers *SubscriberLayers, rid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscribers[sender] = &subscriberTrack{local: local, layers: layers, rid: rid}
+	layers.bind(s.ID, rid)
+}
+
+// removeSubscriber stops forwarding to the sender once it's taken off its peer connection
+func (s *SimulcastTrack) removeSubscriber(sender *webrtc.RTPSender) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers, sender)
+}
+
+// requestSwitch moves the sender over to the given layer as soon as that layer produces a key frame
+func (s *SimulcastTrack) requestSwitch(sender *webrtc.RTPSender, rid string) {
+	if _, ok := s.Layers[rid]; !ok {
+		return
+	}
+
+	s.lock.Lock()
+	subscriber, ok := s.subscribers[sender]
+	if ok {
+		subscriber.pending = rid
+	}
+	s.lock.Unlock()
+
+	// ask the publisher for a key frame so the subscriber doesn't have to wait for the next one
+	if ok {
+		s.requestKeyFrame(rid)
+	}
+}
+
+// cancelSwitch drops any switch that is still pending for the sender
+func (s *SimulcastTrack) cancelSwitch(sender *webrtc.RTPSender) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if subscriber, ok := s.subscribers[sender]; ok {
+		subscriber.pending = ""
+	}
+}
+
+// pause stops forwarding to the sender right away (no need to wait for a key frame)
+func (s *SimulcastTrack) pause(sender *webrtc.RTPSender) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if subscriber, ok := s.subscribers[sender]; ok {
+		subscriber.rid = pausedLayer
+		subscriber.pending = ""
+		subscriber.layers.bind(s.ID, pausedLayer)
+	}
+}
+
+// forward writes a packet of a layer to the subscribers on it, the subscribers waiting for the layer are switched
+// over on its key frames
+// NOTE a subscriber that can't be written to is left alone, it's dropped once its peer connection closes
+func (s *SimulcastTrack) forward(rid string, packet *rtp.Packet, keyFrame bool) {
+	type write struct {
+		local  *webrtc.TrackLocalStaticRTP
+		packet *rtp.Packet
+	}
+	writes := []write{}
+	now := time.Now()
+
+	s.lock.Lock()
+	for _, subscriber := range s.subscribers {
+		if keyFrame && subscriber.pending == rid {
+			subscriber.rid, subscriber.pending, subscriber.switched = rid, "", true
+			subscriber.layers.bind(s.ID, rid)
+		}
+		if subscriber.rid != rid {
+			continue
+		}
+		header := subscriber.rewriter.rewrite(packet.Header, subscriber.switched, s.Codec.ClockRate, now)
+		subscriber.switched = false
+		writes = append(writes, write{subscriber.local, &rtp.Packet{Header: header, Payload: packet.Payload}})
+	}
+	s.lock.Unlock()
+
+	// the writes go out without the lock so the layers don't hold each other up
+	for _, w := range writes {
+		_ = w.local.WriteRTP(w.packet)
+	}
+}
+
+func (s *SimulcastTrack) setSSRC(rid string, ssrc webrtc.SSRC) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ssrcs[rid] = ssrc
+}
+
+func (s *SimulcastTrack) removeSSRC(rid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.ssrcs, rid)
+	delete(s.reports, rid)
+}
+
+func (s *SimulcastTrack) setSenderReport(rid string, report SenderReport) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reports[rid] = report
+}
+
+// SenderReport returns the latest sender report of the layer
+func (s *SimulcastTrack) SenderReport(rid string) (SenderReport, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	report, ok := s.reports[rid]
+	return report, ok
+}
+
+// ParticipantID returns the id of the participant publishing the track, or its stream id if there is none
+func (s *SimulcastTrack) ParticipantID() string {
+	if s.participant != nil {
+		return s.participant.ID
+	}
+	return s.StreamID
+}
+
+// Muted checks if the track is the audio of a participant muted by a host
+func (s *SimulcastTrack) Muted() bool {
+	return s.Kind == webrtc.RTPCodecTypeAudio && s.participant != nil && s.participant.Muted()
+}
+
+// BestLayer returns the highest quality layer that is currently being published
+func (s *SimulcastTrack) BestLayer() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	best, found := "", false
+	for rid := range s.ssrcs {
+		if !found || layerRank(rid) < layerRank(best) {
+			best, found = rid, true
+		}
+	}
+	return best
+}
+
+// Live checks if any layer of the track is still being published
+func (s *SimulcastTrack) Live() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.ssrcs) > 0
+}
+
+// readSenderReports reads the RTCP of a remote layer until the track ends, keeping the sender reports
+func readSenderReports(receiver *webrtc.RTPReceiver, remote *webrtc.TrackRemote, track *SimulcastTrack) {
+	for {
+		var packets []rtcp.Packet
+		var err error
+		if remote.RID() != "" {
+			packets, _, err = receiver.ReadSimulcastRTCP(remote.RID())
+		} else {
+			packets, _, err = receiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok && sr.SSRC == uint32(remote.SSRC()) {
+				track.setSenderReport(remote.RID(), SenderReport{
+					NTPTime: ntpTime(sr.NTPTime),
+					RTPTime: sr.RTPTime,
+					Arrival: time.Now(),
+				})
+			}
+		}
+	}
+}
+
+// ntpTime converts a 64 bit NTP timestamp (seconds since 1900 in 32.32 fixed point)
+func ntpTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanoseconds := (ntp & 0xFFFFFFFF) * 1e9 >> 32
+	return time.Unix(seconds, int64(nanoseconds))
+}
+
+func (s *SimulcastTrack) requestKeyFrame(rid string) {
+	s.lock.Lock()
+	ssrc, ok := s.ssrcs[rid]
+	s.lock.Unlock()
+	if !ok || s.publisher == nil {
+		return
+	}
+
+	_ = s.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{
+			MediaSSRC: uint32(ssrc),
+		},
+	})
+}
+
+// isKeyFrame checks if the RTP payload starts a key frame for the given codec
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		vp8 := &codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil {
+			return false
+		}
+		// the P bit of the VP8 payload header is 0 for key frames
+		return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+	case webrtc.MimeTypeVP9:
+		vp9 := &codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B
+	case webrtc.MimeTypeH264:
+		return isH264KeyFrame(payload)
+	}
+	return false
+}
+
+func isH264KeyFrame(payload []byte) bool {
+	const (
+		naluTypeIDR  = 5
+		naluTypeSPS  = 7
+		naluTypeSTAP = 24
+		naluTypeFUA  = 28
+	)
+
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1F; naluType {
+	case naluTypeIDR, naluTypeSPS:
+		return true
+	case naluTypeSTAP:
+		// walk the aggregated NAL units looking for an SPS or IDR slice
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1F; t == naluTypeIDR || t == naluTypeSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case naluTypeFUA:
+		// only the first fragment of an IDR slice counts
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == naluTypeIDR
+	}
+	return false
+}
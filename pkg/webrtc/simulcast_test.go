@@ -0,0 +1,95 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestPickLayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers []string
+		target string
+		want   string
+	}{
+		{"full", []string{"f", "h", "q"}, "f", "f"},
+		{"half", []string{"f", "h", "q"}, "h", "h"},
+		{"quarter", []string{"f", "h", "q"}, "q", "q"},
+		{"best below the target", []string{"h", "q"}, "f", "h"},
+		{"skips a missing layer", []string{"f", "q"}, "h", "q"},
+		{"nothing at or below the target", []string{"f", "h"}, "q", "h"},
+		{"only full", []string{"f"}, "q", "f"},
+		{"not simulcast", []string{""}, "f", ""},
+	}
+	for _, test := range tests {
+		track := &SimulcastTrack{Layers: map[string]*Layer{}}
+		for _, rid := range test.layers {
+			track.Layers[rid] = nil
+		}
+		if got := track.pickLayer(test.target); got != test.want {
+			t.Errorf("%s: %v for %q got %q, want %q", test.name, test.layers, test.target, got, test.want)
+		}
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	type packet struct {
+		seq     uint16
+		ts      uint32
+		restart bool
+		// when the packet is sent (ms)
+		at      int
+		wantSeq uint16
+		wantTS  uint32
+	}
+	tests := []struct {
+		name    string
+		packets []packet
+	}{
+		{"continuous", []packet{
+			{100, 9000, false, 0, 100, 9000},
+			{101, 9000, false, 1, 101, 9000},
+			{102, 12000, false, 33, 102, 12000},
+		}},
+		{"first layer", []packet{
+			{100, 9000, true, 0, 100, 9000},
+			{101, 12000, false, 33, 101, 12000},
+		}},
+		{"switch", []packet{
+			{100, 9000, false, 0, 100, 9000},
+			{101, 12000, false, 33, 101, 12000},
+			{5000, 700000, true, 66, 102, 14970},
+			{5001, 703000, false, 99, 103, 17970},
+		}},
+		{"switch back", []packet{
+			{100, 9000, false, 0, 100, 9000},
+			{5000, 700000, true, 33, 101, 11970},
+			{102, 15000, true, 66, 102, 14940},
+		}},
+		{"sequence wrap", []packet{
+			{65535, 9000, false, 0, 65535, 9000},
+			{10, 700000, true, 33, 0, 11970},
+			{11, 700000, false, 34, 1, 11970},
+		}},
+		{"late packet", []packet{
+			{100, 9000, false, 0, 100, 9000},
+			{102, 15000, false, 66, 102, 15000},
+			{101, 12000, false, 70, 101, 12000},
+			{5000, 700000, true, 99, 103, 17970},
+		}},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		rewriter := rtpRewriter{}
+		for i, p := range test.packets {
+			at := start.Add(time.Duration(p.at) * time.Millisecond)
+			got := rewriter.rewrite(rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}, p.restart, 90000, at)
+			if got.SequenceNumber != p.wantSeq || got.Timestamp != p.wantTS {
+				t.Errorf("%s: packet %d got %d/%d, want %d/%d",
+					test.name, i, got.SequenceNumber, got.Timestamp, p.wantSeq, p.wantTS)
+			}
+		}
+	}
+}
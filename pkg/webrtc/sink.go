@@ -0,0 +1,47 @@
+package webrtc
+
+import (
+	"github.com/pion/rtp"
+)
+
+// TrackSink is a server side consumer of the tracks published into a room (like the HLS packager)
+type TrackSink interface {
+	// WriteRTP is called with every packet of every layer of the published tracks
+	// NOTE this runs on the forwarding loop so it shouldn't block, the packet may be kept but not modified
+	WriteRTP(track *SimulcastTrack, rid string, packet *rtp.Packet)
+	// TrackEnded is called once the last layer of a track stops being published
+	TrackEnded(track *SimulcastTrack)
+}
+
+func (p *Peers) AddSink(s TrackSink) {
+	p.sinksLock.Lock()
+	defer p.sinksLock.Unlock()
+	p.sinks = append(p.sinks, s)
+}
+
+func (p *Peers) RemoveSink(s TrackSink) {
+	p.sinksLock.Lock()
+	defer p.sinksLock.Unlock()
+	for i := range p.sinks {
+		if p.sinks[i] == s {
+			p.sinks = append(p.sinks[:i], p.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Peers) writeSinks(track *SimulcastTrack, rid string, packet *rtp.Packet) {
+	p.sinksLock.RLock()
+	defer p.sinksLock.RUnlock()
+	for _, s := range p.sinks {
+		s.WriteRTP(track, rid, packet)
+	}
+}
+
+func (p *Peers) endSinks(track *SimulcastTrack) {
+	p.sinksLock.RLock()
+	defer p.sinksLock.RUnlock()
+	for _, s := range p.sinks {
+		s.TrackEnded(track)
+	}
+}
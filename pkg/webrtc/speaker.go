@@ -0,0 +1,180 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// how often the dominant speaker is picked again
+	speakerInterval = 300 * time.Millisecond
+	// how much of each audio level goes into the smoothed level (the levels come in every 20ms or so)
+	speakerSmoothing = 0.1
+	// how loud (in dB above -127dBov) someone has to be to count as speaking
+	speakerThreshold = 60
+	// how much louder than the current speaker someone has to be to take over, so it doesn't flap between two people
+	speakerMargin = 6
+	// how long a track can go without audio levels before it counts as silent (with DTX nothing is sent in silences)
+	speakerTimeout = time.Second
+)
+
+// speakerDetector picks the dominant speaker of the room out of the audio levels of the published tracks
+type speakerDetector struct {
+	lock     sync.Mutex
+	levels   map[string]*speakerLevel
+	dominant string
+	picked   time.Time
+
+	// the latest change that still has to be announced, and whether a goroutine is on it
+	pending    *activeSpeaker
+	announcing bool
+}
+
+type speakerLevel struct {
+	streamID string
+	// the smoothed loudness, 0 is silence and 127 as loud as it gets
+	loudness float64
+	last     time.Time
+}
+
+// activeSpeaker is the data of the active-speaker event, the ids are empty when nobody is speaking
+type activeSpeaker struct {
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+}
+
+// observe takes in an audio level of a track, it returns true when the dominant speaker changed
+func (d *speakerDetector) observe(track *SimulcastTrack, level uint8, now time.Time) (activeSpeaker, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.levels == nil {
+		d.levels = make(map[string]*speakerLevel)
+	}
+	l, ok := d.levels[track.ID]
+	if !ok {
+		l = &speakerLevel{streamID: track.StreamID}
+		d.levels[track.ID] = l
+	}
+	// the level is in -dBov (0 is the loudest)
+	l.loudness += speakerSmoothing * (float64(127-level) - l.loudness)
+	l.last = now
+
+	if now.Sub(d.picked) < speakerInterval {
+		return activeSpeaker{}, false
+	}
+	d.picked = now
+	return d.pick(now)
+}
+
+// remove forgets a track once it's gone
+func (d *speakerDetector) remove(track *SimulcastTrack) (activeSpeaker, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.levels, track.ID)
+	if d.dominant != track.ID {
+		return activeSpeaker{}, false
+	}
+	return d.pick(time.Now())
+}
+
+// pick picks the loudest speaker, it returns true when it's someone else than before
+func (d *speakerDetector) pick(now time.Time) (activeSpeaker, bool) {
+	loudness := func(id string) float64 {
+		l, ok := d.levels[id]
+		if !ok || now.Sub(l.last) > speakerTimeout {
+			return 0
+		}
+		return l.loudness
+	}
+
+	loudest := ""
+	for id := range d.levels {
+		if loudness(id) >= speakerThreshold && (loudest == "" || loudness(id) > loudness(loudest)) {
+			loudest = id
+		}
+	}
+
+	current := loudness(d.dominant)
+	switch {
+	case loudest == "" || loudest == d.dominant:
+		// keep the current speaker highlighted through the pauses unless its track is gone
+		if _, ok := d.levels[d.dominant]; ok || d.dominant == "" {
+			return activeSpeaker{}, false
+		}
+		loudest = ""
+	case current >= speakerThreshold && loudness(loudest) < current+speakerMargin:
+		return activeSpeaker{}, false
+	}
+
+	d.dominant = loudest
+	speaker := activeSpeaker{TrackID: loudest}
+	if l, ok := d.levels[loudest]; ok {
+		speaker.StreamID = l.streamID
+	}
+	return speaker, true
+}
+
+// audioLevelID returns the id the audio level header extension was negotiated with (0 when it wasn't)
+func audioLevelID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.AudioLevelURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// observeAudioLevel feeds the audio level of a packet into the speaker detection of the room
+func (p *Peers) observeAudioLevel(track *SimulcastTrack, id uint8, packet *rtp.Packet) {
+	payload := packet.GetExtension(id)
+	if payload == nil {
+		return
+	}
+	level := rtp.AudioLevelExtension{}
+	if err := level.Unmarshal(payload); err != nil {
+		return
+	}
+	if speaker, changed := p.speakers.observe(track, level.Level, time.Now()); changed {
+		p.announceSpeaker(speaker)
+	}
+}
+
+// announceSpeaker lets every peer with a websocket know who the dominant speaker is
+// NOTE this is called from the forwarding loop of the audio, so the websocket writes are left to a goroutine and
+// only the latest speaker is sent if it's falling behind
+func (p *Peers) announceSpeaker(speaker activeSpeaker) {
+	d := &p.speakers
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.pending = &speaker
+	if !d.announcing {
+		d.announcing = true
+		go p.announceSpeakers()
+	}
+}
+
+// announceSpeakers sends the pending announcements until there are none left
+func (p *Peers) announceSpeakers() {
+	d := &p.speakers
+	for {
+		d.lock.Lock()
+		speaker := d.pending
+		d.pending = nil
+		if speaker == nil {
+			d.announcing = false
+		}
+		d.lock.Unlock()
+
+		if speaker == nil {
+			return
+		}
+		p.broadcast("active-speaker", *speaker, nil)
+	}
+}
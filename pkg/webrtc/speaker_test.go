@@ -0,0 +1,118 @@
+package webrtc
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSpeakerSmoothing(t *testing.T) {
+	tests := []struct {
+		name string
+		// the audio levels in -dBov, 127 is silence
+		levels   []uint8
+		loudness float64
+	}{
+		{"first packet", []uint8{27}, 10},
+		{"second packet", []uint8{27, 27}, 19},
+		{"as loud as it gets", []uint8{0}, 12.7},
+		{"silence brings it down", []uint8{27, 27, 127}, 17.1},
+		{"silence all along", []uint8{127, 127}, 0},
+	}
+	for _, test := range tests {
+		d := &speakerDetector{}
+		track := &SimulcastTrack{ID: "audio", StreamID: "stream"}
+		now := time.Now()
+		for _, level := range test.levels {
+			d.observe(track, level, now)
+			now = now.Add(20 * time.Millisecond)
+		}
+		if loudness := d.levels["audio"].loudness; math.Abs(loudness-test.loudness) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", test.name, loudness, test.loudness)
+		}
+	}
+}
+
+func TestSpeakerPick(t *testing.T) {
+	now := time.Now()
+	quiet, loud, louder := speakerThreshold-10.0, speakerThreshold+1.0, speakerThreshold+1.0+speakerMargin
+
+	tests := []struct {
+		name     string
+		dominant string
+		// the smoothed loudness of each track, and how long ago its last level came in
+		levels map[string]float64
+		stale  map[string]time.Duration
+		// who speaks afterwards, and whether it's a change
+		want    string
+		changed bool
+	}{
+		{
+			name:   "nobody speaks",
+			levels: map[string]float64{"a": quiet, "b": quiet},
+		},
+		{
+			name:   "first speaker",
+			levels: map[string]float64{"a": loud, "b": quiet},
+			want:   "a", changed: true,
+		},
+		{
+			name:     "speaker keeps talking",
+			dominant: "a",
+			levels:   map[string]float64{"a": loud, "b": quiet},
+			want:     "a",
+		},
+		{
+			name:     "slightly louder doesn't take over",
+			dominant: "a",
+			levels:   map[string]float64{"a": loud, "b": loud + speakerMargin - 1},
+			want:     "a",
+		},
+		{
+			name:     "much louder takes over",
+			dominant: "a",
+			levels:   map[string]float64{"a": loud, "b": louder},
+			want:     "b", changed: true,
+		},
+		{
+			name:     "speaker stopped and someone else started",
+			dominant: "a",
+			levels:   map[string]float64{"a": quiet, "b": loud},
+			want:     "b", changed: true,
+		},
+		{
+			name:     "speaker is kept through a pause",
+			dominant: "a",
+			levels:   map[string]float64{"a": quiet, "b": quiet},
+			want:     "a",
+		},
+		{
+			name:     "levels that stopped coming in count as silence",
+			dominant: "a",
+			levels:   map[string]float64{"a": louder, "b": loud},
+			stale:    map[string]time.Duration{"a": 2 * speakerTimeout},
+			want:     "b", changed: true,
+		},
+		{
+			name:     "speaker's track is gone",
+			dominant: "a",
+			levels:   map[string]float64{"b": quiet},
+			changed:  true,
+		},
+	}
+	for _, test := range tests {
+		d := &speakerDetector{dominant: test.dominant, levels: make(map[string]*speakerLevel)}
+		for id, loudness := range test.levels {
+			d.levels[id] = &speakerLevel{streamID: "stream-" + id, loudness: loudness, last: now.Add(-test.stale[id])}
+		}
+
+		speaker, changed := d.pick(now)
+		if changed != test.changed || d.dominant != test.want {
+			t.Errorf("%s: got %q (changed %v), want %q (changed %v)", test.name, d.dominant, changed, test.want, test.changed)
+			continue
+		}
+		if changed && (speaker.TrackID != test.want || (test.want != "" && speaker.StreamID != "stream-"+test.want)) {
+			t.Errorf("%s: announced %+v", test.name, speaker)
+		}
+	}
+}
@@ -3,22 +3,17 @@ package webrtc
 import (
 	"encoding/json"
 	"log"
-	"os"
 	"sync"
 
+	"videochat/pkg/chat"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
 )
 
-func StreamConn(c *websocket.Conn, p *Peers) {
-	// get the webrtc configuration
-	var config webrtc.Configuration
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		config = turnConfig
-	}
-
+func StreamConn(c *websocket.Conn, p *Peers, hub *chat.Hub) {
 	// create a new peer connection for this stream
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, estimator, err := newPeerConnection(ICE.Configuration(TURNUser(c.Params("suuid"), addrHost(c.RemoteAddr()))))
 	if err != nil {
 		log.Print(err)
 		return
@@ -30,6 +25,14 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 		}
 	}()
 
+	// the chat can also be had over the peer connection
+	leaveChat, err := openChat(peerConnection, hub, c.Query("name"), chat.RoleMember)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer leaveChat()
+
 	// setup the receiving RTP streams for audio and video data types
 	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
 		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
@@ -46,13 +49,19 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 		Websocket: &ThreadSafeWriter{
 			Conn:  c,
 			Mutex: sync.Mutex{},
-		}}
+		},
+		Layers:    NewSubscriberLayers(),
+		Bandwidth: &Bandwidth{Estimator: estimator},
+	}
 
 	// Add our new PeerConnection to global list
 	p.ListLock.Lock()
 	p.Connections = append(p.Connections, newPeer)
 	p.ListLock.Unlock()
 
+	// keep the video we forward within the bandwidth of the new peer
+	go p.AdaptLayers(newPeer)
+
 	// log the current list of PeerConnections
 	log.Println(p.Connections)
 
@@ -135,6 +144,10 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 				log.Println(err)
 				return
 			}
+
+		// if the client asks for a different simulcast layer then switch it over on the next key frame
+		case "layer":
+			p.SetLayer(peerConnection, message.Data)
 		}
 	}
 }
@@ -0,0 +1,112 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrUnknownLayer = errors.New("unknown simulcast layer")
+
+// SubscribeRequest is what a subscriber sends to pick the participants it receives
+type SubscribeRequest struct {
+	// go back to receiving every participant (the participants are ignored)
+	All bool `json:"all"`
+	// the participants to receive, tracks that aren't published by a participant (like RTMP) go by their stream id
+	Participants []SubscribeParticipant `json:"participants"`
+	// keep receiving the audio of every participant, only the video is limited to the ones picked
+	Audio bool `json:"audio"`
+}
+
+type SubscribeParticipant struct {
+	ID string `json:"id"`
+	// the best layer to receive of this participant ("" for the best one published)
+	MaxLayer string `json:"maxLayer"`
+}
+
+// Subscription is the set of participants a subscriber receives, a nil subscription receives everyone
+type Subscription struct {
+	lock sync.Mutex
+	// nil until the subscriber picks, which means every participant
+	participants map[string]string
+	audio        bool
+}
+
+func NewSubscription() *Subscription {
+	return &Subscription{}
+}
+
+func (s *Subscription) set(request SubscribeRequest) error {
+	participants := map[string]string(nil)
+	if !request.All {
+		participants = make(map[string]string, len(request.Participants))
+		for _, participant := range request.Participants {
+			if participant.MaxLayer != "" && layerRank(participant.MaxLayer) == len(simulcastLayers) {
+				return fmt.Errorf("%w %q", ErrUnknownLayer, participant.MaxLayer)
+			}
+			participants[participant.ID] = participant.MaxLayer
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.participants = participants
+	s.audio = request.Audio
+	return nil
+}
+
+// Wants checks if the subscriber should receive the track
+func (s *Subscription) Wants(track *SimulcastTrack) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.participants == nil || (s.audio && track.Kind == webrtc.RTPCodecTypeAudio) {
+		return true
+	}
+	_, ok := s.participants[track.ParticipantID()]
+	return ok
+}
+
+// MaxLayer returns the best layer the subscriber wants of the track ("" when it takes whatever it can get)
+func (s *Subscription) MaxLayer(track *SimulcastTrack) string {
+	if s == nil {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.participants[track.ParticipantID()]
+}
+
+// targetLayer is the layer the subscriber should be on for the track, the worst of what it asked for in general,
+// what it asked for of this participant and what its bandwidth allows
+func targetLayer(state PeerConnectionState, track *SimulcastTrack) string {
+	target := state.Layers.Target()
+	if max := state.Subscription.MaxLayer(track); max != "" && layerRank(max) > layerRank(target) {
+		target = max
+	}
+	return target
+}
+
+// Subscribe changes the participants the subscriber on the given peer connection receives and renegotiates
+func (p *Peers) Subscribe(pc *webrtc.PeerConnection, request SubscribeRequest) error {
+	p.ListLock.Lock()
+	for i := range p.Connections {
+		if p.Connections[i].PeerConnection != pc || p.Connections[i].Subscription == nil {
+			continue
+		}
+		if err := p.Connections[i].Subscription.set(request); err != nil {
+			p.ListLock.Unlock()
+			return err
+		}
+	}
+	p.ListLock.Unlock()
+
+	// drop the tracks the subscriber no longer wants and add the new ones
+	p.SignalPeerConnections()
+	return nil
+}
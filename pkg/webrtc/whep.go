@@ -0,0 +1,132 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrNoTracks = errors.New("stream has no tracks to play")
+
+// WHEPConn creates a receive only peer connection for a WHEP player, subscribed to the tracks of the stream
+// client is the address the request came from (see TURNUser), it returns the id of the new session along with the SDP answer
+func WHEPConn(offer, streamID, client string, p *Peers) (string, string, error) {
+	id := guuid.New().String()
+	peerConnection, estimator, err := newPeerConnection(ICE.Configuration(TURNUser(streamID, client)))
+	if err != nil {
+		return "", "", err
+	}
+
+	// NOTE the viewer has no websocket, so it is never sent a renegotiation offer
+	newPeer := PeerConnectionState{
+		PeerConnection: peerConnection,
+		Layers:         NewSubscriberLayers(),
+		Bandwidth:      &Bandwidth{Estimator: estimator},
+	}
+
+	// Setup hanlder for connection state change
+	peerConnection.OnConnectionStateChange(func(pp webrtc.PeerConnectionState) {
+		switch pp {
+		case webrtc.PeerConnectionStateFailed:
+			if err := peerConnection.Close(); err != nil {
+				log.Println(err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			removeSession(id)
+			p.SignalPeerConnections()
+		}
+	})
+
+	// add the tracks before answering so that they get matched with the sections the player offered
+	err = func() error {
+		p.ListLock.Lock()
+		defer p.ListLock.Unlock()
+
+		tracks := p.playableTracks()
+		if len(tracks) == 0 {
+			return ErrNoTracks
+		}
+		for _, track := range tracks {
+			if err := subscribe(newPeer, track); err != nil {
+				return err
+			}
+		}
+
+		// Add our new PeerConnection to global list
+		p.Connections = append(p.Connections, newPeer)
+		return nil
+	}()
+	if err != nil {
+		if cErr := peerConnection.Close(); cErr != nil {
+			log.Println(cErr)
+		}
+		return "", "", err
+	}
+
+	// the list isn't locked while answering, gathering the candidates can take a while
+	// (if this fails the connection gets pruned from the list once it's closed)
+	answer, err := answerSession(peerConnection, offer)
+	if err != nil {
+		if cErr := peerConnection.Close(); cErr != nil {
+			log.Println(cErr)
+		}
+		return "", "", err
+	}
+
+	// keep the video we forward within the bandwidth of the viewer
+	go p.AdaptLayers(newPeer)
+
+	addSession(id, streamID, SessionWHEP, peerConnection)
+	// get the viewer a key frame so that playback can start right away
+	p.DispatchKeyFrame()
+	return id, answer, nil
+}
+
+// playableTracks picks the audio and video track of a single publisher, since WHEP players only offer one of each
+func (p *Peers) playableTracks() []*SimulcastTrack {
+	// group the tracks by the stream (publisher) they belong to
+	streams := map[string][]*SimulcastTrack{}
+	streamIDs := []string{}
+	for _, track := range p.TrackLocals {
+		if _, ok := streams[track.StreamID]; !ok {
+			streamIDs = append(streamIDs, track.StreamID)
+		}
+		streams[track.StreamID] = append(streams[track.StreamID], track)
+	}
+	sort.Strings(streamIDs)
+
+	// prefer the first stream that has video
+	picked := ""
+	for _, streamID := range streamIDs {
+		if picked == "" {
+			picked = streamID
+		}
+		if hasKind(streams[streamID], webrtc.RTPCodecTypeVideo) {
+			picked = streamID
+			break
+		}
+	}
+
+	tracks := []*SimulcastTrack{}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		for _, track := range streams[picked] {
+			if track.Kind == kind {
+				tracks = append(tracks, track)
+				break
+			}
+		}
+	}
+	return tracks
+}
+
+func hasKind(tracks []*SimulcastTrack, kind webrtc.RTPCodecType) bool {
+	for _, track := range tracks {
+		if track.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
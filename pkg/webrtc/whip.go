@@ -0,0 +1,46 @@
+package webrtc
+
+import (
+	"log"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHIPConn publishes the tracks offered by a WHIP client (OBS, GStreamer, etc) into the room
+// client is the address the request came from (see TURNUser), it returns the id of the new session along with the SDP answer
+func WHIPConn(offer, streamID, client string, p *Peers) (string, string, error) {
+	id := guuid.New().String()
+	peerConnection, _, err := newPeerConnection(ICE.Configuration(TURNUser(streamID, client)))
+	if err != nil {
+		return "", "", err
+	}
+
+	// Setup hanlder for connection state change
+	peerConnection.OnConnectionStateChange(func(pp webrtc.PeerConnectionState) {
+		switch pp {
+		case webrtc.PeerConnectionStateFailed:
+			if err := peerConnection.Close(); err != nil {
+				log.Println(err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			removeSession(id)
+		}
+	})
+
+	// feed the tracks of the publisher into the same fan out the websocket publishers use
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		p.ForwardTrack(track, receiver, peerConnection)
+	})
+
+	answer, err := answerSession(peerConnection, offer)
+	if err != nil {
+		if cErr := peerConnection.Close(); cErr != nil {
+			log.Println(cErr)
+		}
+		return "", "", err
+	}
+
+	addSession(id, streamID, SessionWHIP, peerConnection)
+	return id, answer, nil
+}
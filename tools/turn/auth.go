@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"videochat/pkg/turnauth"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+// how long a client can go without refreshing before it stops counting against the quota of its user
+// (allocations live 10 minutes unless refreshed)
+const allocationLifetime = 10 * time.Minute
+
+// authenticator checks the static users first and then the time limited credentials of the server
+type authenticator struct {
+	static map[string]string
+	secret string
+	quota  *quota
+
+	lock sync.Mutex
+	// the user each client address last authenticated as, it's charged to the quota once the server accepts the
+	// allocation (pion checks the password after asking us for it)
+	clients map[string]authenticatedClient
+}
+
+type authenticatedClient struct {
+	user string
+	at   time.Time
+}
+
+func newAuthenticator(static map[string]string, secret string, quota *quota) *authenticator {
+	return &authenticator{
+		static:  static,
+		secret:  secret,
+		quota:   quota,
+		clients: make(map[string]authenticatedClient),
+	}
+}
+
+func (a *authenticator) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	password, user, ok := a.password(username)
+	if !ok {
+		return nil, false
+	}
+	// credentials generated without a user only identify their expiry, so those clients are told apart by their host
+	if user == "" {
+		user = addrHost(srcAddr)
+	}
+	if !a.quota.allowed(user, srcAddr) {
+		log.Println("allocation quota reached for", user, srcAddr)
+		return nil, false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	for client, c := range a.clients {
+		if now.Sub(c.at) > allocationLifetime {
+			delete(a.clients, client)
+		}
+	}
+	a.clients[clientKey(srcAddr)] = authenticatedClient{user: user, at: now}
+	return turn.GenerateAuthKey(username, realm, password), true
+}
+
+// the responses that tell us an allocation went through
+var (
+	allocateSuccess = stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse).Value()
+	refreshSuccess  = stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse).Value()
+)
+
+// sent looks at what the server sends to a client, the allocations and refreshes it accepts are charged to the quota
+// of the user the client authenticated as
+func (a *authenticator) sent(data []byte, addr net.Addr) {
+	// every STUN message starts with its type, this also skips the channel data of the relayed traffic
+	if !stun.IsMessage(data) {
+		return
+	}
+	if messageType := binary.BigEndian.Uint16(data); messageType != allocateSuccess && messageType != refreshSuccess {
+		return
+	}
+
+	a.lock.Lock()
+	client, ok := a.clients[clientKey(addr)]
+	a.lock.Unlock()
+	if ok {
+		a.quota.charge(client.user, addr)
+	}
+}
+
+// password returns the password of a username along with the user the quota is kept for
+// (a static user or the user signed into time limited credentials, which the server derives from the room or stream
+// and the host of the client so it can't be changed by the client, and is empty when there's no user)
+func (a *authenticator) password(username string) (string, string, bool) {
+	if password, ok := a.static[username]; ok {
+		return password, username, true
+	}
+	if a.secret == "" {
+		return "", "", false
+	}
+
+	password, err := turnauth.Check(a.secret, username)
+	if err != nil {
+		log.Println(err, username)
+		return "", "", false
+	}
+	_, user, _ := turnauth.Parse(username)
+	return password, user, true
+}
+
+// addrHost returns the host of a client address, without the port that changes with every connection
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// quota limits the number of allocations each user holds
+// NOTE pion doesn't tell us about allocations, so every client address a user gets an allocation from counts as one
+// until it goes quiet for an allocation lifetime (see sent and the connections in conn.go)
+type quota struct {
+	max int
+
+	lock sync.Mutex
+	// the last time each client address of a user authenticated
+	users map[string]map[string]time.Time
+}
+
+func newQuota(max int) *quota {
+	return &quota{max: max, users: make(map[string]map[string]time.Time)}
+}
+
+// allowed checks if a client of the user can get an allocation, either it holds one already or there's room for it
+func (q *quota) allowed(user string, srcAddr net.Addr) bool {
+	if q.max <= 0 {
+		return true
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.expire(time.Now())
+	clients := q.users[user]
+	_, ok := clients[clientKey(srcAddr)]
+	return ok || len(clients) < q.max
+}
+
+// charge counts the allocation of a client against the quota of the user
+// NOTE clients authenticating at the same time can all be allowed before they're charged, so a user can go over
+// the quota by the number of allocations it races
+func (q *quota) charge(user string, srcAddr net.Addr) {
+	if q.max <= 0 {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	clients := q.users[user]
+	if clients == nil {
+		clients = make(map[string]time.Time)
+		q.users[user] = clients
+	}
+	clients[clientKey(srcAddr)] = time.Now()
+}
+
+// expire forgets the clients that are gone, the lock has to be held
+func (q *quota) expire(now time.Time) {
+	for name, clients := range q.users {
+		for client, seen := range clients {
+			if now.Sub(seen) > allocationLifetime {
+				delete(clients, client)
+			}
+		}
+		if len(clients) == 0 {
+			delete(q.users, name)
+		}
+	}
+}
+
+// clientKey identifies a client by its transport and address
+func clientKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"videochat/pkg/turnauth"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+func udpAddr(ip string, port int) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestQuota(t *testing.T) {
+	q := newQuota(2)
+
+	tests := []struct {
+		name  string
+		user  string
+		addr  net.Addr
+		allow bool
+	}{
+		{"first client", "room/192.0.2.1", udpAddr("192.0.2.1", 1000), true},
+		{"second client", "room/192.0.2.1", udpAddr("192.0.2.1", 1001), true},
+		{"over the quota", "room/192.0.2.1", udpAddr("192.0.2.1", 1002), false},
+		{"known client refreshing", "room/192.0.2.1", udpAddr("192.0.2.1", 1000), true},
+		{"another user", "room/192.0.2.2", udpAddr("192.0.2.2", 1000), true},
+		{"same host in another room", "other/192.0.2.1", udpAddr("192.0.2.1", 1003), true},
+	}
+	for _, test := range tests {
+		allow := q.allowed(test.user, test.addr)
+		if allow != test.allow {
+			t.Errorf("%s: allowed %v, want %v", test.name, allow, test.allow)
+		}
+		if allow {
+			q.charge(test.user, test.addr)
+		}
+	}
+
+	// a client that went quiet for an allocation lifetime frees its slot
+	q.users["room/192.0.2.1"]["udp/192.0.2.1:1001"] = time.Now().Add(-allocationLifetime - time.Second)
+	if !q.allowed("room/192.0.2.1", udpAddr("192.0.2.1", 1002)) {
+		t.Error("a stale client still takes up a slot")
+	}
+}
+
+func TestQuotaUnlimited(t *testing.T) {
+	q := newQuota(0)
+	for port := 0; port < 100; port++ {
+		if !q.allowed("user", udpAddr("192.0.2.1", port)) {
+			t.Fatalf("client %d was refused without a quota", port)
+		}
+		q.charge("user", udpAddr("192.0.2.1", port))
+	}
+}
+
+func TestAuthenticateQuota(t *testing.T) {
+	a := newAuthenticator(map[string]string{"static": "password"}, "secret", newQuota(1))
+	// credentials handed out at different times have different usernames, even for the same user
+	credentials := func(user string, ttl time.Duration) string {
+		username, _ := turnauth.Credentials("secret", user, ttl)
+		return username
+	}
+
+	// what the server sends back once the password checks out
+	response, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		addr     net.Addr
+		ok       bool
+		// the server refuses the request after asking us for the password, so no allocation is made
+		wrongPassword bool
+	}{
+		{"signed user with the wrong password", credentials("room/192.0.2.1", 1*time.Hour), udpAddr("192.0.2.1", 999), true, true},
+		{"signed user", credentials("room/192.0.2.1", 1*time.Hour), udpAddr("192.0.2.1", 1000), true, false},
+		{"signed user again", credentials("room/192.0.2.1", 2*time.Hour), udpAddr("192.0.2.1", 1001), false, false},
+		{"another signed user", credentials("room/192.0.2.2", 3*time.Hour), udpAddr("192.0.2.2", 1000), true, false},
+		{"no user", credentials("", 4*time.Hour), udpAddr("198.51.100.1", 1000), true, false},
+		{"no user from the same host", credentials("", 5*time.Hour), udpAddr("198.51.100.1", 1001), false, false},
+		{"no user from another host", credentials("", 6*time.Hour), udpAddr("198.51.100.2", 1000), true, false},
+		{"static user", "static", udpAddr("203.0.113.1", 1000), true, false},
+		{"static user from another client", "static", udpAddr("203.0.113.2", 1000), false, false},
+		{"unknown user", "nobody", udpAddr("203.0.113.3", 1000), false, false},
+	}
+	for _, test := range tests {
+		_, ok := a.authenticate(test.username, "videochat", test.addr)
+		if ok != test.ok {
+			t.Errorf("%s: authenticated %v, want %v", test.name, ok, test.ok)
+		}
+		if ok && !test.wrongPassword {
+			a.sent(response.Raw, test.addr)
+		}
+	}
+}
+
+func TestServerChargesAfterTheCheck(t *testing.T) {
+	a := newAuthenticator(map[string]string{"static": "password"}, "", newQuota(1))
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "videochat",
+		AuthHandler: a.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: &allocationPacketConn{PacketConn: listener, auth: a},
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	allocate := func(password string) error {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := turn.NewClient(&turn.ClientConfig{
+			TURNServerAddr: listener.LocalAddr().String(),
+			Conn:           conn,
+			Username:       "static",
+			Password:       password,
+			Realm:          "videochat",
+			RTO:            50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		relay, err := client.Allocate()
+		if err == nil {
+			t.Cleanup(func() { relay.Close() })
+		}
+		return err
+	}
+
+	// the client with the wrong password doesn't take up the only slot
+	if err := allocate("wrong"); err == nil {
+		t.Fatal("allocated with the wrong password")
+	}
+	if err := allocate("password"); err != nil {
+		t.Fatalf("allocating after a failed attempt: %v", err)
+	}
+	if err := allocate("password"); err == nil {
+		t.Error("allocated over the quota")
+	}
+}
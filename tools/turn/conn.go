@@ -0,0 +1,40 @@
+package main
+
+import "net"
+
+// allocationPacketConn lets the authenticator see the responses the server sends over UDP
+type allocationPacketConn struct {
+	net.PacketConn
+	auth *authenticator
+}
+
+func (c *allocationPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.auth.sent(p, addr)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// allocationListener lets the authenticator see the responses the server sends over TCP
+type allocationListener struct {
+	net.Listener
+	auth *authenticator
+}
+
+func (l *allocationListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &allocationConn{Conn: conn, auth: l.auth}, nil
+}
+
+// allocationConn is a TCP client of the server, pion writes a message at a time and knows the client by its remote
+// address
+type allocationConn struct {
+	net.Conn
+	auth *authenticator
+}
+
+func (c *allocationConn) Write(p []byte) (int, error) {
+	c.auth.sent(p, c.RemoteAddr())
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pion/turn/v2"
+)
+
+var (
+	// the address the UDP and TCP listeners bind to
+	addr = flag.String("addr", ":3478", "")
+	// the IP handed to clients as their relay address, it has to be reachable by the other side
+	publicIP = flag.String("public-ip", "", "")
+	realm    = flag.String("realm", "videochat", "")
+	// static users (comma separated user=password pairs)
+	users = flag.String("users", "", "")
+	// the secret shared with the server (its -turn-secret) to check the time limited credentials it hands out
+	secret = flag.String("secret", "", "")
+	// the range relay ports are allocated from
+	minPort = flag.Int("min-port", 49152, "")
+	maxPort = flag.Int("max-port", 65535, "")
+	// the number of allocations each user can hold at once (0 is unlimited)
+	maxAllocations = flag.Int("max-allocations", 10, "")
+)
+
+func main() {
+	flag.Parse()
+
+	if *publicIP == "" {
+		log.Fatalln("-public-ip is required")
+	}
+	relayIP := net.ParseIP(*publicIP)
+	if relayIP == nil {
+		log.Fatalln("invalid -public-ip", *publicIP)
+	}
+	if *minPort <= 0 || *maxPort > 65535 || *minPort > *maxPort {
+		log.Fatalln("invalid relay port range", *minPort, *maxPort)
+	}
+
+	static, err := parseUsers(*users)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(static) == 0 && *secret == "" {
+		log.Fatalln("either -users or -secret is required")
+	}
+
+	udpListener, err := net.ListenPacket("udp4", *addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tcpListener, err := net.Listen("tcp4", *addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// every relay is a UDP port in the range, whichever transport the client came in on
+	relay := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(*minPort),
+			MaxPort:      uint16(*maxPort),
+		}
+	}
+
+	a := newAuthenticator(static, *secret, newQuota(*maxAllocations))
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       *realm,
+		AuthHandler: a.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: &allocationPacketConn{PacketConn: udpListener, auth: a}, RelayAddressGenerator: relay()},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: &allocationListener{Listener: tcpListener, auth: a}, RelayAddressGenerator: relay()},
+		},
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("turn server listening on", *addr, "relaying through", relayIP)
+
+	// wait for the container to be stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if err := server.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseUsers parses the user=password pairs of the -users flag
+func parseUsers(list string) (map[string]string, error) {
+	static := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		user, password, ok := strings.Cut(pair, "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid -users entry %q", pair)
+		}
+		static[user] = password
+	}
+	return static, nil
+}